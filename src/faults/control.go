@@ -0,0 +1,72 @@
+package faults
+
+//
+// RPC interface to an Injector, so that the faults of a
+// running server can be changed from outside its process.
+// A server whose transport came from Wrap() registers it
+// with Register(); then, for example,
+//
+//   args := &faults.SetRuleArgs{From: faults.Any, To: "b", Rule: faults.Unreliable}
+//   transport.Call(tr, "a", "Faults.SetRule", args, &faults.ControlReply{})
+//
+// makes every message that server a sends to b unreliable.
+//
+
+import "net/rpc"
+import "transport"
+
+type SetRuleArgs struct {
+  From string
+  To string
+  Rule Rule
+}
+
+type BlockArgs struct {
+  From string
+  To string
+  Blocked bool // false unblocks
+}
+
+type PartitionArgs struct {
+  Groups [][]string // none heals every partition
+}
+
+type ControlReply struct {
+}
+
+type Control struct {
+  in *Injector
+}
+
+func (c *Control) SetRule(args *SetRuleArgs, reply *ControlReply) error {
+  c.in.SetRule(args.From, args.To, args.Rule)
+  return nil
+}
+
+func (c *Control) Block(args *BlockArgs, reply *ControlReply) error {
+  if args.Blocked {
+    c.in.Block(args.From, args.To)
+  } else {
+    c.in.Unblock(args.From, args.To)
+  }
+  return nil
+}
+
+func (c *Control) Partition(args *PartitionArgs, reply *ControlReply) error {
+  if len(args.Groups) == 0 {
+    c.in.Heal()
+  } else {
+    c.in.Partition(args.Groups...)
+  }
+  return nil
+}
+
+//
+// if tr came from an Injector, serve that Injector's
+// Control RPCs, as "Faults", on rpcs.
+//
+func Register(rpcs *rpc.Server, tr transport.Transport) {
+  if n, ok := tr.(*node); ok {
+    rpcs.RegisterName("Faults", &Control{in: n.in})
+  }
+}
@@ -0,0 +1,318 @@
+package faults
+
+//
+// Network fault injection.
+//
+// An Injector holds a set of rules about what the network does
+// to messages on each link, and wraps the Transport of every node
+// that should obey them:
+//
+//   in := faults.New(seed, nil)
+//   tr := in.Wrap("px-0", transport.Unix{})
+//   px := paxos.MakeWithOptions(peers, 0, nil, paxos.Options{Transport: tr})
+//
+// A link is a (from, to) pair of node names; a node is named by
+// the address it listens on, or anything else for a client. Rules
+// can be changed at any time, from tests or from a running program:
+//
+//   in.SetRule("*", "px-2", faults.Rule{Drop: 0.3})  -- lossy link into px-2
+//   in.Block("px-0", "px-1")                         -- one-way partition
+//   in.Partition([]string{"px-0"}, []string{"px-1", "px-2"})
+//   in.At(5 * time.Second, func() { in.Heal() })     -- scheduled change
+//
+// Every random choice is drawn from a per-link generator derived
+// from the seed, as in package sim. Delays are measured on the
+// clock given to New(); pass a sim.Sim to run on virtual time.
+//
+// Faults are applied by the sender: a lost request never reaches
+// the server, a lost reply does, but the sender still sees an error.
+//
+
+import "time"
+import "net"
+import "net/rpc"
+import "sync"
+import "errors"
+import "reflect"
+import "hash/fnv"
+import "math/rand"
+import "sim"
+import "transport"
+
+var ErrDropped = errors.New("faults: message dropped")
+var ErrBlocked = errors.New("faults: link is partitioned")
+
+// matches any node in SetRule().
+const Any = "*"
+
+//
+// what happens to messages on a link.
+//
+type Rule struct {
+  Drop float64 // chance that a request is lost
+  DropReply float64 // chance that a reply is lost
+  Delay time.Duration // every message is delayed this long,
+  Jitter time.Duration // plus up to this much more
+  Reorder float64 // chance that a message is held back, so later ones pass it
+  Duplicate float64 // chance that a request is delivered twice
+}
+
+//
+// about one request in ten is lost, and one reply in ten.
+// tests make a server unreliable with
+//   in.SetRule(faults.Any, addr, faults.Unreliable)
+// and give every peer and clerk that talks to it a transport
+// from in.Wrap().
+//
+var Unreliable = Rule{Drop: 0.1, DropReply: 0.1}
+
+// how much longer than usual a held-back message takes.
+const reorderFactor = 10
+
+// hold-back delay when a link has no Delay or Jitter.
+const reorderMin = 10 * time.Millisecond
+
+type link struct {
+  from string
+  to string
+}
+
+type Injector struct {
+  mu sync.Mutex
+  seed int64
+  clock sim.Clock
+  rules map[link]Rule
+  blocked map[link]bool
+  rands map[link]*rand.Rand
+}
+
+//
+// make an Injector whose links are all healthy. delays
+// are timed with clock; nil means the wall clock.
+//
+func New(seed int64, clock sim.Clock) *Injector {
+  in := &Injector{seed: seed, clock: clock}
+  if in.clock == nil {
+    in.clock = sim.Real{}
+  }
+  in.rules = make(map[link]Rule)
+  in.blocked = make(map[link]bool)
+  in.rands = make(map[link]*rand.Rand)
+  return in
+}
+
+//
+// set the rule for messages from node from to node to.
+// either may be Any. the most specific rule applies:
+// (from, to), then (from, Any), then (Any, to), then
+// (Any, Any).
+//
+func (in *Injector) SetRule(from string, to string, r Rule) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  in.rules[link{from, to}] = r
+}
+
+//
+// remove every rule; links go back to healthy. doesn't
+// affect partitions.
+//
+func (in *Injector) ClearRules() {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  in.rules = make(map[link]Rule)
+}
+
+//
+// stop messages from from reaching to. the other
+// direction is unaffected.
+//
+func (in *Injector) Block(from string, to string) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  in.blocked[link{from, to}] = true
+}
+
+func (in *Injector) Unblock(from string, to string) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  delete(in.blocked, link{from, to})
+}
+
+//
+// replace all blocks with a partition into groups: nodes
+// in different groups can't reach each other. nodes that
+// are in no group are not affected.
+//
+func (in *Injector) Partition(groups ...[]string) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  in.blocked = make(map[link]bool)
+  for i, g1 := range groups {
+    for j, g2 := range groups {
+      if i == j {
+        continue
+      }
+      for _, a := range g1 {
+        for _, b := range g2 {
+          in.blocked[link{a, b}] = true
+        }
+      }
+    }
+  }
+}
+
+//
+// remove every block.
+//
+func (in *Injector) Heal() {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+  in.blocked = make(map[link]bool)
+}
+
+//
+// call f after d has passed on the Injector's clock,
+// e.g. to change partitions on a schedule.
+//
+func (in *Injector) At(d time.Duration, f func()) {
+  in.clock.Go(func() {
+    in.clock.Sleep(d)
+    f()
+  })
+}
+
+// caller must hold in.mu.
+func (in *Injector) rule(from string, to string) Rule {
+  for _, l := range []link{{from, to}, {from, Any}, {Any, to}, {Any, Any}} {
+    if r, present := in.rules[l]; present {
+      return r
+    }
+  }
+  return Rule{}
+}
+
+//
+// what happens to the next request from one node to another.
+//
+type fate struct {
+  blocked bool
+  drop bool
+  dropReply bool
+  duplicate bool
+  delay time.Duration // of the request
+  replyDelay time.Duration
+  dupDelay time.Duration // of the duplicate, after the original
+}
+
+func (in *Injector) fate(from string, to string) fate {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+
+  l := link{from, to}
+  rr := in.rands[l]
+  if rr == nil {
+    h := fnv.New64a()
+    h.Write([]byte(from))
+    h.Write([]byte{0})
+    h.Write([]byte(to))
+    rr = rand.New(rand.NewSource(in.seed ^ int64(h.Sum64())))
+    in.rands[l] = rr
+  }
+
+  r := in.rule(from, to)
+  delay := func() time.Duration {
+    d := r.Delay
+    if r.Jitter > 0 {
+      d += time.Duration(rr.Int63n(int64(r.Jitter)))
+    }
+    if rr.Float64() < r.Reorder {
+      max := reorderFactor * (r.Delay + r.Jitter)
+      if max < reorderMin {
+        max = reorderMin
+      }
+      d += time.Duration(rr.Int63n(int64(max)))
+    }
+    return d
+  }
+
+  f := fate{}
+  f.blocked = in.blocked[l]
+  f.drop = rr.Float64() < r.Drop
+  f.dropReply = rr.Float64() < r.DropReply || in.blocked[link{to, from}]
+  f.duplicate = rr.Float64() < r.Duplicate
+  f.delay = delay()
+  f.replyDelay = delay()
+  f.dupDelay = delay()
+  return f
+}
+
+//
+// the transport for node name, which sends through base
+// (nil means transport.Default) subject to the rules.
+//
+func (in *Injector) Wrap(name string, base transport.Transport) transport.Transport {
+  if base == nil {
+    base = transport.Default
+  }
+  return &node{in: in, name: name, base: base, clock: sim.ClockOf(base)}
+}
+
+type node struct {
+  in *Injector
+  name string
+  base transport.Transport
+  clock sim.Clock
+}
+
+func (n *node) Listen(addr string) (net.Listener, error) {
+  return n.base.Listen(addr)
+}
+
+func (n *node) ListenRPC(addr string, rpcs *rpc.Server) (net.Listener, error) {
+  return transport.ListenRPC(n.base, addr, rpcs)
+}
+
+func (n *node) Dial(addr string) (net.Conn, error) {
+  return n.base.Dial(addr)
+}
+
+// a wrapped simulated node still runs on virtual time.
+func (n *node) Now() time.Time { return n.clock.Now() }
+func (n *node) Sleep(d time.Duration) { n.clock.Sleep(d) }
+func (n *node) Go(f func()) { n.clock.Go(f) }
+func (n *node) Rand() sim.Rand { return sim.RandOf(n.base) }
+
+func (n *node) Call(addr string, name string, args interface{}, reply interface{}) error {
+  in := n.in
+  f := in.fate(n.name, addr)
+
+  if f.delay > 0 {
+    in.clock.Sleep(f.delay)
+  }
+  if f.blocked {
+    return ErrBlocked
+  }
+  if f.drop {
+    return ErrDropped
+  }
+
+  if f.duplicate {
+    // the copy arrives later, and its reply goes nowhere.
+    dup := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+    in.clock.Go(func() {
+      in.clock.Sleep(f.dupDelay)
+      n.base.Call(addr, name, args, dup)
+    })
+  }
+
+  err := n.base.Call(addr, name, args, reply)
+
+  if f.replyDelay > 0 {
+    in.clock.Sleep(f.replyDelay)
+  }
+  if err == nil && f.dropReply {
+    return ErrDropped
+  }
+  return err
+}
@@ -0,0 +1,212 @@
+package faults
+
+import "testing"
+import "net/rpc"
+import "sync"
+import "time"
+import "fmt"
+import "sim"
+import "transport"
+
+type Counter struct {
+  mu sync.Mutex
+  n int
+}
+
+func (c *Counter) Incr(args *int, reply *int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.n += *args
+  *reply = c.n
+  return nil
+}
+
+func (c *Counter) get() int {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.n
+}
+
+func serve(tr transport.Transport, addr string) *Counter {
+  c := &Counter{}
+  rpcs := rpc.NewServer()
+  rpcs.Register(c)
+  Register(rpcs, tr)
+  l, _ := transport.ListenRPC(tr, addr, rpcs)
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go rpcs.ServeConn(conn)
+    }
+  }()
+  return c
+}
+
+func incr(tr transport.Transport, addr string) error {
+  args := 1
+  var reply int
+  return tr.Call(addr, "Counter.Incr", &args, &reply)
+}
+
+func TestRules(t *testing.T) {
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+  s.SetNetwork(0, 0, 0)
+  in := New(1, s)
+
+  a := in.Wrap("a", s.Node("a"))
+  b := in.Wrap("b", s.Node("b"))
+  ca := serve(a, "a")
+  cb := serve(b, "b")
+
+  fmt.Printf("Test: Healthy links ...\n")
+
+  for i := 0; i < 10; i++ {
+    if err := incr(a, "b"); err != nil {
+      t.Fatalf("call a->b: %v", err)
+    }
+  }
+  if cb.get() != 10 {
+    t.Fatalf("b counted %v, expected 10", cb.get())
+  }
+  if sim.RandOf(a) != sim.RandOf(s.Node("a")) {
+    t.Fatalf("a wrapped node doesn't use its base's random source")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Drops ...\n")
+
+  in.SetRule("a", "b", Rule{Drop: 0.5})
+  nfail := 0
+  for i := 0; i < 200; i++ {
+    if incr(a, "b") != nil {
+      nfail++
+    }
+  }
+  if nfail < 60 || nfail > 140 {
+    t.Fatalf("%v of 200 calls failed with Drop 0.5", nfail)
+  }
+  if cb.get() != 10 + 200 - nfail {
+    t.Fatalf("dropped requests reached the server")
+  }
+  // the other direction is unaffected.
+  for i := 0; i < 10; i++ {
+    if err := incr(b, "a"); err != nil {
+      t.Fatalf("call b->a: %v", err)
+    }
+  }
+
+  in.SetRule("a", Any, Rule{DropReply: 1})
+  in.SetRule("a", "b", Rule{})
+  if incr(a, "b") != nil {
+    t.Fatalf("(a, b) rule did not take precedence over (a, Any)")
+  }
+  n := ca.get()
+  if err := incr(a, "a"); err != ErrDropped {
+    t.Fatalf("call with a lost reply returned %v", err)
+  }
+  if ca.get() != n + 1 {
+    t.Fatalf("request with a lost reply was not executed")
+  }
+  in.ClearRules()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Delay and duplication ...\n")
+
+  in.SetRule(Any, Any, Rule{Delay: 50 * time.Millisecond})
+  t0 := s.Now()
+  incr(a, "b")
+  if d := s.Now().Sub(t0); d < 100 * time.Millisecond {
+    t.Fatalf("round trip took %v, expected at least 100ms", d)
+  }
+
+  in.SetRule(Any, Any, Rule{Duplicate: 1})
+  n = cb.get()
+  incr(a, "b")
+  s.Sleep(time.Second)
+  if cb.get() != n + 2 {
+    t.Fatalf("duplicated request executed %v times", cb.get() - n)
+  }
+  in.ClearRules()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPartitions(t *testing.T) {
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+  in := New(1, s)
+
+  a := in.Wrap("a", s.Node("a"))
+  b := in.Wrap("b", s.Node("b"))
+  c := in.Wrap("c", s.Node("c"))
+  serve(a, "a")
+  cb := serve(b, "b")
+  serve(c, "c")
+
+  fmt.Printf("Test: One-way partition ...\n")
+
+  in.Block("a", "b")
+  if err := incr(a, "b"); err != ErrBlocked {
+    t.Fatalf("call a->b across a block returned %v", err)
+  }
+  // b's requests get through to a, but a's replies don't.
+  if err := incr(b, "a"); err != ErrDropped {
+    t.Fatalf("call b->a returned %v, expected a lost reply", err)
+  }
+  if err := incr(c, "b"); err != nil {
+    t.Fatalf("call c->b: %v", err)
+  }
+  in.Unblock("a", "b")
+  if err := incr(a, "b"); err != nil {
+    t.Fatalf("call a->b after Unblock(): %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scheduled partitions ...\n")
+
+  in.Partition([]string{"a"}, []string{"b", "c"})
+  if incr(a, "b") == nil || incr(c, "a") == nil {
+    t.Fatalf("call crossed a partition")
+  }
+  if err := incr(c, "b"); err != nil {
+    t.Fatalf("call within a partition: %v", err)
+  }
+  in.At(time.Second, func() { in.Heal() })
+  s.Sleep(500 * time.Millisecond)
+  if incr(a, "b") == nil {
+    t.Fatalf("partition healed early")
+  }
+  s.Sleep(time.Second)
+  if err := incr(a, "b"); err != nil {
+    t.Fatalf("partition did not heal: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Control over RPC ...\n")
+
+  args := &BlockArgs{From: "b", To: "c", Blocked: true}
+  if err := a.Call("b", "Faults.Block", args, &ControlReply{}); err != nil {
+    t.Fatalf("Faults.Block: %v", err)
+  }
+  if incr(b, "c") != ErrBlocked {
+    t.Fatalf("remote Block() had no effect")
+  }
+  pargs := &PartitionArgs{}
+  if err := a.Call("b", "Faults.Partition", pargs, &ControlReply{}); err != nil {
+    t.Fatalf("Faults.Partition: %v", err)
+  }
+  n := cb.get()
+  if incr(c, "b") != nil || cb.get() != n + 1 {
+    t.Fatalf("remote Partition() did not heal")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,18 +1,34 @@
 package kvpaxos
 
-import "net/rpc"
+import "transport"
+import "sim"
 import "time"
 
 type Clerk struct {
+  mu sim.Mutex // one request at a time
   servers []string
+  tr transport.Transport
+  clock sim.Clock
   // You will have to modify this struct.
+  me int64 // unique id, so servers can spot retries
+  seq int // number of the latest request
 }
 
 
 func MakeClerk(servers []string) *Clerk {
+  return MakeClerkOn(nil, servers)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, servers []string) *Clerk {
   ck := new(Clerk)
+  ck.tr = tr
+  ck.clock = sim.ClockOf(tr)
   ck.servers = servers
   // You'll have to add code here.
+  ck.me = sim.RandOf(tr).Int63()
   return ck
 }
 
@@ -29,22 +45,14 @@ func MakeClerk(servers []string) *Clerk {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
 }
 
 //
@@ -54,41 +62,339 @@ func call(srv string, rpcname string,
 //
 func (ck *Clerk) Get(key string) string {
   // You will have to modify this function.
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
 
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &GetArgs{}
       args.Key = key
+      args.Client = ck.me
+      args.Seq = ck.seq
       var reply GetReply
-      ok := call(srv, "KVPaxos.Get", args, &reply)
+      ok := call(ck.tr, srv, "KVPaxos.Get", args, &reply)
       if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
         return reply.Value
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
   }
   return ""
 }
 
+//
+// send a Put (or a PutHash, Append, &c) until it succeeds.
+//
+func (ck *Clerk) put(args PutArgs) PutReply {
+  // You will have to modify this function.
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+  args.Client = ck.me
+  args.Seq = ck.seq
+
+  for {
+    for _, srv := range ck.servers {
+      var reply PutReply
+      ok := call(ck.tr, srv, "KVPaxos.Put", &args, &reply)
+      if ok && reply.Err == OK {
+        return reply
+      }
+    }
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
 //
 // set the value for a key.
 // keeps trying until it succeeds.
 //
 func (ck *Clerk) Put(key string, value string) {
-  // You will have to modify this function.
+  ck.put(PutArgs{Key: key, Value: value})
+}
+
+//
+// set the value for a key, and remove the key ttl
+// after the Put takes effect, unless it is set again
+// before then.
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+  ck.put(PutArgs{Key: key, Value: value, TTL: ttl})
+}
+
+//
+// set the value for a key to hash(previous value + value),
+// and return the previous value.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+  return ck.put(PutArgs{Key: key, Value: value, DoHash: true}).PreviousValue
+}
+
+//
+// append arg to a key's value, and return the
+// length of the result.
+//
+func (ck *Clerk) Append(key string, arg string) int {
+  return ck.put(PutArgs{Key: key, Value: arg, DoAppend: true}).Length
+}
+
+//
+// set a key's value to update if its value is now
+// expected (a key that does not exist counts as "").
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) CompareAndSwap(key string, expected string, update string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: update, DoCAS: true, Expected: expected})
+  return reply.Stored, reply.PreviousValue
+}
+
+//
+// set a key's value only if the key does not exist.
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: value, DoIfAbsent: true})
+  return reply.Stored, reply.PreviousValue
+}
+
+//
+// run ops as one atomic transaction; see TxnOp. returns
+// whether the guards held, and the values read by the
+// Gets that ran. ops with a step of unknown Kind are
+// refused, and return false and no values.
+//
+func (ck *Clerk) Txn(ops []TxnOp) (bool, []string) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+  args := &TxnArgs{Ops: ops, Client: ck.me, Seq: ck.seq}
 
   for {
     for _, srv := range ck.servers {
-      args := &PutArgs{}
-      args.Key = key
-      args.Value = value
-      var reply PutReply
-      ok := call(srv, "KVPaxos.Put", args, &reply)
+      var reply TxnReply
+      ok := call(ck.tr, srv, "KVPaxos.Txn", args, &reply)
       if ok && reply.Err == OK {
-        return 
+        return reply.Succeeded, reply.Values
+      }
+      if ok && reply.Err == ErrBadTxn {
+        return false, nil
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// a stream of changes to a key, or to every key with
+// a prefix; see Clerk.Watch().
+//
+type Watcher struct {
+  ck *Clerk
+  args WatchArgs
+  events []Event // fetched, not yet returned
+}
+
+//
+// watch key (or, if prefix is set, every key that starts
+// with key) for changes made by paxos instance from or
+// later. from -1 means changes from now on; a Cursor()
+// from another Watcher resumes where that one left off.
+//
+func (ck *Clerk) Watch(key string, prefix bool, from int) *Watcher {
+  return &Watcher{ck: ck, args: WatchArgs{Key: key, Prefix: prefix, From: from}}
+}
+
+//
+// wait for the next instance that changed a watched key,
+// and return its changes, which all have the same Seq.
+// returns ErrCompacted if the servers no longer have the
+// changes the Watcher is up to.
+//
+func (w *Watcher) Next() ([]Event, Err) {
+  for len(w.events) == 0 {
+    reply, ok := w.poll()
+    for ok == false {
+      w.ck.clock.Sleep(100 * time.Millisecond)
+      reply, ok = w.poll()
+    }
+    if reply.Err == ErrCompacted {
+      return nil, ErrCompacted
+    }
+    w.events = reply.Events
+    w.args.From = reply.Next
+  }
+  n := 1
+  for n < len(w.events) && w.events[n].Seq == w.events[0].Seq {
+    n++
+  }
+  es := w.events[:n]
+  w.events = w.events[n:]
+  return es, OK
+}
+
+//
+// the instance to resume from to see the changes that
+// Next() has not yet returned.
+//
+func (w *Watcher) Cursor() int {
+  if len(w.events) > 0 {
+    return w.events[0].Seq
   }
+  return w.args.From
+}
+
+// ask each server in turn for changes.
+func (w *Watcher) poll() (WatchReply, bool) {
+  for _, srv := range w.ck.servers {
+    var reply WatchReply
+    ok := call(w.ck.tr, srv, "KVPaxos.Watch", &w.args, &reply)
+    if ok && (reply.Err == OK || reply.Err == ErrCompacted) {
+      return reply, true
+    }
+  }
+  return WatchReply{}, false
+}
+
+//
+// up to limit (at most MaxScan; 0 means MaxScan) keys in
+// [start, end), in order, with their values. end "" means
+// no upper bound. also returns the start for the next page,
+// or "" if there are no more keys. each page is read at one
+// point in the log, but pages may see different states.
+//
+func (ck *Clerk) Scan(start string, end string, limit int) ([]KeyValue, string) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+  args := &ScanArgs{Start: start, End: end, Limit: limit, Client: ck.me, Seq: ck.seq}
+
+  for {
+    for _, srv := range ck.servers {
+      var reply ScanReply
+      ok := call(ck.tr, srv, "KVPaxos.Scan", args, &reply)
+      if ok && reply.Err == OK {
+        return reply.Pairs, reply.Next
+      }
+    }
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// every key that starts with prefix, in order, a
+// page of MaxScan at a time.
+//
+func (ck *Clerk) ListPrefix(prefix string) []string {
+  keys := []string{}
+  end := prefixEnd(prefix)
+  for next := prefix; ; {
+    pairs, more := ck.Scan(next, end, 0)
+    for _, kv := range pairs {
+      keys = append(keys, kv.Key)
+    }
+    if more == "" {
+      return keys
+    }
+    next = more
+  }
+}
+
+//
+// fetch key's value as of paxos instance seq, i.e. after
+// every instance below seq was applied. returns "" if the
+// key did not exist then, and ErrCompacted if no server
+// still has the value. seq must be one the log has got to,
+// such as a ReadSnapshot's Seq(); otherwise this keeps
+// trying until it has.
+//
+func (ck *Clerk) GetAt(key string, seq int) (string, Err) {
+  args := &GetAtArgs{Key: key, At: seq}
+  for {
+    compacted := false
+    for _, srv := range ck.servers {
+      var reply GetReply
+      ok := call(ck.tr, srv, "KVPaxos.GetAt", args, &reply)
+      if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+        return reply.Value, OK
+      }
+      if ok && reply.Err == ErrCompacted {
+        compacted = true
+      }
+    }
+    if compacted {
+      return "", ErrCompacted
+    }
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// like Scan(), but as of paxos instance seq, as for GetAt().
+//
+func (ck *Clerk) ScanAt(start string, end string, limit int, seq int) ([]KeyValue, string, Err) {
+  args := &ScanAtArgs{Start: start, End: end, Limit: limit, At: seq}
+  for {
+    compacted := false
+    for _, srv := range ck.servers {
+      var reply ScanReply
+      ok := call(ck.tr, srv, "KVPaxos.ScanAt", args, &reply)
+      if ok && reply.Err == OK {
+        return reply.Pairs, reply.Next, OK
+      }
+      if ok && reply.Err == ErrCompacted {
+        compacted = true
+      }
+    }
+    if compacted {
+      return nil, "", ErrCompacted
+    }
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// a consistent view of the store at one point in the log.
+//
+type ReadView struct {
+  ck *Clerk
+  seq int
+}
+
+//
+// start reading as of now: the view sees every update that
+// completed before ReadSnapshot() was called, and none that
+// starts after it returns. a view's reads fail with
+// ErrCompacted once the servers have forgotten its versions.
+//
+func (ck *Clerk) ReadSnapshot() *ReadView {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+  args := &ReadSnapshotArgs{Client: ck.me, Seq: ck.seq}
+
+  for {
+    for _, srv := range ck.servers {
+      var reply ReadSnapshotReply
+      ok := call(ck.tr, srv, "KVPaxos.ReadSnapshot", args, &reply)
+      if ok && reply.Err == OK {
+        return &ReadView{ck, reply.At}
+      }
+    }
+    ck.clock.Sleep(100 * time.Millisecond)
+  }
+}
+
+// the paxos instance the view reads as of.
+func (v *ReadView) Seq() int {
+  return v.seq
+}
+
+func (v *ReadView) Get(key string) (string, Err) {
+  return v.ck.GetAt(key, v.seq)
+}
+
+func (v *ReadView) Scan(start string, end string, limit int) ([]KeyValue, string, Err) {
+  return v.ck.ScanAt(start, end, limit, v.seq)
 }
@@ -1,8 +1,15 @@
 package kvpaxos
 
+import "hash/fnv"
+import "time"
+
 const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
+  ErrNoSnapshot = "ErrNoSnapshot"
+  ErrCompacted = "ErrCompacted"
+  ErrFuture = "ErrFuture"
+  ErrBadTxn = "ErrBadTxn" // a TxnOp of unknown Kind
 )
 type Err string
 
@@ -10,18 +17,144 @@ type PutArgs struct {
   // You'll have to add definitions here.
   Key string
   Value string
+  DoHash bool // store hash(previous value + Value)
+  DoAppend bool // store previous value + Value
+  DoCAS bool // store Value only if the current value is Expected
+  Expected string
+  DoIfAbsent bool // store Value only if the key does not exist
+  TTL time.Duration // for a plain Put: remove the key this long after; 0 means never
+  Client int64 // the Clerk's unique id
+  Seq int // the Clerk's request number; retries reuse it
 }
 
 type PutReply struct {
   Err Err
+  PreviousValue string // for DoHash, DoCAS and DoIfAbsent
+  Length int // of the new value, for DoAppend
+  Stored bool // for DoCAS and DoIfAbsent
 }
 
 type GetArgs struct {
   // You'll have to add definitions here.
   Key string
+  Client int64
+  Seq int
 }
 
 type GetReply struct {
   Err Err
   Value string
 }
+
+//
+// read as of paxos instance At, i.e. after every
+// instance below At has been applied.
+//
+type GetAtArgs struct {
+  Key string
+  At int
+}
+
+type ReadSnapshotArgs struct {
+  Client int64
+  Seq int
+}
+
+type ReadSnapshotReply struct {
+  Err Err
+  At int // the instance to read as of
+}
+
+//
+// one step of a transaction. Compares are the guards; if
+// every one holds, the Gets and Puts with Else unset run,
+// in order, and otherwise the ones with Else set do.
+//
+const (
+  TxnCompare = "Compare" // the value of Key is Value ("" if none)
+  TxnGet = "Get"
+  TxnPut = "Put"
+)
+
+type TxnOp struct {
+  Kind string
+  Key string
+  Value string
+  Else bool
+}
+
+type TxnArgs struct {
+  Ops []TxnOp
+  Client int64
+  Seq int
+}
+
+type TxnReply struct {
+  Err Err
+  Succeeded bool // whether the guards held
+  Values []string // one per Get that ran, in order
+}
+
+type KeyValue struct {
+  Key string
+  Value string
+}
+
+type ScanArgs struct {
+  Start string
+  End string // exclusive; "" means no bound
+  Limit int // at most MaxScan; 0 means MaxScan
+  Client int64
+  Seq int
+}
+
+type ScanAtArgs struct {
+  Start string
+  End string
+  Limit int
+  At int // as for GetAtArgs
+}
+
+type ScanReply struct {
+  Err Err
+  Pairs []KeyValue // in key order
+  Next string // the Start of the next page; "" if there is none
+}
+
+//
+// Key was set to Value (or, if Deleted, expired)
+// by paxos instance Seq.
+//
+type Event struct {
+  Seq int
+  Key string
+  Value string
+  Deleted bool
+}
+
+type WatchArgs struct {
+  Key string
+  Prefix bool // watch every key that starts with Key
+  From int // the first instance of interest; -1 means from now
+}
+
+type WatchReply struct {
+  Err Err
+  Events []Event
+  Next int // From for the next Watch
+}
+
+type SnapshotArgs struct {
+  Seq int // the instance the caller is stuck on
+}
+
+type SnapshotReply struct {
+  Err Err
+  Snapshot []byte // encoded; see snapshot.go
+}
+
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
@@ -0,0 +1,133 @@
+package kvpaxos
+
+//
+// An ordered index of the keys in kv.data, for scans.
+//
+// The index is a skiplist of keys; values stay in the map.
+// Each node is on level 0 and, with probability 1/2 for each
+// level, on the levels above, so a search from the top level
+// down skips about half the remaining nodes at each step.
+// The coin flips are the bits of a hash of the key, so the
+// index makes no random choices of its own.
+// The zero index is empty and ready to use.
+//
+
+const maxLevel = 24
+
+type node struct {
+  key string
+  next []*node // next[i] is the next node on level i
+}
+
+type index struct {
+  head node
+  n int
+}
+
+//
+// fill path with the last node before key on each level,
+// and return the node at key, if there is one.
+//
+func (ix *index) find(key string, path []*node) *node {
+  if ix.head.next == nil {
+    ix.head.next = make([]*node, maxLevel)
+  }
+  x := &ix.head
+  for i := maxLevel - 1; i >= 0; i-- {
+    for x.next[i] != nil && x.next[i].key < key {
+      x = x.next[i]
+    }
+    if path != nil {
+      path[i] = x
+    }
+  }
+  if x.next[0] != nil && x.next[0].key == key {
+    return x.next[0]
+  }
+  return nil
+}
+
+func (ix *index) insert(key string) {
+  path := make([]*node, maxLevel)
+  if ix.find(key, path) != nil {
+    return
+  }
+  level := 1
+  for h := hash(key); level < maxLevel && h & 1 == 0; h >>= 1 {
+    level++
+  }
+  x := &node{key: key, next: make([]*node, level)}
+  for i := 0; i < level; i++ {
+    x.next[i] = path[i].next[i]
+    path[i].next[i] = x
+  }
+  ix.n++
+}
+
+func (ix *index) remove(key string) {
+  path := make([]*node, maxLevel)
+  x := ix.find(key, path)
+  if x == nil {
+    return
+  }
+  for i := range x.next {
+    path[i].next[i] = x.next[i]
+  }
+  ix.n--
+}
+
+//
+// the first node with a key >= key, or nil. follow
+// next[0] from there for the rest in order.
+//
+func (ix *index) seek(key string) *node {
+  path := make([]*node, maxLevel)
+  ix.find(key, path)
+  return path[0].next[0]
+}
+
+// the number of keys.
+func (ix *index) len() int {
+  return ix.n
+}
+
+// most pairs one Scan returns.
+const MaxScan = 1000
+
+//
+// up to limit of the keys in [start, end), in order, with
+// their values, and the start of the rest ("" if none).
+// end "" means no upper bound.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) scan(start string, end string, limit int) ([]KeyValue, string) {
+  if limit <= 0 || limit > MaxScan {
+    limit = MaxScan
+  }
+  pairs := []KeyValue{}
+  for x := kv.keys.seek(start); x != nil; x = x.next[0] {
+    if end != "" && x.key >= end {
+      break
+    }
+    if len(pairs) == limit {
+      return pairs, x.key
+    }
+    pairs = append(pairs, KeyValue{x.key, kv.data[x.key]})
+  }
+  return pairs, ""
+}
+
+//
+// the least key greater than every key with the prefix,
+// or "" if there is none.
+//
+func prefixEnd(prefix string) string {
+  b := []byte(prefix)
+  for i := len(b) - 1; i >= 0; i-- {
+    if b[i] < 0xff {
+      b[i]++
+      return string(b[:i+1])
+    }
+  }
+  return ""
+}
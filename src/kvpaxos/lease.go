@@ -0,0 +1,173 @@
+package kvpaxos
+
+//
+// Read leases, enabled with Options.Lease.
+//
+// A server in lease mode that gets a Get proposes a LeaseOp
+// naming itself, stamped with its clock. Whether the LeaseOp
+// grants the lease is decided when it is applied, from the log
+// alone, so every server agrees on who holds it: a lease is
+// granted if it renews the current holder's lease with a later
+// stamp, or if it is stamped at least Lease + Drift after the
+// current lease's stamp. The holder serves Gets from its own
+// state until its clock passes stamp + Lease, renewing when
+// half of that has gone by.
+//
+// Every other server delays its reply to each request, Gets
+// included, until its clock passes the current lease's stamp
+// + Lease + Drift. By then the holder has stopped reading
+// locally, as long as no two clocks differ by more than Drift,
+// unless it has renewed, and a renewal comes after the request
+// in the log. So a local read never misses a completed update,
+// even when the holder is partitioned away.
+//
+// The delay is the price of local reads: while the holder keeps
+// renewing, each Put, Txn or log read at any other server waits
+// up to Lease + Drift before replying, so Clerks that write
+// should use the holder where they can. The delay cannot be
+// limited to reads, since it is a write completing elsewhere
+// that a local read must not miss.
+//
+// The log order of lease grants to a new holder is kept in
+// LeaseHistory().
+//
+
+import "time"
+import "log"
+
+type lease struct {
+  Holder int
+  Start int64 // the holder's clock, in nanoseconds
+  Duration time.Duration // zero means no lease
+  Drift time.Duration
+}
+
+// when other servers may assume the holder has stopped.
+func (l lease) expiry() int64 {
+  return l.Start + int64(l.Duration + l.Drift)
+}
+
+//
+// the lease passing to Holder, in instance Seq.
+//
+type LeaseChange struct {
+  Seq int
+  Holder int
+}
+
+//
+// apply a LeaseOp.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) grant(op Op) {
+  cur := kv.lease
+  if cur.Duration > 0 {
+    if cur.Holder == op.Holder && op.Time <= cur.Start {
+      return // a stale renewal would move the expiry back.
+    }
+    if cur.Holder != op.Holder && op.Time < cur.expiry() {
+      return
+    }
+  }
+  if cur.Duration == 0 || cur.Holder != op.Holder {
+    log.Printf("[%d] lease to %d in %d", kv.me, op.Holder, kv.applied)
+    kv.holders = append(kv.holders, LeaseChange{kv.applied, op.Holder})
+  }
+  kv.lease = lease{op.Holder, op.Time, op.Lease, op.Drift}
+}
+
+//
+// may this server serve Gets locally right now?
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) holding() bool {
+  l := kv.lease
+  return l.Duration > 0 && l.Holder == kv.me &&
+         kv.clock.Now().UnixNano() < l.Start + int64(l.Duration)
+}
+
+//
+// is it worth proposing a LeaseOp? only when this server
+// holds the lease and is half way through it, or when the
+// current lease has run out.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) wantLease() bool {
+  l := kv.lease
+  now := kv.clock.Now().UnixNano()
+  if l.Duration == 0 {
+    return true
+  }
+  if l.Holder == kv.me {
+    return now >= l.Start + int64(l.Duration / 2)
+  }
+  return now >= l.expiry()
+}
+
+//
+// try to get (or renew) the lease through the log.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) acquire() {
+  kv.opSeq++
+  op := Op{Client: kv.opClient, Seq: kv.opSeq, Kind: LeaseOp,
+           Holder: kv.me, Lease: kv.opts.Lease, Drift: kv.opts.Drift}
+  op.Time = kv.clock.Now().UnixNano()
+  kv.agree(op)
+}
+
+//
+// apply the instances this server already knows are
+// decided, without starting any.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) catchUp() {
+  for kv.dead == false {
+    if decided, _ := kv.px.Status(kv.applied); decided == false {
+      return
+    }
+    _, vs := kv.px.Entries(kv.applied)
+    kv.apply(kv.applied, vs)
+  }
+}
+
+//
+// how long a reply must be held back so that it cannot
+// race with a local read at another server.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) leaseWait() time.Duration {
+  l := kv.lease
+  if l.Duration == 0 || l.Holder == kv.me {
+    return 0
+  }
+  wait := time.Duration(l.expiry() - kv.clock.Now().UnixNano())
+  if wait < 0 {
+    return 0
+  }
+  return wait
+}
+
+//
+// the current lease holder, going by the instances this
+// server has applied, or -1 if there has never been one.
+// the holder's lease may have run out.
+//
+func (kv *KVPaxos) LeaseHolder() int {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  if kv.lease.Duration == 0 {
+    return -1
+  }
+  return kv.lease.Holder
+}
+
+//
+// every change of lease holder this server has applied,
+// in log order. renewals are left out.
+//
+func (kv *KVPaxos) LeaseHistory() []LeaseChange {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  return append([]LeaseChange{}, kv.holders...)
+}
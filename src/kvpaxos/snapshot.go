@@ -0,0 +1,188 @@
+package kvpaxos
+
+//
+// Snapshots of a server's state, for log compaction.
+//
+// Every SnapshotInterval instances a server encodes its key/value
+// map, its duplicate table, its lease and lease history, and the
+// number of instances applied,
+// and only then tells paxos it is Done() with those instances. A
+// server that finds itself waiting on an instance the others may
+// have forgotten (e.g. it was restarted) asks them for their
+// latest snapshot with the Snapshot RPC, installs it, and goes on
+// from there.
+//
+// An encoded snapshot is a four-byte format version and a
+// four-byte CRC-32 of the rest, followed by the gob-encoded
+// state. A snapshot with any other version or a bad checksum is
+// refused.
+//
+
+import "bytes"
+import "errors"
+import "encoding/gob"
+import "encoding/binary"
+import "hash/crc32"
+import "time"
+import "log"
+
+// instances applied between snapshots.
+const SnapshotInterval = 100
+
+//
+// how long to wait on an undecided instance before
+// asking the other servers for a snapshot past it.
+//
+const SnapshotWait = time.Second
+
+const snapshotVersion = 2 // 2 added Holders
+
+var errSnapshotCorrupt = errors.New("kvpaxos: snapshot checksum mismatch")
+var errSnapshotVersion = errors.New("kvpaxos: unknown snapshot version")
+
+type snapshot struct {
+  Applied int // the state after applying instances below this
+  Data map[string]string
+  Dups map[int64]dup
+  Now int64
+  Swept int64
+  Lease lease
+  Holders []LeaseChange
+  Expires map[string]int64
+}
+
+func encodeSnapshot(s snapshot) ([]byte, error) {
+  var body bytes.Buffer
+  if err := gob.NewEncoder(&body).Encode(s); err != nil {
+    return nil, err
+  }
+  buf := make([]byte, 8, 8 + body.Len())
+  binary.BigEndian.PutUint32(buf[0:4], snapshotVersion)
+  binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body.Bytes()))
+  return append(buf, body.Bytes()...), nil
+}
+
+func decodeSnapshot(buf []byte) (snapshot, error) {
+  var s snapshot
+  if len(buf) < 8 {
+    return s, errSnapshotCorrupt
+  }
+  if binary.BigEndian.Uint32(buf[0:4]) != snapshotVersion {
+    return s, errSnapshotVersion
+  }
+  if binary.BigEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(buf[8:]) {
+    return s, errSnapshotCorrupt
+  }
+  if err := gob.NewDecoder(bytes.NewReader(buf[8:])).Decode(&s); err != nil {
+    return s, err
+  }
+  // gob leaves empty maps nil.
+  if s.Data == nil {
+    s.Data = make(map[string]string)
+  }
+  if s.Dups == nil {
+    s.Dups = make(map[int64]dup)
+  }
+  return s, nil
+}
+
+//
+// snapshot the state, and let paxos forget
+// the instances it covers.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) takeSnapshot() {
+  buf, err := encodeSnapshot(snapshot{Applied: kv.applied, Data: kv.data,
+                                      Dups: kv.dups, Now: kv.now, Swept: kv.swept,
+                                      Lease: kv.lease, Holders: kv.holders,
+                                      Expires: kv.expires})
+  if err != nil {
+    log.Printf("[%d] snapshot failed: %v", kv.me, err)
+    return
+  }
+  kv.trimEvents(kv.snapApplied)
+  kv.snapMu.Lock()
+  kv.snapshot = buf
+  kv.snapApplied = kv.applied
+  kv.snapMu.Unlock()
+  kv.px.Done(kv.applied - 1)
+  kv.pruneVersions(kv.px.Min())
+}
+
+//
+// replace the state with s, which must be
+// later than the state now.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) install(s snapshot, buf []byte) {
+  kv.data = s.Data
+  kv.keys = index{}
+  for key := range kv.data {
+    kv.keys.insert(key)
+  }
+  kv.dups = s.Dups
+  kv.now = s.Now
+  kv.swept = s.Swept
+  kv.lease = s.Lease
+  kv.holders = s.Holders
+  kv.expires = s.Expires
+  kv.rebuildExpiries()
+  kv.applied = s.Applied
+  kv.events = nil
+  kv.eventsFrom = s.Applied
+  kv.versions = nil
+  kv.replaced = nil
+  kv.versionsFrom = s.Applied
+  kv.snapMu.Lock()
+  kv.snapshot = buf
+  kv.snapApplied = s.Applied
+  kv.snapMu.Unlock()
+  kv.px.Done(s.Applied - 1)
+}
+
+//
+// ask the other servers for a snapshot that covers
+// instance seq, and install the first one found.
+// returns whether it found one.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) fetchSnapshot(seq int) bool {
+  for _, i := range kv.rand.Perm(len(kv.servers)) {
+    if i == kv.me || kv.dead {
+      continue
+    }
+    args := &SnapshotArgs{Seq: seq}
+    var reply SnapshotReply
+    ok := call(kv.tr, kv.servers[i], "KVPaxos.Snapshot", args, &reply)
+    if !ok || reply.Err != OK {
+      continue
+    }
+    s, err := decodeSnapshot(reply.Snapshot)
+    if err != nil {
+      log.Printf("[%d] bad snapshot from %d: %v", kv.me, i, err)
+      continue
+    }
+    if s.Applied > seq {
+      kv.install(s, reply.Snapshot)
+      return true
+    }
+  }
+  return false
+}
+
+//
+// reply with this server's latest snapshot, if it
+// covers instance args.Seq. takes only kv.snapMu, so
+// that servers all stuck in wait() can answer each other.
+//
+func (kv *KVPaxos) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+  kv.snapMu.Lock()
+  defer kv.snapMu.Unlock()
+  if kv.snapApplied <= args.Seq {
+    reply.Err = ErrNoSnapshot
+    return nil
+  }
+  reply.Err = OK
+  reply.Snapshot = kv.snapshot
+  return nil
+}
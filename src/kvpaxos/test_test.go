@@ -7,8 +7,11 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "linearizable"
+import "faults"
+import "sim"
 
-func check(t *testing.T, ck *Clerk, key string, value string) {
+func check(t *testing.T, ck linearizable.KV, key string, value string) {
   v := ck.Get(key)
   if v != value {
     t.Fatalf("Get(%v) -> %v, expected %v", key, v, value)
@@ -70,6 +73,7 @@ func TestBasic(t *testing.T) {
 
   fmt.Printf("Test: Concurrent clients ...\n")
 
+  rec := linearizable.NewRecorder(nil)
   for iters := 0; iters < 20; iters++ {
     const npara = 15
     var ca [npara]chan bool
@@ -78,7 +82,7 @@ func TestBasic(t *testing.T) {
       go func(me int) {
         defer func() { ca[me] <- true }()
         ci := (rand.Int() % nservers)
-        myck := MakeClerk([]string{kvh[ci]})
+        myck := rec.Wrap(MakeClerk([]string{kvh[ci]}))
         if (rand.Int() % 1000) < 500 {
           myck.Put("b", strconv.Itoa(rand.Int()))
         } else {
@@ -91,12 +95,13 @@ func TestBasic(t *testing.T) {
     }
     var va [nservers]string
     for i := 0; i < nservers; i++ {
-      va[i] = cka[i].Get("b")
+      va[i] = rec.Wrap(cka[i]).Get("b")
       if va[i] != va[0] {
         t.Fatalf("mismatch")
       }
     }
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -254,15 +259,17 @@ func TestUnreliable(t *testing.T) {
   for i := 0; i < nservers; i++ {
     kvh[i] = port("un", i)
   }
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
-    kva[i].unreliable = true
+    kva[i] = StartServerOn(in.Wrap(kvh[i], nil), kvh, i)
   }
 
-  ck := MakeClerk(kvh)
+  ck := MakeClerkOn(ctr, kvh)
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{kvh[i]})
+    cka[i] = MakeClerkOn(ctr, []string{kvh[i]})
   }
 
   fmt.Printf("Test: Basic put/get, unreliable ...\n")
@@ -280,6 +287,7 @@ func TestUnreliable(t *testing.T) {
 
   fmt.Printf("Test: Sequence of puts, unreliable ...\n")
 
+  rec := linearizable.NewRecorder(nil)
   for iters := 0; iters < 6; iters++ {
   const ncli = 5
     var ca [ncli]chan bool
@@ -294,7 +302,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := rec.Wrap(MakeClerkOn(ctr, sa))
         key := strconv.Itoa(me)
         myck.Put(key, "0")
         myck.Put(key, "1")
@@ -316,11 +324,13 @@ func TestUnreliable(t *testing.T) {
       }
     }
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
   fmt.Printf("Test: Concurrent clients, unreliable ...\n")
 
+  rec = linearizable.NewRecorder(nil)
   for iters := 0; iters < 20; iters++ {
     const ncli = 15
     var ca [ncli]chan bool
@@ -334,7 +344,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := rec.Wrap(MakeClerkOn(ctr, sa))
         if (rand.Int() % 1000) < 500 {
           myck.Put("b", strconv.Itoa(rand.Int()))
         } else {
@@ -348,12 +358,13 @@ func TestUnreliable(t *testing.T) {
 
     var va [nservers]string
     for i := 0; i < nservers; i++ {
-      va[i] = cka[i].Get("b")
+      va[i] = rec.Wrap(cka[i]).Get("b")
       if va[i] != va[0] {
         t.Fatalf("mismatch; 0 got %v, %v got %v", va[0], i, va[i])
       }
     }
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -387,7 +398,8 @@ func TestHole(t *testing.T) {
   for iters := 0; iters < 5; iters++ {
     part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
 
-    ck2 := MakeClerk([]string{port(tag, 2)})
+    rec := linearizable.NewRecorder(nil)
+    ck2 := rec.Wrap(MakeClerk([]string{port(tag, 2)}))
     ck2.Put("q", "q")
 
     done := false
@@ -398,9 +410,9 @@ func TestHole(t *testing.T) {
       go func(cli int) {
         ok := false
         defer func() { ca[cli] <- ok }()
-        var cka [nservers]*Clerk
+        var cka [nservers]*linearizable.Clerk
         for i := 0; i < nservers; i++ {
-          cka[i] = MakeClerk([]string{port(tag, i)})
+          cka[i] = rec.Wrap(MakeClerk([]string{port(tag, i)}))
         }
         key := strconv.Itoa(cli)
         last := ""
@@ -446,6 +458,7 @@ func TestHole(t *testing.T) {
       t.Fatal("something is wrong")
     }
     check(t, ck2, "q", "qq")
+    rec.Verify(t)
   }
 
   fmt.Printf("  ... Passed\n")
@@ -462,6 +475,9 @@ func TestManyPartition(t *testing.T) {
   defer cleanup(kva)
   defer cleanpp(tag, nservers)
 
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
   for i := 0; i < nservers; i++ {
     var kvh []string = make([]string, nservers)
     for j := 0; j < nservers; j++ {
@@ -471,8 +487,7 @@ func TestManyPartition(t *testing.T) {
         kvh[j] = pp(tag, i, j)
       }
     }
-    kva[i] = StartServer(kvh, i)
-    kva[i].unreliable = true
+    kva[i] = StartServerOn(in.Wrap(kvh[i], nil), kvh, i)
   }
   defer part(t, tag, nservers, []int{}, []int{}, []int{})
   part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
@@ -502,6 +517,7 @@ func TestManyPartition(t *testing.T) {
     }
   }()
 
+  rec := linearizable.NewRecorder(nil)
   const nclients = 10
   var ca [nclients]chan bool
   for xcli := 0; xcli < nclients; xcli++ {
@@ -517,7 +533,7 @@ func TestManyPartition(t *testing.T) {
         j := rand.Intn(i+1)
         sa[i], sa[j] = sa[j], sa[i]
       }
-      myck := MakeClerk(sa)
+      myck := rec.Wrap(MakeClerkOn(ctr, sa))
       key := strconv.Itoa(cli)
       last := ""
       myck.Put(key, last)
@@ -548,8 +564,1127 @@ func TestManyPartition(t *testing.T) {
     z := <- ca[i]
     ok = ok && z
   }
+  rec.Verify(t)
 
   if ok {
     fmt.Printf("  ... Passed\n")
   }
 }
+
+func TestDuplicates(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("dup", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Retried requests are applied once ...\n")
+
+  pargs := &PutArgs{Key: "a", Value: "x", Client: 1, Seq: 1}
+  var preply PutReply
+  if call(nil, kvh[0], "KVPaxos.Put", pargs, &preply) == false || preply.Err != OK {
+    t.Fatalf("Put failed")
+  }
+  ck.Put("a", "y")
+
+  // a retry of the first Put, at another server,
+  // must not undo the second.
+  if call(nil, kvh[1], "KVPaxos.Put", pargs, &preply) == false || preply.Err != OK {
+    t.Fatalf("retried Put failed")
+  }
+  check(t, ck, "a", "y")
+
+  // a retried Get returns what it read the first time.
+  gargs := &GetArgs{Key: "a", Client: 1, Seq: 2}
+  var g1 GetReply
+  if call(nil, kvh[2], "KVPaxos.Get", gargs, &g1) == false || g1.Value != "y" {
+    t.Fatalf("Get failed: %v", g1)
+  }
+  ck.Put("a", "z")
+  var g2 GetReply
+  if call(nil, kvh[0], "KVPaxos.Get", gargs, &g2) == false || g2.Value != "y" {
+    t.Fatalf("retried Get returned %v, wanted y", g2.Value)
+  }
+  check(t, ck, "a", "z")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Inactive clients are forgotten ...\n")
+
+  kv := &KVPaxos{data: map[string]string{}, dups: map[int64]dup{}}
+  kv.perform(Op{Client: 1, Seq: 1, Time: 0, Kind: PutOp, Key: "a", Value: "1"})
+  kv.perform(Op{Client: 2, Seq: 1, Time: int64(ClientTimeout) / 2, Kind: GetOp, Key: "a"})
+  if len(kv.dups) != 2 {
+    t.Fatalf("client forgotten too soon")
+  }
+  kv.perform(Op{Client: 2, Seq: 2, Time: int64(ClientTimeout) * 2, Kind: GetOp, Key: "a"})
+  if _, present := kv.dups[1]; present {
+    t.Fatalf("inactive client not forgotten")
+  }
+  if d, present := kv.dups[2]; !present || d.Seq != 2 || d.Value != "1" {
+    t.Fatalf("active client's entry wrong: %v", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPutHashAppend(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("hash", i)
+  }
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerOn(in.Wrap(kvh[i], nil), kvh, i)
+  }
+
+  ck := MakeClerkOn(ctr, kvh)
+
+  fmt.Printf("Test: Basic PutHash/Append ...\n")
+
+  ck.Put("h", "x")
+  if prev := ck.PutHash("h", "y"); prev != "x" {
+    t.Fatalf("PutHash returned %v, wanted x", prev)
+  }
+  check(t, ck, "h", strconv.Itoa(int(hash("xy"))))
+
+  if n := ck.Append("l", "ab"); n != 2 {
+    t.Fatalf("Append returned %v, wanted 2", n)
+  }
+  if n := ck.Append("l", "c"); n != 3 {
+    t.Fatalf("Append returned %v, wanted 3", n)
+  }
+  check(t, ck, "l", "abc")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent PutHash/Append, unreliable ...\n")
+
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
+
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 5
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      defer func() { ca[cli] <- true }()
+      myck := rec.Wrap(MakeClerkOn(ctr, kvh))
+      for i := 0; i < 10; i++ {
+        switch rand.Int() % 3 {
+        case 0:
+          myck.PutHash("ph", strconv.Itoa(cli))
+        case 1:
+          myck.Append("ap", strconv.Itoa(cli))
+        default:
+          myck.Get("ph")
+          myck.Get("ap")
+        }
+      }
+    }(xcli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestConditional(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("cond", i)
+  }
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerOn(in.Wrap(kvh[i], nil), kvh, i)
+  }
+
+  ck := MakeClerkOn(ctr, kvh)
+
+  fmt.Printf("Test: Basic CompareAndSwap/PutIfAbsent ...\n")
+
+  if ok, prev := ck.PutIfAbsent("a", "1"); !ok || prev != "" {
+    t.Fatalf("PutIfAbsent on a new key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.PutIfAbsent("a", "2"); ok || prev != "1" {
+    t.Fatalf("PutIfAbsent on an existing key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "0", "2"); ok || prev != "1" {
+    t.Fatalf("CompareAndSwap from the wrong value -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "1", "2"); !ok || prev != "1" {
+    t.Fatalf("CompareAndSwap -> %v %v", ok, prev)
+  }
+  check(t, ck, "a", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Election and counter, unreliable ...\n")
+
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
+
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 5
+  const nincr = 5
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      won := false
+      defer func() { ca[cli] <- won }()
+      myck := rec.Wrap(MakeClerkOn(ctr, kvh))
+      won, _ = myck.PutIfAbsent("leader", strconv.Itoa(cli))
+      for i := 0; i < nincr; i++ {
+        for {
+          old := myck.Get("counter")
+          n, _ := strconv.Atoi(old)
+          if ok, _ := myck.CompareAndSwap("counter", old, strconv.Itoa(n+1)); ok {
+            break
+          }
+        }
+      }
+    }(xcli)
+  }
+  nwon := 0
+  for cli := 0; cli < nclients; cli++ {
+    if <- ca[cli] {
+      nwon++
+    }
+  }
+  if nwon != 1 {
+    t.Fatalf("%v clients won the election", nwon)
+  }
+  check(t, ck, "counter", strconv.Itoa(nclients * nincr))
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("snap", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+  const nkeys = 10
+  values := make([]string, nkeys)
+
+  fmt.Printf("Test: Snapshots let paxos forget instances ...\n")
+
+  for i := 0; i < SnapshotInterval * 3; i++ {
+    values[i % nkeys] = strconv.Itoa(i)
+    ck.Put(strconv.Itoa(i % nkeys), values[i % nkeys])
+  }
+  // every server must have applied (and snapshotted)
+  // the log before any instance can be forgotten.
+  for i := 0; i < nservers; i++ {
+    check(t, MakeClerk([]string{kvh[i]}), "0", values[0])
+  }
+  for iters := 0; kva[0].px.Min() < SnapshotInterval; iters++ {
+    if iters > 50 {
+      t.Fatalf("Min() is %v after %v instances", kva[0].px.Min(), SnapshotInterval * 3)
+    }
+    ck.Put("x", strconv.Itoa(iters))
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted server catches up from a snapshot ...\n")
+
+  kva[2].kill()
+
+  pargs := &PutArgs{Key: "d", Value: "x", DoAppend: true, Client: 1, Seq: 1}
+  var preply PutReply
+  if call(nil, kvh[0], "KVPaxos.Put", pargs, &preply) == false || preply.Length != 1 {
+    t.Fatalf("Append failed: %v", preply)
+  }
+  for i := 0; i < SnapshotInterval * 2; i++ {
+    values[i % nkeys] = strconv.Itoa(-i)
+    ck.Put(strconv.Itoa(i % nkeys), values[i % nkeys])
+  }
+
+  // the new server knows nothing, and the others have
+  // forgotten the start of the log.
+  kva[2] = StartServer(kvh, 2)
+  if call(nil, kvh[2], "KVPaxos.Put", pargs, &preply) == false || preply.Length != 1 {
+    t.Fatalf("retried Append at restarted server: %v", preply)
+  }
+  ck2 := MakeClerk([]string{kvh[2]})
+  for i := 0; i < nkeys; i++ {
+    check(t, ck2, strconv.Itoa(i), values[i])
+  }
+  check(t, ck2, "d", "x")
+  if keys := ck2.ListPrefix(""); fmt.Sprint(keys) != fmt.Sprint(ck.ListPrefix("")) {
+    t.Fatalf("restarted server's index has %v", keys)
+  }
+  kva[2].snapMu.Lock()
+  if kva[2].snapApplied < SnapshotInterval {
+    t.Fatalf("restarted server did not install a snapshot")
+  }
+  kva[2].snapMu.Unlock()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Damaged snapshots are refused ...\n")
+
+  s := snapshot{Applied: 5, Data: map[string]string{"a": "b"}, Dups: map[int64]dup{}}
+  buf, err := encodeSnapshot(s)
+  if err != nil {
+    t.Fatalf("encode: %v", err)
+  }
+  if s1, err := decodeSnapshot(buf); err != nil || s1.Applied != 5 || s1.Data["a"] != "b" {
+    t.Fatalf("decode: %v %v", s1, err)
+  }
+  bad := append([]byte{}, buf...)
+  bad[len(bad) - 1] ^= 1
+  if _, err := decodeSnapshot(bad); err != errSnapshotCorrupt {
+    t.Fatalf("flipped bit not detected: %v", err)
+  }
+  bad = append([]byte{}, buf...)
+  bad[3]++
+  if _, err := decodeSnapshot(bad); err != errSnapshotVersion {
+    t.Fatalf("unknown version not detected: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLease(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "lease"
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  opts := Options{Lease: time.Second, Drift: 100 * time.Millisecond}
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServerWithOptions(kvh, i, opts)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{port(tag, i)})
+  }
+
+  fmt.Printf("Test: Lease holder serves Gets locally ...\n")
+
+  cka[0].Put("a", "1")
+  check(t, cka[0], "a", "1")
+  if kva[0].LeaseHolder() != 0 {
+    t.Fatalf("lease holder is %v, expected 0", kva[0].LeaseHolder())
+  }
+  max := kva[0].px.Max()
+  for i := 0; i < 100; i++ {
+    check(t, cka[0], "a", "1")
+  }
+  if kva[0].px.Max() > max + 5 {
+    t.Fatalf("100 local Gets used %v instances", kva[0].px.Max() - max)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Updates elsewhere are seen by the holder ...\n")
+
+  cka[1].Put("a", "2")
+  check(t, cka[0], "a", "2")
+  cka[2].Append("a", "3")
+  check(t, cka[0], "a", "23")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lease holder partitioned away ...\n")
+
+  rec := linearizable.NewRecorder(nil)
+  rec.Wrap(cka[0]).Put("a", "start")
+  part(t, tag, nservers, []int{0}, []int{1,2}, []int{})
+
+  stop := make(chan bool)
+  done := make(chan bool)
+  go func() {
+    ck := rec.Wrap(cka[0])
+    for {
+      select {
+      case <-stop:
+        done <- true
+        return
+      default:
+      }
+      ck.Get("a")
+    }
+  }()
+  ck1 := rec.Wrap(cka[1])
+  for i := 0; i < 5; i++ {
+    ck1.Put("a", strconv.Itoa(i))
+  }
+  // a Get in the majority gets the lease once 0's runs out.
+  for iters := 0; kva[1].LeaseHolder() != 1; iters++ {
+    if iters > 30 {
+      t.Fatalf("lease holder in majority is %v, expected 1", kva[1].LeaseHolder())
+    }
+    ck1.Get("a")
+    time.Sleep(100 * time.Millisecond)
+  }
+  ck1.Put("a", "x")
+
+  // 0's Get may be stuck in the minority until the
+  // partition heals, and may then take the lease back.
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+  close(stop)
+  <- done
+  check(t, cka[0], "a", "x")
+  rec.Verify(t)
+
+  h := kva[1].LeaseHistory()
+  if len(h) < 2 || h[0].Holder != 0 || h[1].Holder != 1 || h[0].Seq >= h[1].Seq {
+    t.Fatalf("lease history %v, expected 0 then 1", h)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lease history survives a snapshot ...\n")
+
+  kva[1].mu.Lock()
+  kva[1].takeSnapshot()
+  h = append([]LeaseChange{}, kva[1].holders...)
+  kva[1].mu.Unlock()
+  kva[1].snapMu.Lock()
+  buf := kva[1].snapshot
+  kva[1].snapMu.Unlock()
+  s, err := decodeSnapshot(buf)
+  if err != nil {
+    t.Fatalf("decode: %v", err)
+  }
+  kva[2].kill()
+  kva[2].mu.Lock()
+  kva[2].holders = nil
+  kva[2].install(s, buf)
+  kva[2].mu.Unlock()
+  if h2 := kva[2].LeaseHistory(); fmt.Sprint(h2) != fmt.Sprint(h) {
+    t.Fatalf("lease history %v after install, expected %v", h2, h)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTxn(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("txn", i)
+  }
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerOn(in.Wrap(kvh[i], nil), kvh, i)
+  }
+
+  ck := MakeClerkOn(ctr, kvh)
+
+  fmt.Printf("Test: Basic Txn ...\n")
+
+  ok, vs := ck.Txn([]TxnOp{{Kind: TxnPut, Key: "a", Value: "1"},
+                           {Kind: TxnPut, Key: "b", Value: "2"},
+                           {Kind: TxnGet, Key: "a"}})
+  if !ok || len(vs) != 1 || vs[0] != "1" {
+    t.Fatalf("unguarded Txn -> %v %v", ok, vs)
+  }
+  check(t, ck, "b", "2")
+
+  guarded := func(a string) []TxnOp {
+    return []TxnOp{{Kind: TxnCompare, Key: "a", Value: a},
+                   {Kind: TxnCompare, Key: "c", Value: ""},
+                   {Kind: TxnPut, Key: "b", Value: "then"},
+                   {Kind: TxnGet, Key: "b"},
+                   {Kind: TxnGet, Key: "a", Else: true},
+                   {Kind: TxnPut, Key: "c", Value: "else", Else: true}}
+  }
+  ok, vs = ck.Txn(guarded("0"))
+  if ok || len(vs) != 1 || vs[0] != "1" {
+    t.Fatalf("failed guard -> %v %v", ok, vs)
+  }
+  check(t, ck, "b", "2")
+  check(t, ck, "c", "else")
+  ck.Put("c", "")
+  ok, vs = ck.Txn(guarded("1"))
+  if !ok || len(vs) != 1 || vs[0] != "then" {
+    t.Fatalf("guard held -> %v %v", ok, vs)
+  }
+  check(t, ck, "c", "")
+
+  // a retry gets the first outcome, not a re-run.
+  args := &TxnArgs{Ops: []TxnOp{{Kind: TxnCompare, Key: "d", Value: ""},
+                                {Kind: TxnPut, Key: "d", Value: "x"}},
+                   Client: 1, Seq: 1}
+  var r1, r2 TxnReply
+  if call(nil, kvh[0], "KVPaxos.Txn", args, &r1) == false || !r1.Succeeded {
+    t.Fatalf("Txn failed: %v", r1)
+  }
+  if call(nil, kvh[1], "KVPaxos.Txn", args, &r2) == false || !r2.Succeeded {
+    t.Fatalf("retried Txn re-run: %v", r2)
+  }
+
+  // a retry's Gets read afresh, after its own Puts.
+  args = &TxnArgs{Ops: []TxnOp{{Kind: TxnGet, Key: "d"},
+                               {Kind: TxnPut, Key: "d", Value: "y"},
+                               {Kind: TxnGet, Key: "d"}},
+                  Client: 1, Seq: 2}
+  if call(nil, kvh[0], "KVPaxos.Txn", args, &r1) == false ||
+     fmt.Sprint(r1.Values) != "[x y]" {
+    t.Fatalf("Txn read %v, expected [x y]", r1.Values)
+  }
+  // the Put brings kvh[1] up to date, past the Txn.
+  MakeClerkOn(ctr, []string{kvh[1]}).Put("d", "z")
+  if call(nil, kvh[1], "KVPaxos.Txn", args, &r2) == false ||
+     fmt.Sprint(r2.Values) != "[z y]" {
+    t.Fatalf("retried Txn read %v, expected [z y]", r2.Values)
+  }
+  check(t, ck, "d", "z")
+
+  // a step of unknown kind is refused, and nothing runs.
+  ok, vs = ck.Txn([]TxnOp{{Kind: TxnPut, Key: "e", Value: "1"},
+                          {Kind: "Delete", Key: "a"}})
+  if ok || vs != nil {
+    t.Fatalf("Txn with an unknown step -> %v %v", ok, vs)
+  }
+  check(t, ck, "e", "")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent transfers, unreliable ...\n")
+
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
+
+  const naccounts = 4
+  const nclients = 4
+  const ntransfers = 10
+  for i := 0; i < naccounts; i++ {
+    ck.Put("acct" + strconv.Itoa(i), "100")
+  }
+
+  var ca [nclients]chan bool
+  for xi := 0; xi < nclients; xi++ {
+    ca[xi] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerkOn(ctr, kvh)
+      for n := 0; n < ntransfers; {
+        from := "acct" + strconv.Itoa(rand.Int() % naccounts)
+        to := "acct" + strconv.Itoa(rand.Int() % naccounts)
+        if from == to {
+          continue
+        }
+        _, vs := myck.Txn([]TxnOp{{Kind: TxnGet, Key: from}, {Kind: TxnGet, Key: to}})
+        x, _ := strconv.Atoi(vs[0])
+        y, _ := strconv.Atoi(vs[1])
+        ok, _ := myck.Txn([]TxnOp{{Kind: TxnCompare, Key: from, Value: vs[0]},
+                                  {Kind: TxnCompare, Key: to, Value: vs[1]},
+                                  {Kind: TxnPut, Key: from, Value: strconv.Itoa(x - 1)},
+                                  {Kind: TxnPut, Key: to, Value: strconv.Itoa(y + 1)},
+                                  {Kind: TxnPut, Key: "n" + strconv.Itoa(me),
+                                   Value: strconv.Itoa(n + 1)}})
+        if ok {
+          n++
+        }
+      }
+    }(xi)
+  }
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+
+  in.ClearRules()
+  ops := []TxnOp{}
+  for i := 0; i < naccounts; i++ {
+    ops = append(ops, TxnOp{Kind: TxnGet, Key: "acct" + strconv.Itoa(i)})
+  }
+  _, vs = ck.Txn(ops)
+  sum := 0
+  for _, v := range vs {
+    x, _ := strconv.Atoi(v)
+    sum += x
+  }
+  if sum != naccounts * 100 {
+    t.Fatalf("balances %v sum to %v, wanted %v", vs, sum, naccounts * 100)
+  }
+  for i := 0; i < nclients; i++ {
+    check(t, ck, "n" + strconv.Itoa(i), strconv.Itoa(ntransfers))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  next := func(w *Watcher, want ...string) int {
+    es, err := w.Next()
+    if err != OK || len(es) != len(want) / 2 {
+      t.Fatalf("Next() -> %v %v, wanted %v", es, err, want)
+    }
+    for i, e := range es {
+      if e.Key != want[2*i] || e.Value != want[2*i+1] || e.Seq != es[0].Seq {
+        t.Fatalf("Next() -> %v, wanted %v", es, want)
+      }
+    }
+    return es[0].Seq
+  }
+
+  fmt.Printf("Test: Watch a prefix ...\n")
+
+  w := ck.Watch("cfg/", true, 0)
+  ck.Put("cfg/a", "1")
+  ck.Put("other", "x")
+  ck.Append("cfg/b", "y")
+  ck.Txn([]TxnOp{{Kind: TxnPut, Key: "cfg/a", Value: "2"},
+                 {Kind: TxnPut, Key: "other", Value: "z"},
+                 {Kind: TxnPut, Key: "cfg/c", Value: "3"}})
+  s1 := next(w, "cfg/a", "1")
+  s2 := next(w, "cfg/b", "y")
+  s3 := next(w, "cfg/a", "2", "cfg/c", "3")
+  if s1 >= s2 || s2 >= s3 {
+    t.Fatalf("changes out of order: %v %v %v", s1, s2, s3)
+  }
+
+  // Next() waits for a change.
+  go func() {
+    time.Sleep(200 * time.Millisecond)
+    ck.Put("cfg/b", "later")
+  }()
+  next(w, "cfg/b", "later")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Resume a watch at another server ...\n")
+
+  wa := ck.Watch("cfg/a", false, w.Cursor())
+  ck.Put("cfg/a", "3")
+  ck.Put("cfg/a", "4")
+  next(wa, "cfg/a", "3")
+
+  // server 2 has handled no requests; it applies
+  // the log to answer.
+  wb := MakeClerk([]string{kvh[2]}).Watch("cfg/a", false, wa.Cursor())
+  next(wb, "cfg/a", "4")
+  ck.Put("cfg/a", "5")
+  next(wb, "cfg/a", "5")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch from a compacted instance ...\n")
+
+  for i := 0; i < SnapshotInterval * 2; i++ {
+    ck.Put("n", strconv.Itoa(i))
+  }
+  if _, err := ck.Watch("n", false, 0).Next(); err != ErrCompacted {
+    t.Fatalf("Watch from 0 -> %v, wanted ErrCompacted", err)
+  }
+  wn := ck.Watch("n", false, -1)
+  go func() {
+    time.Sleep(200 * time.Millisecond)
+    ck.Put("n", "last")
+  }()
+  next(wn, "n", "last")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestScan(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Ordered index ...\n")
+
+  var ix index
+  want := map[string]bool{}
+  for i := 0; i < 2000; i++ {
+    key := strconv.Itoa(rand.Int() % 1000)
+    if rand.Int() % 3 == 0 {
+      ix.remove(key)
+      delete(want, key)
+    } else {
+      ix.insert(key)
+      want[key] = true
+    }
+  }
+  if ix.len() != len(want) {
+    t.Fatalf("index has %v keys, wanted %v", ix.len(), len(want))
+  }
+  n := 0
+  last := ""
+  for x := ix.seek(""); x != nil; x = x.next[0] {
+    if want[x.key] == false || (n > 0 && x.key <= last) {
+      t.Fatalf("index out of order or wrong at %q after %q", x.key, last)
+    }
+    last = x.key
+    n++
+  }
+  if n != len(want) {
+    t.Fatalf("walked %v keys, wanted %v", n, len(want))
+  }
+  if x := ix.seek("5"); x != nil && x.key < "5" {
+    t.Fatalf("seek(5) -> %q", x.key)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("scan", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Scan and ListPrefix ...\n")
+
+  const nobj = 250
+  name := func(i int) string { return fmt.Sprintf("obj/%04d", i) }
+  for _, i := range rand.Perm(nobj) {
+    ck.Put(name(i), strconv.Itoa(i))
+  }
+  ck.Put("obj", "not in the prefix")
+  ck.Put("obj0", "nor this")
+
+  pairs, next := ck.Scan(name(10), name(20), 0)
+  if len(pairs) != 10 || next != "" {
+    t.Fatalf("Scan [10, 20) -> %v pairs, next %q", len(pairs), next)
+  }
+  for i, kv := range pairs {
+    if kv.Key != name(10 + i) || kv.Value != strconv.Itoa(10 + i) {
+      t.Fatalf("Scan [10, 20) pair %v is %v", i, kv)
+    }
+  }
+
+  // page through the prefix.
+  got := 0
+  for next = "obj/"; ; {
+    pairs, next = ck.Scan(next, prefixEnd("obj/"), 100)
+    for _, kv := range pairs {
+      if kv.Key != name(got) {
+        t.Fatalf("page has %v, wanted %v", kv.Key, name(got))
+      }
+      got++
+    }
+    if next == "" {
+      break
+    }
+    if len(pairs) != 100 {
+      t.Fatalf("short page of %v with more to come", len(pairs))
+    }
+  }
+  if got != nobj {
+    t.Fatalf("paged through %v keys, wanted %v", got, nobj)
+  }
+
+  keys := ck.ListPrefix("obj/")
+  if len(keys) != nobj || keys[0] != name(0) || keys[nobj-1] != name(nobj-1) {
+    t.Fatalf("ListPrefix -> %v keys", len(keys))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scans go through the log ...\n")
+
+  MakeClerk([]string{kvh[1]}).Put("obj/new", "x")
+  pairs, _ = MakeClerk([]string{kvh[2]}).Scan("obj/new", "", 1)
+  if len(pairs) != 1 || pairs[0].Key != "obj/new" {
+    t.Fatalf("Scan at another server missed a Put: %v", pairs)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTTL(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ttl", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Keys expire while idle ...\n")
+
+  ck.Put("keep", "1")
+  ck.PutWithTTL("s", "1", 500 * time.Millisecond)
+  check(t, ck, "s", "1")
+  if keys := ck.ListPrefix(""); len(keys) != 2 {
+    t.Fatalf("ListPrefix -> %v", keys)
+  }
+  // no requests now; ticks move log time on.
+  time.Sleep(time.Second)
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    kva[i].catchUp()
+    _, present := kva[i].data["s"]
+    kva[i].mu.Unlock()
+    if present {
+      t.Fatalf("server %d did not expire an idle key", i)
+    }
+  }
+  check(t, ck, "s", "")
+  if keys := ck.ListPrefix(""); len(keys) != 1 || keys[0] != "keep" {
+    t.Fatalf("ListPrefix after expiry -> %v", keys)
+  }
+  w := ck.Watch("s", false, 0)
+  w.Next()
+  if es, _ := w.Next(); len(es) != 1 || es[0].Deleted == false {
+    t.Fatalf("expiry not watched: %v", es)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Puts renew or clear TTLs ...\n")
+
+  ck.PutWithTTL("p", "1", 300 * time.Millisecond)
+  ck.Put("p", "2")
+  ck.PutWithTTL("r", "1", 300 * time.Millisecond)
+  ck.PutWithTTL("r", "2", 2 * time.Second)
+  ck.PutWithTTL("a", "x", 300 * time.Millisecond)
+  ck.Append("a", "y")
+  time.Sleep(time.Second)
+  check(t, ck, "p", "2")
+  check(t, ck, "r", "2")
+  check(t, ck, "a", "")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Expiry is the same everywhere ...\n")
+
+  for i := 0; i < 20; i++ {
+    ck.PutWithTTL("e" + strconv.Itoa(i), "x", time.Duration(i * 20) * time.Millisecond)
+  }
+  time.Sleep(200 * time.Millisecond)
+  ck.Put("sync", "1")
+  for i := 0; i < nservers; i++ {
+    check(t, MakeClerk([]string{kvh[i]}), "sync", "1")
+  }
+  // compare the servers at the same point in the log,
+  // which ticks keep moving.
+  var states [nservers]string
+  for {
+    var applied [nservers]int
+    for i := 0; i < nservers; i++ {
+      kva[i].mu.Lock()
+      kva[i].catchUp()
+      applied[i] = kva[i].applied
+      states[i] = fmt.Sprint(kva[i].data, kva[i].expires)
+      kva[i].mu.Unlock()
+    }
+    if applied[0] == applied[1] && applied[0] == applied[2] {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if states[0] != states[1] || states[0] != states[2] {
+    t.Fatalf("servers disagree:\n%v\n%v\n%v", states[0], states[1], states[2])
+  }
+
+  // with no TTLs left, servers stop ticking.
+  time.Sleep(2 * time.Second)
+  ck.Put("sync", "2")
+  max := kva[0].px.Max()
+  time.Sleep(time.Second)
+  if kva[0].px.Max() != max {
+    t.Fatalf("servers ticked with no TTLs")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Ticks without a majority hold nothing up ...\n")
+
+  ck.PutWithTTL("late", "x", time.Hour)
+  for i := 1; i < nservers; i++ {
+    kva[i].kill()
+    kva[i] = nil
+  }
+  // long enough for server 0 to propose a tick.
+  time.Sleep(TickInterval * (nservers + 2))
+  done := make(chan bool)
+  go func() {
+    kva[0].LeaseHolder()
+    done <- true
+  }()
+  select {
+  case <-done:
+  case <-time.After(time.Second):
+    t.Fatalf("server blocked behind a tick")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestVersions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("versions", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  getAt := func(ck *Clerk, key string, seq int, value string) {
+    v, err := ck.GetAt(key, seq)
+    if err != OK || v != value {
+      t.Fatalf("GetAt(%v, %v) -> %v %v, expected %v", key, seq, v, err, value)
+    }
+  }
+
+  fmt.Printf("Test: Reads as of a snapshot ...\n")
+
+  ck.Put("a", "1")
+  ck.PutWithTTL("t", "x", 300 * time.Millisecond)
+  s1 := ck.ReadSnapshot()
+  ck.Put("a", "2")
+  ck.Append("a", "3")
+  ck.Txn([]TxnOp{{Kind: TxnPut, Key: "a", Value: "4"}, {Kind: TxnPut, Key: "b", Value: "1"}})
+  time.Sleep(time.Second)
+  check(t, ck, "t", "")
+  s2 := ck.ReadSnapshot()
+
+  for i := 0; i < nservers; i++ {
+    getAt(cka[i], "a", s1.Seq(), "1")
+    getAt(cka[i], "b", s1.Seq(), "")
+    getAt(cka[i], "t", s1.Seq(), "x")
+    getAt(cka[i], "a", s2.Seq(), "4")
+    getAt(cka[i], "b", s2.Seq(), "1")
+    getAt(cka[i], "t", s2.Seq(), "")
+  }
+  pairs, next, err := s1.Scan("", "", 0)
+  if err != OK || next != "" || fmt.Sprint(pairs) != "[{a 1} {t x}]" {
+    t.Fatalf("s1.Scan -> %v %v %v", pairs, next, err)
+  }
+  pairs, next, err = s2.Scan("", "", 1)
+  if err != OK || next != "b" || fmt.Sprint(pairs) != "[{a 4}]" {
+    t.Fatalf("s2.Scan -> %v %v %v", pairs, next, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent snapshots are consistent ...\n")
+
+  // each Txn moves one unit from x to y; every view
+  // must see a total of 100.
+  ck.Put("x", "100")
+  ck.Put("y", "0")
+  done := false
+  go func() {
+    myck := MakeClerk(kvh)
+    for i := 1; !done && i <= 100; i++ {
+      myck.Txn([]TxnOp{{Kind: TxnPut, Key: "x", Value: strconv.Itoa(100 - i)},
+                       {Kind: TxnPut, Key: "y", Value: strconv.Itoa(i)}})
+    }
+  }()
+  for i := 0; i < 20; i++ {
+    s := cka[i % nservers].ReadSnapshot()
+    x, _ := s.Get("x")
+    y, _ := s.Get("y")
+    nx, _ := strconv.Atoi(x)
+    ny, _ := strconv.Atoi(y)
+    if nx + ny != 100 {
+      t.Fatalf("snapshot %v sees x=%v y=%v", s.Seq(), x, y)
+    }
+  }
+  done = true
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Old versions are compacted ...\n")
+
+  for i := 0; i < 3 * SnapshotInterval; i++ {
+    cka[i % nservers].Put("a", strconv.Itoa(i))
+  }
+  for iters := 0; ; iters++ {
+    if _, err := ck.GetAt("a", s1.Seq()); err == ErrCompacted {
+      break
+    }
+    if iters > 50 {
+      t.Fatalf("old versions never compacted")
+    }
+    cka[iters % nservers].Put("z", "z")
+    time.Sleep(100 * time.Millisecond)
+  }
+  // versions since Min() are still there.
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    from := kva[i].versionsFrom
+    kva[i].mu.Unlock()
+    if from > kva[i].px.Min() {
+      t.Fatalf("server %d forgot versions from %d, Min %d", i, from, kva[i].px.Min())
+    }
+  }
+  s3 := ck.ReadSnapshot()
+  ck.Put("a", "after")
+  getAt(ck, "a", s3.Seq(), strconv.Itoa(3 * SnapshotInterval - 1))
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = "kv-" + strconv.Itoa(i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerOn(s.Node(kvh[i]), kvh, i)
+  }
+  ck := MakeClerkOn(s.Node("ck"), kvh)
+
+  fmt.Printf("Test: Concurrent clients, simulated partitions ...\n")
+
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0.1)
+  rr := sim.RandOf(s.Node("test"))
+  rec := linearizable.NewRecorder(s)
+  const nclients = 5
+  var mu sim.Mutex
+  ndone := 0
+  for cli := 0; cli < nclients; cli++ {
+    myck := rec.Wrap(MakeClerkOn(s.Node("ck-" + strconv.Itoa(cli)), kvh))
+    cli := cli
+    s.Go(func() {
+      for i := 0; i < 20; i++ {
+        switch rr.Intn(3) {
+        case 0:
+          myck.Put("a", strconv.Itoa(cli))
+        case 1:
+          myck.Append("b", strconv.Itoa(cli))
+        default:
+          myck.Get("a")
+          myck.Get("b")
+        }
+      }
+      mu.Lock()
+      ndone++
+      mu.Unlock()
+    })
+  }
+  // one server at a time is cut off from everyone else.
+  for {
+    mu.Lock()
+    n := ndone
+    mu.Unlock()
+    if n == nclients {
+      break
+    }
+    s.Partition([]string{kvh[rr.Intn(nservers)]})
+    s.Sleep(500 * time.Millisecond)
+  }
+  s.Partition()
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: TTLs run on virtual time ...\n")
+
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0)
+  ck.PutWithTTL("t", "x", 5 * time.Second)
+  check(t, ck, "t", "x")
+  s.Sleep(4 * time.Second)
+  check(t, ck, "t", "x")
+  s.Sleep(2 * time.Second)
+  check(t, ck, "t", "")
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,127 @@
+package kvpaxos
+
+//
+// Keys that expire.
+//
+// A Put with a TTL sets the key to expire TTL after the log
+// time at which it is applied; a later Put without one (or a
+// CompareAndSwap, PutIfAbsent or Txn Put that stores a value)
+// makes the key permanent again, while Append and PutHash
+// leave the TTL alone. Log time is the highest Op.Time
+// applied so far, so every server removes an expired key at
+// the same point in the log, just before the first Op stamped
+// at or after its expiry. Gets and Scans through the log, and
+// local reads under a lease, never see it after that.
+//
+// Log time only moves when Ops are applied, so while any key
+// has a TTL, an idle server proposes a TickOp to move it on.
+// To keep down the number of ticks, a server waits longer the
+// lower its rank: the lease holder first, then by index.
+//
+
+import "container/heap"
+import "time"
+
+// how often log time should move while keys have TTLs.
+const TickInterval = 100 * time.Millisecond
+
+type expiry struct {
+  key string
+  at int64
+}
+
+//
+// expiries by time. an entry is stale, and skipped, if the
+// key's TTL has changed since.
+//
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+  old := *h
+  x := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return x
+}
+
+//
+// give key a TTL from the current log time, or none if
+// ttl is 0.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) setTTL(key string, ttl time.Duration) {
+  if ttl <= 0 {
+    delete(kv.expires, key)
+    return
+  }
+  if kv.expires == nil {
+    kv.expires = make(map[string]int64)
+  }
+  at := kv.now + int64(ttl)
+  kv.expires[key] = at
+  heap.Push(&kv.expiring, expiry{key, at})
+}
+
+//
+// remove every key that has expired by the log time.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) expire() {
+  for len(kv.expiring) > 0 && kv.expiring[0].at <= kv.now {
+    e := heap.Pop(&kv.expiring).(expiry)
+    if at, present := kv.expires[e.key]; !present || at != e.at {
+      continue
+    }
+    delete(kv.expires, e.key)
+    kv.preserve(e.key)
+    delete(kv.data, e.key)
+    kv.keys.remove(e.key)
+    kv.events = append(kv.events, Event{Seq: kv.applied, Key: e.key, Deleted: true})
+  }
+}
+
+// caller must hold kv.mu.
+func (kv *KVPaxos) rebuildExpiries() {
+  kv.expiring = nil
+  for key, at := range kv.expires {
+    heap.Push(&kv.expiring, expiry{key, at})
+  }
+}
+
+//
+// propose a TickOp now and then while keys have TTLs.
+// the proposal is made without kv.mu, so that requests
+// are not held up behind a tick when there is no majority;
+// if something else is decided in the instance instead,
+// a later round tries again.
+//
+func (kv *KVPaxos) ticker() {
+  started := -1 // the instance of the last tick proposed
+  for kv.dead == false {
+    kv.clock.Sleep(TickInterval)
+
+    kv.mu.Lock()
+    kv.catchUp()
+    rank := 1 + kv.me
+    if kv.holding() {
+      rank = 0
+    }
+    lag := kv.clock.Now().UnixNano() - kv.now
+    seq := kv.applied
+    if len(kv.expires) == 0 || lag <= int64(TickInterval) * int64(1 + rank) || seq == started {
+      kv.mu.Unlock()
+      continue
+    }
+    kv.opSeq++
+    op := Op{Client: kv.opClient, Seq: kv.opSeq, Kind: TickOp}
+    op.Time = kv.clock.Now().UnixNano()
+    kv.mu.Unlock()
+
+    started = seq
+    kv.px.Start(seq, op)
+    kv.px.WaitDecided(seq, TickInterval)
+  }
+}
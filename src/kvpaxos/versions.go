@@ -0,0 +1,203 @@
+package kvpaxos
+
+//
+// Reading the store as of a past point in the log.
+//
+// Before an instance changes (or expires) a key, the server
+// keeps the key's value from before that instance, tagged with
+// the instance. The value of a key as of instance seq, meaning
+// after every instance below seq has been applied, is then the
+// value kept by the first change at or after seq, or the current
+// value if there has been none since.
+//
+// A server forgets the versions from before paxos Min() each
+// time it snapshots, since every server is Done with those
+// instances; GetAt and ScanAt for an instance below that get
+// ErrCompacted. A server that installs a snapshot has no older
+// versions at all, so a Clerk asks the others before giving up.
+//
+// ReadSnapshot goes through the log, like a Get, and returns the
+// instance just past it, so reads as of that instance see every
+// update that completed before the ReadSnapshot, and none that
+// started after it.
+//
+
+import "sort"
+
+type version struct {
+  Until int // the instance that replaced it
+  Value string
+  Present bool
+}
+
+type replaced struct {
+  seq int
+  key string
+}
+
+//
+// keep key's value from before the instance being applied,
+// unless this instance has already changed key.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) preserve(key string) {
+  vs := kv.versions[key]
+  if len(vs) > 0 && vs[len(vs)-1].Until == kv.applied {
+    return
+  }
+  if kv.versions == nil {
+    kv.versions = make(map[string][]version)
+  }
+  value, present := kv.data[key]
+  kv.versions[key] = append(vs, version{kv.applied, value, present})
+  kv.replaced = append(kv.replaced, replaced{kv.applied, key})
+}
+
+//
+// forget the versions that only reads as of instances
+// below seq could need.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) pruneVersions(seq int) {
+  if seq <= kv.versionsFrom {
+    return
+  }
+  i := 0
+  for ; i < len(kv.replaced) && kv.replaced[i].seq < seq; i++ {
+    key := kv.replaced[i].key
+    if vs := kv.versions[key]; len(vs) > 1 {
+      kv.versions[key] = vs[1:]
+    } else {
+      delete(kv.versions, key)
+    }
+  }
+  kv.replaced = append([]replaced{}, kv.replaced[i:]...)
+  kv.versionsFrom = seq
+}
+
+//
+// key's value as of instance seq, which must be between
+// kv.versionsFrom and kv.applied.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) valueAt(key string, seq int) (string, bool) {
+  vs := kv.versions[key]
+  i := sort.Search(len(vs), func(i int) bool { return vs[i].Until >= seq })
+  if i < len(vs) {
+    return vs[i].Value, vs[i].Present
+  }
+  value, present := kv.data[key]
+  return value, present
+}
+
+//
+// like scan(), but as of instance seq. keys that have
+// expired since seq are not in the index, so they are
+// found among the versions.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) scanAt(start string, end string, limit int, seq int) ([]KeyValue, string) {
+  if limit <= 0 || limit > MaxScan {
+    limit = MaxScan
+  }
+  gone := []string{}
+  for key := range kv.versions {
+    _, present := kv.data[key]
+    if !present && key >= start && (end == "" || key < end) {
+      gone = append(gone, key)
+    }
+  }
+  sort.Strings(gone)
+
+  pairs := []KeyValue{}
+  x := kv.keys.seek(start)
+  for {
+    var key string
+    if x != nil && (end == "" || x.key < end) && (len(gone) == 0 || x.key < gone[0]) {
+      key = x.key
+      x = x.next[0]
+    } else if len(gone) > 0 {
+      key = gone[0]
+      gone = gone[1:]
+    } else {
+      return pairs, ""
+    }
+    if value, present := kv.valueAt(key, seq); present {
+      if len(pairs) == limit {
+        return pairs, key
+      }
+      pairs = append(pairs, KeyValue{key, value})
+    }
+  }
+}
+
+//
+// bring the state up to instance seq, if the log has got
+// that far. returns the Err for a read as of seq.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) reach(seq int) Err {
+  kv.catchUp()
+  if seq > kv.applied {
+    // a TickOp changes nothing, but applies what comes before it.
+    kv.opSeq++
+    op := Op{Client: kv.opClient, Seq: kv.opSeq, Kind: TickOp}
+    op.Time = kv.clock.Now().UnixNano()
+    kv.agree(op)
+  }
+  if seq > kv.applied {
+    return ErrFuture
+  }
+  if seq < kv.versionsFrom {
+    return ErrCompacted
+  }
+  return OK
+}
+
+func (kv *KVPaxos) GetAt(args *GetAtArgs, reply *GetReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  reply.Err = kv.reach(args.At)
+  if reply.Err != OK {
+    return nil
+  }
+  value, present := kv.valueAt(args.Key, args.At)
+  if !present {
+    reply.Err = ErrNoKey
+  }
+  reply.Value = value
+  return nil
+}
+
+func (kv *KVPaxos) ScanAt(args *ScanAtArgs, reply *ScanReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  reply.Err = kv.reach(args.At)
+  if reply.Err != OK {
+    return nil
+  }
+  reply.Pairs, reply.Next = kv.scanAt(args.Start, args.End, args.Limit, args.At)
+  return nil
+}
+
+//
+// pick a point in the log to read as of, through the log.
+//
+func (kv *KVPaxos) ReadSnapshot(args *ReadSnapshotArgs, reply *ReadSnapshotReply) error {
+  kv.mu.Lock()
+
+  op := Op{Client: args.Client, Seq: args.Seq, Kind: ReadSnapshotOp}
+  d, err := kv.execute(op)
+  wait := kv.leaseWait()
+  kv.mu.Unlock()
+  if err != nil {
+    return err
+  }
+  kv.clock.Sleep(wait)
+
+  reply.Err = d.Err
+  reply.At = d.At
+  return nil
+}
@@ -0,0 +1,91 @@
+package kvpaxos
+
+//
+// Watching keys for changes.
+//
+// Each server notes every change it applies to a key as an
+// Event, stamped with the paxos instance that made it. The
+// Watch RPC returns the Events for a key (or a key prefix)
+// from instance From on, waiting up to WatchWait for one if
+// there are none yet, and the instance to ask from next time.
+// Since every server applies the same log, any of them can
+// continue a watch that another one started.
+//
+// A server keeps Events back to its snapshot before last, so
+// at least SnapshotInterval instances' worth. Older ones, and
+// any from before a snapshot it installed, are gone, and a
+// Watch for them gets ErrCompacted.
+//
+
+import "time"
+import "sort"
+import "strings"
+
+// longest a Watch RPC waits for a change.
+const WatchWait = time.Second
+
+// tell watchers (and the index) that key has changed.
+// caller must hold kv.mu.
+func (kv *KVPaxos) changed(key string) {
+  kv.keys.insert(key)
+  kv.events = append(kv.events, Event{Seq: kv.applied, Key: key, Value: kv.data[key]})
+}
+
+//
+// forget the Events from before instance seq.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) trimEvents(seq int) {
+  if seq <= kv.eventsFrom {
+    return
+  }
+  i := sort.Search(len(kv.events), func(i int) bool { return kv.events[i].Seq >= seq })
+  kv.events = append([]Event{}, kv.events[i:]...)
+  kv.eventsFrom = seq
+}
+
+// caller must hold kv.mu.
+func (kv *KVPaxos) eventsSince(from int, key string, prefix bool) []Event {
+  es := []Event{}
+  i := sort.Search(len(kv.events), func(i int) bool { return kv.events[i].Seq >= from })
+  for _, e := range kv.events[i:] {
+    if e.Key == key || (prefix && strings.HasPrefix(e.Key, key)) {
+      es = append(es, e)
+    }
+  }
+  return es
+}
+
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  from := args.From
+  start := kv.clock.Now()
+  for {
+    kv.catchUp()
+    if from < 0 {
+      from = kv.applied
+    }
+    if from < kv.eventsFrom {
+      reply.Err = ErrCompacted
+      return nil
+    }
+    reply.Events = kv.eventsSince(from, args.Key, args.Prefix)
+    left := WatchWait - kv.clock.Now().Sub(start)
+    if len(reply.Events) > 0 || left <= 0 || kv.dead {
+      break
+    }
+    seq := kv.applied
+    kv.mu.Unlock()
+    kv.px.WaitDecided(seq, left)
+    kv.mu.Lock()
+  }
+
+  reply.Err = OK
+  reply.Next = from
+  if kv.applied > from {
+    reply.Next = kv.applied
+  }
+  return nil
+}
@@ -0,0 +1,312 @@
+package linearizable
+
+import "fmt"
+import "sort"
+import "time"
+import "strings"
+import "strconv"
+import "hash/fnv"
+import "encoding/binary"
+
+type Result struct {
+  Ok bool
+  Key string // a key whose history is not linearizable
+  Counterexample []Op // a minimal failing subset of Key's operations
+}
+
+func (res Result) String() string {
+  if res.Ok {
+    return "linearizable"
+  }
+  lines := []string{}
+  for _, op := range res.Counterexample {
+    lines = append(lines, "  " + op.String())
+  }
+  return fmt.Sprintf("history of key %q is not linearizable; " +
+                     "no order exists for:\n%v",
+                     res.Key, strings.Join(lines, "\n"))
+}
+
+//
+// check that ops, a history of operations on keys, is linearizable.
+//
+func Check(ops []Op) Result {
+  bykey := map[string][]Op{}
+  keys := []string{}
+  for _, op := range ops {
+    if op.Kind == Get && op.Return == Pending {
+      continue
+    }
+    if _, present := bykey[op.Key]; !present {
+      keys = append(keys, op.Key)
+    }
+    bykey[op.Key] = append(bykey[op.Key], op)
+  }
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    if linearizable(bykey[key]) == false {
+      return Result{false, key, minimize(bykey[key])}
+    }
+  }
+  return Result{Ok: true}
+}
+
+// the services' PutHash hash.
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
+
+//
+// a key's state in the model is "" if the key does not
+// exist, or "=" followed by its value.
+//
+func valueOf(state string) string {
+  if state == "" {
+    return ""
+  }
+  return state[1:]
+}
+
+//
+// apply op to a key in state. returns the new state,
+// and false if op's output is impossible. a pending
+// op's output is unknown, so anything goes.
+//
+func step(state string, op Op) (string, bool) {
+  known := op.Return != Pending
+  value := valueOf(state)
+  switch op.Kind {
+  case Get:
+    return state, op.Output == value
+  case Put:
+    return "=" + op.Value, true
+  case PutHash:
+    next := strconv.Itoa(int(hash(value + op.Value)))
+    return "=" + next, !known || op.Output == value
+  case Append:
+    next := value + op.Value
+    return "=" + next, !known || op.Output == strconv.Itoa(len(next))
+  case CompareAndSwap, PutIfAbsent:
+    stored := value == op.Expected
+    if op.Kind == PutIfAbsent {
+      stored = state == ""
+    }
+    next := state
+    if stored {
+      next = "=" + op.Value
+    }
+    return next, !known || op.Output == conditional(stored, value)
+  }
+  return state, false
+}
+
+//
+// the invocation or the response of an operation, in a
+// list ordered by time. a call is lifted out of the list,
+// along with its return, when the search linearizes it.
+//
+type entry struct {
+  op int
+  call bool
+  match *entry // a call's return
+  prev *entry
+  next *entry
+}
+
+func makeEntries(ops []Op) *entry {
+  type event struct {
+    at time.Duration
+    call bool
+    op int
+  }
+  events := make([]event, 0, 2 * len(ops))
+  for i, op := range ops {
+    events = append(events, event{op.Call, true, i})
+    events = append(events, event{op.Return, false, i})
+  }
+  // operations that touch at the same instant overlap.
+  sort.Slice(events, func(i, j int) bool {
+    if events[i].at != events[j].at {
+      return events[i].at < events[j].at
+    }
+    return events[i].call && !events[j].call
+  })
+
+  head := &entry{op: -1}
+  calls := make([]*entry, len(ops))
+  last := head
+  for _, ev := range events {
+    e := &entry{op: ev.op, call: ev.call, prev: last}
+    if ev.call {
+      calls[ev.op] = e
+    } else {
+      calls[ev.op].match = e
+    }
+    last.next = e
+    last = e
+  }
+  return head
+}
+
+func unlink(e *entry) {
+  e.prev.next = e.next
+  if e.next != nil {
+    e.next.prev = e.prev
+  }
+}
+
+func relink(e *entry) {
+  e.prev.next = e
+  if e.next != nil {
+    e.next.prev = e
+  }
+}
+
+func lift(call *entry) {
+  unlink(call)
+  unlink(call.match)
+}
+
+// undo the most recent lift(), which must have been of call.
+func unlift(call *entry) {
+  relink(call.match)
+  relink(call)
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int) { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key() string {
+  buf := make([]byte, 8 * len(b))
+  for i, w := range b {
+    binary.LittleEndian.PutUint64(buf[8*i:], w)
+  }
+  return string(buf)
+}
+
+//
+// Wing & Gong's search for an order of ops: repeatedly pick
+// a call that no pending return precedes, apply it to the
+// model, and lift it out of the list; when no call can be
+// applied, undo the last choice and try the next one.
+//
+func linearizable(ops []Op) bool {
+  type choice struct {
+    call *entry
+    state string // before call was applied
+  }
+
+  head := makeEntries(ops)
+  linearized := make(bitset, (len(ops) + 63) / 64)
+  seen := map[string]bool{}
+  stack := []choice{}
+  state := ""
+
+  e := head.next
+  for head.next != nil {
+    if e.call {
+      if next, ok := step(state, ops[e.op]); ok {
+        linearized.set(e.op)
+        k := linearized.key() + next
+        if seen[k] == false {
+          seen[k] = true
+          stack = append(stack, choice{e, state})
+          state = next
+          lift(e)
+          e = head.next
+          continue
+        }
+        linearized.clear(e.op)
+      }
+      e = e.next
+    } else {
+      if ops[e.op].Return == Pending {
+        // every completed operation has been linearized,
+        // and the pending ones need not be.
+        return true
+      }
+      if len(stack) == 0 {
+        return false
+      }
+      c := stack[len(stack)-1]
+      stack = stack[:len(stack)-1]
+      state = c.state
+      linearized.clear(c.call.op)
+      unlift(c.call)
+      e = c.call.next
+    }
+  }
+  return true
+}
+
+//
+// shrink a non-linearizable history to a subset that is still
+// not linearizable, but becomes so if any one operation is
+// removed. removes chunks of halving size, as in delta
+// debugging, then single operations until none can go.
+//
+// a Put is only removed along with every Get that read its
+// value; otherwise any such Get alone would be a (useless)
+// counterexample.
+//
+func minimize(ops []Op) []Op {
+  written := func(ops []Op) map[string]bool {
+    w := map[string]bool{}
+    for _, op := range ops {
+      if op.Kind == Put {
+        w[op.Value] = true
+      }
+    }
+    return w
+  }
+  orig := written(ops)
+
+  fails := func(rest []Op) bool {
+    w := written(rest)
+    for _, op := range rest {
+      if op.Kind == Get && orig[op.Output] && w[op.Output] == false {
+        return false
+      }
+    }
+    return linearizable(rest) == false
+  }
+
+  without := func(i int, j int) []Op {
+    rest := append([]Op{}, ops[:i]...)
+    return append(rest, ops[j:]...)
+  }
+
+  for chunk := len(ops) / 2; chunk > 1; chunk /= 2 {
+    for i := 0; i < len(ops); {
+      j := i + chunk
+      if j > len(ops) {
+        j = len(ops)
+      }
+      if rest := without(i, j); fails(rest) {
+        ops = rest
+      } else {
+        i = j
+      }
+    }
+  }
+
+  for changed := true; changed; {
+    changed = false
+    for i := 0; i < len(ops); {
+      if rest := without(i, i+1); fails(rest) {
+        ops = rest
+        changed = true
+      } else {
+        i++
+      }
+    }
+  }
+
+  sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+  return ops
+}
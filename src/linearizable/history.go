@@ -0,0 +1,247 @@
+package linearizable
+
+//
+// Linearizability checking for key/value histories.
+//
+// A test wraps each of its Clerks with a Recorder, which notes
+// when every operation is invoked and when it returns, and
+// what it returned:
+//
+//   rec := linearizable.NewRecorder(nil)
+//   ck := rec.Wrap(MakeClerk(servers))
+//   ... run clients concurrently through ck ...
+//   rec.Verify(t)
+//
+// Verify() fails the test unless there is some order of the
+// operations, consistent with their real-time order, in which
+// every Get returns the value the operations before it left.
+// PutHash, Append, CompareAndSwap and PutIfAbsent, where a Clerk
+// has them, are checked the same way against their results.
+// If there is no such order,
+// it reports a minimal set of operations that cannot be
+// ordered that way.
+//
+// The checker is Wing & Gong's search, with Lowe's cache of
+// (operations linearized, state) pairs to cut off branches
+// already seen, as in Porcupine. Keys are independent in this
+// model, so each key's operations are checked on their own.
+//
+// An operation that has not returned by the time of the check
+// (e.g. its client was still retrying at the end of the test)
+// may or may not have taken effect. A pending update is kept,
+// but need not be linearized, and its result is not checked; a
+// pending Get tells nothing, and is left out.
+//
+
+import "fmt"
+import "sync"
+import "time"
+import "math"
+import "strconv"
+import "sim"
+
+type Kind int
+
+const (
+  Get Kind = iota
+  Put
+  PutHash // Output is the previous value
+  Append // Output is the new length
+  CompareAndSwap // Output is conditional(stored, previous value)
+  PutIfAbsent // likewise
+)
+
+// the Return of an operation that never returned.
+const Pending = time.Duration(math.MaxInt64)
+
+type Op struct {
+  Client int
+  Kind Kind
+  Key string
+  Value string // argument of an update
+  Expected string // argument of a CompareAndSwap
+  Output string // result, if the operation has one
+  Call time.Duration // since the Recorder was made
+  Return time.Duration
+}
+
+func (op Op) String() string {
+  ret := "..."
+  if op.Return != Pending {
+    ret = op.Return.String()
+  }
+  switch op.Kind {
+  case Get:
+    return fmt.Sprintf("client %v: Get(%q) -> %q [%v, %v]",
+                       op.Client, op.Key, op.Output, op.Call, ret)
+  case Put:
+    return fmt.Sprintf("client %v: Put(%q, %q) [%v, %v]",
+                       op.Client, op.Key, op.Value, op.Call, ret)
+  case PutHash:
+    return fmt.Sprintf("client %v: PutHash(%q, %q) -> %q [%v, %v]",
+                       op.Client, op.Key, op.Value, op.Output, op.Call, ret)
+  case Append:
+    return fmt.Sprintf("client %v: Append(%q, %q) -> %v [%v, %v]",
+                       op.Client, op.Key, op.Value, op.Output, op.Call, ret)
+  case CompareAndSwap:
+    return fmt.Sprintf("client %v: CompareAndSwap(%q, %q, %q) -> %v [%v, %v]",
+                       op.Client, op.Key, op.Expected, op.Value, op.Output, op.Call, ret)
+  case PutIfAbsent:
+    return fmt.Sprintf("client %v: PutIfAbsent(%q, %q) -> %v [%v, %v]",
+                       op.Client, op.Key, op.Value, op.Output, op.Call, ret)
+  }
+  return fmt.Sprintf("client %v: op %v on %q", op.Client, op.Kind, op.Key)
+}
+
+type Recorder struct {
+  mu sync.Mutex
+  clock sim.Clock
+  start time.Time
+  ops []Op
+  nclients int
+}
+
+//
+// a Recorder that times operations on clock;
+// nil means the wall clock.
+//
+func NewRecorder(clock sim.Clock) *Recorder {
+  if clock == nil {
+    clock = sim.Real{}
+  }
+  rec := &Recorder{}
+  rec.clock = clock
+  rec.start = clock.Now()
+  return rec
+}
+
+//
+// note that client has invoked an operation. returns
+// the handle to pass to End() when it returns.
+//
+func (rec *Recorder) Begin(client int, kind Kind, key string, value string) int {
+  return rec.begin(Op{Client: client, Kind: kind, Key: key, Value: value})
+}
+
+func (rec *Recorder) begin(op Op) int {
+  rec.mu.Lock()
+  defer rec.mu.Unlock()
+  op.Call = sim.Since(rec.clock, rec.start)
+  op.Return = Pending
+  rec.ops = append(rec.ops, op)
+  return len(rec.ops) - 1
+}
+
+func (rec *Recorder) End(h int, output string) {
+  rec.mu.Lock()
+  defer rec.mu.Unlock()
+  rec.ops[h].Output = output
+  rec.ops[h].Return = sim.Since(rec.clock, rec.start)
+}
+
+// a copy of the operations recorded so far.
+func (rec *Recorder) History() []Op {
+  rec.mu.Lock()
+  defer rec.mu.Unlock()
+  return append([]Op{}, rec.ops...)
+}
+
+func (rec *Recorder) Check() Result {
+  return Check(rec.History())
+}
+
+//
+// fail the test if the history so far is not linearizable.
+//
+func (rec *Recorder) Verify(t interface{ Fatalf(string, ...interface{}) }) {
+  if res := rec.Check(); res.Ok == false {
+    t.Fatalf("%v", res)
+  }
+}
+
+// what a Clerk has to provide to be recorded.
+type KV interface {
+  Get(key string) string
+  Put(key string, value string)
+}
+
+// Clerks that also have PutHash or Append.
+type Hasher interface {
+  PutHash(key string, value string) string
+}
+
+type Appender interface {
+  Append(key string, arg string) int
+}
+
+type Conditional interface {
+  CompareAndSwap(key string, expected string, update string) (bool, string)
+  PutIfAbsent(key string, value string) (bool, string)
+}
+
+// the Output of a CompareAndSwap or PutIfAbsent.
+func conditional(stored bool, prev string) string {
+  return strconv.FormatBool(stored) + " " + prev
+}
+
+//
+// a KV that records every operation it passes on.
+//
+type Clerk struct {
+  kv KV
+  rec *Recorder
+  client int
+}
+
+func (rec *Recorder) Wrap(kv KV) *Clerk {
+  rec.mu.Lock()
+  defer rec.mu.Unlock()
+  rec.nclients++
+  return &Clerk{kv: kv, rec: rec, client: rec.nclients}
+}
+
+func (ck *Clerk) Get(key string) string {
+  h := ck.rec.Begin(ck.client, Get, key, "")
+  v := ck.kv.Get(key)
+  ck.rec.End(h, v)
+  return v
+}
+
+func (ck *Clerk) Put(key string, value string) {
+  h := ck.rec.Begin(ck.client, Put, key, value)
+  ck.kv.Put(key, value)
+  ck.rec.End(h, "")
+}
+
+// panics if the wrapped Clerk has no PutHash.
+func (ck *Clerk) PutHash(key string, value string) string {
+  h := ck.rec.Begin(ck.client, PutHash, key, value)
+  prev := ck.kv.(Hasher).PutHash(key, value)
+  ck.rec.End(h, prev)
+  return prev
+}
+
+// panics if the wrapped Clerk has no Append.
+func (ck *Clerk) Append(key string, arg string) int {
+  h := ck.rec.Begin(ck.client, Append, key, arg)
+  n := ck.kv.(Appender).Append(key, arg)
+  ck.rec.End(h, strconv.Itoa(n))
+  return n
+}
+
+// panics if the wrapped Clerk has no CompareAndSwap.
+func (ck *Clerk) CompareAndSwap(key string, expected string, update string) (bool, string) {
+  h := ck.rec.begin(Op{Client: ck.client, Kind: CompareAndSwap, Key: key,
+                       Value: update, Expected: expected})
+  stored, prev := ck.kv.(Conditional).CompareAndSwap(key, expected, update)
+  ck.rec.End(h, conditional(stored, prev))
+  return stored, prev
+}
+
+// panics if the wrapped Clerk has no PutIfAbsent.
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string) {
+  h := ck.rec.Begin(ck.client, PutIfAbsent, key, value)
+  stored, prev := ck.kv.(Conditional).PutIfAbsent(key, value)
+  ck.rec.End(h, conditional(stored, prev))
+  return stored, prev
+}
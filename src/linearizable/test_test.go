@@ -0,0 +1,242 @@
+package linearizable
+
+import "testing"
+import "sync"
+import "time"
+import "strconv"
+import "math/rand"
+
+func ms(n int) time.Duration {
+  return time.Duration(n) * time.Millisecond
+}
+
+func put(client int, key string, value string, call int, ret int) Op {
+  op := Op{Client: client, Kind: Put, Key: key, Value: value, Call: ms(call), Return: Pending}
+  if ret >= 0 {
+    op.Return = ms(ret)
+  }
+  return op
+}
+
+func get(client int, key string, output string, call int, ret int) Op {
+  return Op{Client: client, Kind: Get, Key: key, Output: output, Call: ms(call), Return: ms(ret)}
+}
+
+func update(kind Kind, client int, key string, value string, output string,
+            call int, ret int) Op {
+  op := put(client, key, value, call, ret)
+  op.Kind = kind
+  op.Output = output
+  return op
+}
+
+func cas(client int, key string, expected string, value string, output string,
+         call int, ret int) Op {
+  op := update(CompareAndSwap, client, key, value, output, call, ret)
+  op.Expected = expected
+  return op
+}
+
+func TestCheck(t *testing.T) {
+  cases := []struct {
+    name string
+    ops []Op
+    ok bool
+  }{
+    {"sequential", []Op{
+      put(0, "a", "1", 0, 10),
+      get(0, "a", "1", 20, 30),
+      put(0, "a", "2", 40, 50),
+      get(1, "a", "2", 60, 70),
+    }, true},
+    {"missing key", []Op{
+      get(0, "a", "", 0, 10),
+      put(0, "a", "1", 20, 30),
+    }, true},
+    {"concurrent puts, either order", []Op{
+      put(0, "a", "1", 0, 50),
+      put(1, "a", "2", 10, 40),
+      get(2, "a", "1", 60, 70),
+      get(3, "a", "1", 80, 90),
+    }, true},
+    {"read overlapping a put", []Op{
+      put(0, "a", "1", 0, 10),
+      put(1, "a", "2", 20, 60),
+      get(2, "a", "1", 30, 40),
+      get(3, "a", "2", 50, 70),
+    }, true},
+    {"stale read", []Op{
+      put(0, "a", "1", 0, 10),
+      put(0, "a", "2", 20, 30),
+      get(1, "a", "1", 40, 50),
+    }, false},
+    {"reads disagree on order", []Op{
+      put(0, "a", "1", 0, 100),
+      put(1, "a", "2", 0, 100),
+      get(2, "a", "1", 10, 20),
+      get(2, "a", "2", 30, 40),
+      get(3, "a", "1", 50, 60),
+    }, false},
+    {"value never written", []Op{
+      put(0, "a", "1", 0, 10),
+      get(1, "a", "3", 20, 30),
+    }, false},
+    {"pending put took effect", []Op{
+      put(0, "a", "1", 0, 10),
+      put(1, "a", "2", 20, -1),
+      get(2, "a", "2", 30, 40),
+    }, true},
+    {"pending put never took effect", []Op{
+      put(0, "a", "1", 0, 10),
+      put(1, "a", "2", 20, -1),
+      get(2, "a", "1", 30, 40),
+    }, true},
+    {"puthash chain", []Op{
+      put(0, "a", "x", 0, 10),
+      update(PutHash, 1, "a", "y", "x", 20, 30),
+      get(2, "a", strconv.Itoa(int(hash("xy"))), 40, 50),
+    }, true},
+    {"puthash applied twice", []Op{
+      update(PutHash, 0, "a", "y", "", 0, 10),
+      get(1, "a", strconv.Itoa(int(hash(strconv.Itoa(int(hash("y"))) + "y"))), 20, 30),
+    }, false},
+    {"appends", []Op{
+      update(Append, 0, "a", "ab", "2", 0, 10),
+      update(Append, 1, "a", "c", "3", 5, 20),
+      get(2, "a", "abc", 30, 40),
+    }, true},
+    {"append applied twice", []Op{
+      update(Append, 0, "a", "ab", "2", 0, 10),
+      get(1, "a", "abab", 20, 30),
+    }, false},
+    {"pending append", []Op{
+      update(Append, 0, "a", "ab", "", 0, -1),
+      get(1, "a", "ab", 20, 30),
+    }, true},
+    {"compare and swap", []Op{
+      put(0, "a", "1", 0, 10),
+      cas(1, "a", "1", "2", "true 1", 20, 30),
+      cas(2, "a", "1", "3", "false 2", 40, 50),
+      get(0, "a", "2", 60, 70),
+    }, true},
+    {"two swaps from the same value", []Op{
+      put(0, "a", "1", 0, 10),
+      cas(1, "a", "1", "2", "true 1", 20, 50),
+      cas(2, "a", "1", "3", "true 1", 20, 50),
+    }, false},
+    {"put if absent", []Op{
+      update(PutIfAbsent, 0, "a", "", "true ", 0, 10),
+      update(PutIfAbsent, 1, "a", "x", "false ", 20, 30),
+      get(2, "a", "", 40, 50),
+    }, true},
+    {"put if absent on a key set to empty", []Op{
+      put(0, "a", "", 0, 10),
+      update(PutIfAbsent, 1, "a", "x", "true ", 20, 30),
+    }, false},
+    {"keys are independent", []Op{
+      put(0, "a", "1", 0, 10),
+      put(0, "b", "2", 20, 30),
+      get(1, "b", "2", 40, 50),
+      get(1, "a", "1", 60, 70),
+    }, true},
+  }
+
+  for _, c := range cases {
+    res := Check(c.ops)
+    if res.Ok != c.ok {
+      t.Fatalf("%v: got %v, wanted ok=%v", c.name, res, c.ok)
+    }
+  }
+}
+
+func TestCounterexample(t *testing.T) {
+  // a long, correct history for key "a" with one stale read
+  // buried in the middle.
+  ops := []Op{}
+  now := 0
+  for i := 0; i < 100; i++ {
+    ops = append(ops, put(i % 3, "a", strconv.Itoa(i), now, now + 5))
+    ops = append(ops, get(3, "a", strconv.Itoa(i), now + 6, now + 8))
+    ops = append(ops, put(4, "b", strconv.Itoa(i), now, now + 3))
+    now += 10
+  }
+  ops[3*50+1].Output = "10"
+
+  res := Check(ops)
+  if res.Ok || res.Key != "a" {
+    t.Fatalf("stale read not detected: %v", res)
+  }
+  // Put(10), a later Put, and the stale Get.
+  if len(res.Counterexample) != 3 {
+    t.Fatalf("counterexample not minimal:\n%v", res)
+  }
+  if res.Counterexample[0].Value != "10" ||
+     res.Counterexample[2].Kind != Get {
+    t.Fatalf("unexpected counterexample:\n%v", res)
+  }
+}
+
+// an in-memory KV whose Gets may read a stale copy.
+type memKV struct {
+  mu sync.Mutex
+  data map[string]string
+  stale map[string]string
+  lag bool
+}
+
+func (kv *memKV) Get(key string) string {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  if kv.lag {
+    return kv.stale[key]
+  }
+  return kv.data[key]
+}
+
+func (kv *memKV) Put(key string, value string) {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  kv.stale[key] = kv.data[key]
+  kv.data[key] = value
+}
+
+func TestRecorder(t *testing.T) {
+  kv := &memKV{data: map[string]string{}, stale: map[string]string{}}
+  rec := NewRecorder(nil)
+
+  const nclients = 5
+  var wg sync.WaitGroup
+  for i := 0; i < nclients; i++ {
+    wg.Add(1)
+    go func(me int) {
+      defer wg.Done()
+      ck := rec.Wrap(kv)
+      rr := rand.New(rand.NewSource(int64(me)))
+      for j := 0; j < 1000; j++ {
+        key := strconv.Itoa(rr.Int() % 3)
+        if rr.Int() % 2 == 0 {
+          ck.Put(key, strconv.Itoa(rr.Int()))
+        } else {
+          ck.Get(key)
+        }
+      }
+    }(i)
+  }
+  wg.Wait()
+
+  if len(rec.History()) != nclients * 1000 {
+    t.Fatalf("recorded %v operations, wanted %v",
+             len(rec.History()), nclients * 1000)
+  }
+  rec.Verify(t)
+
+  // now Gets lag one Put behind.
+  kv.lag = true
+  ck := rec.Wrap(kv)
+  ck.Put("x", "1")
+  ck.Put("x", "2")
+  ck.Get("x")
+  if res := rec.Check(); res.Ok || res.Key != "x" {
+    t.Fatalf("stale Get not detected: %v", res)
+  }
+}
@@ -2,6 +2,7 @@ package lockservice
 
 import "math/rand"
 import "log"
+import "transport"
 
 //
 // the lockservice Clerk lives in the client
@@ -9,6 +10,7 @@ import "log"
 //
 type Clerk struct {
   servers [2]string // primary port, backup port
+  tr transport.Transport
 
   request int // request id
   id int // the id of the client.
@@ -16,7 +18,15 @@ type Clerk struct {
 
 
 func MakeClerk(primary string, backup string) *Clerk {
+  return MakeClerkOn(fresh, primary, backup)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, primary string, backup string) *Clerk {
   ck := new(Clerk)
+  ck.tr = tr
   ck.servers[0] = primary
   ck.servers[1] = backup
 
@@ -43,10 +53,10 @@ func (ck *Clerk) Lock(lockname string) bool {
   var reply LockReply
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.servers[0], "LockServer.Lock", args, &reply)
+  ok := call(ck.tr, ck.servers[0], "LockServer.Lock", args, &reply)
   if ok == false {
     // contact the secondary
-    ok := call(ck.servers[1], "LockServer.Lock", args, &reply);
+    ok := call(ck.tr, ck.servers[1], "LockServer.Lock", args, &reply);
 
     if ok == false {
       ck.request += 1
@@ -78,10 +88,10 @@ func (ck *Clerk) Unlock(lockname string) bool {
   var reply UnlockReply
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.servers[0], "LockServer.Unlock", args, &reply)
+  ok := call(ck.tr, ck.servers[0], "LockServer.Unlock", args, &reply)
   if ok == false {
     // contact the secondary
-    ok := call(ck.servers[1], "LockServer.Unlock", args, &reply);
+    ok := call(ck.tr, ck.servers[1], "LockServer.Unlock", args, &reply);
 
     if ok == false {
       ck.request += 1
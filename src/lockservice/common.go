@@ -1,6 +1,6 @@
 package lockservice
 
-import "net/rpc"
+import "transport"
 
 //
 // RPC definitions for a simple lock service.
@@ -39,6 +39,12 @@ type UnlockReply struct {
 }
 
 
+//
+// a dying server fails the next connection it accepts (see
+// server.go), so the tests need every call to dial its own.
+//
+var fresh = transport.Unix{Fresh: true}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -52,20 +58,12 @@ type UnlockReply struct {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
-}
\ No newline at end of file
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
+}
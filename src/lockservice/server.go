@@ -2,10 +2,11 @@ package lockservice
 
 import "net"
 import "net/rpc"
+import "transport"
+import "faults"
 import "log"
 import "sync"
 import "fmt"
-import "os"
 import "io"
 import "time"
 
@@ -25,6 +26,7 @@ type LockServer struct {
 
   am_primary bool // am I the primary?
   backup string   // backup's port
+  tr transport.Transport
 
   // for each lock name, is it locked?
   locks map[string]bool
@@ -51,7 +53,7 @@ func (ls *LockServer) Lock(args *LockArgs, reply *LockReply) error {
 
   if ls.am_primary {
     var backupReply LockReply
-    call(ls.backup, "LockServer.Lock", args, &backupReply)
+    call(ls.tr, ls.backup, "LockServer.Lock", args, &backupReply)
   }
 
 
@@ -97,7 +99,7 @@ func (ls *LockServer) Unlock(args *UnlockArgs, reply *UnlockReply) error {
 
   if ls.am_primary {
     var backupReply LockReply
-    call(ls.backup, "LockServer.Unlock", args, &backupReply)
+    call(ls.tr, ls.backup, "LockServer.Unlock", args, &backupReply)
   }
 
   if present == true &&
@@ -158,7 +160,16 @@ func (dc DeafConn) Read(p []byte) (n int, err error) {
 }
 
 func StartServer(primary string, backup string, am_primary bool) *LockServer {
+  return StartServerOn(fresh, primary, backup, am_primary)
+}
+
+//
+// like StartServer(), but listens and sends RPCs with tr.
+//
+func StartServerOn(tr transport.Transport, primary string, backup string,
+                   am_primary bool) *LockServer {
   ls := new(LockServer)
+  ls.tr = tr
   ls.backup = backup
   ls.am_primary = am_primary
   ls.locks = map[string]bool{}
@@ -177,11 +188,10 @@ func StartServer(primary string, backup string, am_primary bool) *LockServer {
   // tell net/rpc about our RPC server and handlers.
   rpcs := rpc.NewServer()
   rpcs.Register(ls)
+  faults.Register(rpcs, ls.tr)
 
   // prepare to receive connections from clients.
-  // change "unix" to "tcp" to use over a network.
-  os.Remove(me) // only needed for "unix"
-  l, e := net.Listen("unix", me);
+  l, e := transport.Listen(ls.tr, me);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -0,0 +1,228 @@
+package paxos
+
+//
+// Batching several application values into one instance.
+//
+// px.StartBatch(seq, vs) proposes all of vs as a single value.
+// px.Entries(seq) returns a decided instance's values; entry i
+// of instance seq is always the i'th value of the batch that
+// was decided there. an instance decided by plain Start() has
+// one entry.
+//
+// A Batcher collects values submitted within a short window,
+// or until it has a size limit's worth, and proposes them as
+// one batch in the next free instance, trying later instances
+// if some other proposal wins. Submit() reports where each
+// value ended up, or closes its channel if the peer is killed
+// first. Submit()'s channels are for goroutines that aren't
+// tasks of a sim.Sim, which mustn't wait on channels.
+//
+
+import "time"
+import "sim"
+import "math"
+import "encoding/gob"
+
+type Batch struct {
+  Id int64 // tells apart batches that hold equal values
+  Values []interface{}
+}
+
+//
+// the position of one batched value: entry Index of
+// instance Seq.
+//
+type Entry struct {
+  Seq int
+  Index int
+}
+
+func init() {
+  gob.Register(Batch{})
+}
+
+func (px *Paxos) StartBatch(seq int, vs []interface{}) {
+  px.Start(seq, Batch{Id: px.rand.Int63(), Values: vs})
+}
+
+//
+// the values decided in instance seq, in a stable order.
+//
+func (px *Paxos) Entries(seq int) (bool, []interface{}) {
+  decided, v := px.Status(seq)
+  if decided == false {
+    return false, nil
+  }
+  return true, entries(v)
+}
+
+func entries(v interface{}) []interface{} {
+  if b, ok := v.(Batch); ok {
+    return b.Values
+  }
+  return []interface{}{v}
+}
+
+type Batcher struct {
+  mu sim.Mutex
+  px *Paxos
+  window time.Duration
+  limit int
+  pending []interface{}
+  waiters []chan Entry
+  kick *sim.Cond // broadcast when a batch may be ready
+  closed bool // the peer was killed; waiters are all closed
+}
+
+//
+// make a Batcher that proposes whatever it has collected
+// window after the first value arrives, or as soon as it
+// holds limit values. limit <= 0 means no limit.
+//
+func (px *Paxos) NewBatcher(window time.Duration, limit int) *Batcher {
+  if limit <= 0 {
+    limit = math.MaxInt32
+  }
+  b := &Batcher{}
+  b.px = px
+  b.window = window
+  b.limit = limit
+  b.kick = sim.NewCond(&b.mu)
+  px.clock.Go(b.run)
+  return b
+}
+
+//
+// queue v for the next batch. the returned channel
+// yields v's position once its batch is decided. if
+// the peer is killed before that, the channel is closed
+// without a value, and v may or may not be decided.
+//
+func (b *Batcher) Submit(v interface{}) <-chan Entry {
+  ch := make(chan Entry, 1)
+
+  b.mu.Lock()
+  if b.closed {
+    b.mu.Unlock()
+    close(ch)
+    return ch
+  }
+  b.pending = append(b.pending, v)
+  b.waiters = append(b.waiters, ch)
+  if n := len(b.pending); n == 1 || n >= b.limit {
+    b.kick.Broadcast()
+  }
+  b.mu.Unlock()
+  return ch
+}
+
+//
+// wait until kicked, or until d has passed, but no
+// longer than a second, so as to notice if the peer
+// has been killed.
+// caller must hold b.mu.
+//
+func (b *Batcher) wait(d time.Duration) {
+  if d > time.Second {
+    d = time.Second
+  }
+  b.kick.WaitFor(d)
+}
+
+func (b *Batcher) run() {
+  defer b.shut()
+
+  for b.px.dead == false {
+    b.mu.Lock()
+    if len(b.pending) == 0 {
+      b.wait(time.Second)
+      b.mu.Unlock()
+      continue
+    }
+
+    // give the batch until the window closes to fill up.
+    deadline := b.px.clock.Now().Add(b.window)
+    for len(b.pending) < b.limit && b.px.dead == false &&
+        b.px.clock.Now().Before(deadline) {
+      b.wait(deadline.Sub(b.px.clock.Now()))
+    }
+    if b.px.dead {
+      b.mu.Unlock()
+      return
+    }
+
+    n := len(b.pending)
+    if n > b.limit {
+      n = b.limit
+    }
+    values := b.pending[:n:n]
+    waiters := b.waiters[:n:n]
+    b.pending = b.pending[n:]
+    b.waiters = b.waiters[n:]
+    b.mu.Unlock()
+
+    b.propose(Batch{Id: b.px.rand.Int63(), Values: values}, waiters)
+  }
+}
+
+//
+// get batch decided in some instance, and tell each
+// waiter where its value went.
+//
+func (b *Batcher) propose(batch Batch, waiters []chan Entry) {
+  seq := b.px.place(batch, func(v interface{}) bool {
+    got, ok := v.(Batch)
+    return ok && got.Id == batch.Id
+  })
+  for i, ch := range waiters {
+    if seq >= 0 {
+      ch <- Entry{Seq: seq, Index: i}
+    }
+    close(ch)
+  }
+}
+
+//
+// the peer is dead: close the channel of every value
+// still waiting for a batch, and of any Submit() after.
+//
+func (b *Batcher) shut() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.closed = true
+  for _, ch := range b.waiters {
+    close(ch)
+  }
+  b.pending = nil
+  b.waiters = nil
+}
+
+//
+// get v decided in some instance after Max(), and return
+// it, or -1 if this peer is killed first. mine tells
+// whether a decided value is v. each instance is Start()ed
+// just once, since its proposer keeps going until it is
+// decided or forgotten.
+//
+func (px *Paxos) place(v interface{}, mine func(interface{}) bool) int {
+  seq := px.Max() + 1
+  for px.dead == false {
+    if min := px.Min(); seq < min {
+      seq = min
+    }
+    px.Start(seq, v)
+    decided, got := px.WaitDecided(seq, time.Second)
+    for decided == false && px.dead == false && seq >= px.Min() {
+      decided, got = px.WaitDecided(seq, time.Second)
+    }
+    if decided && mine(got) {
+      return seq
+    }
+    // someone else's value won; try further along.
+    if max := px.Max(); max > seq {
+      seq = max
+    }
+    seq++
+  }
+  return -1
+}
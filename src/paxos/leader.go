@@ -0,0 +1,387 @@
+package paxos
+
+//
+// Multi-Paxos leader mode, enabled with Options.Leader.
+//
+// A peer becomes leader by running phase 1 once for every
+// instance >= some seq (LeaderPrepare). Acceptors that agree
+// promise to reject lower-numbered proposals for all of those
+// instances, and report any instance in that range in which
+// they have already accepted something. From then on the
+// leader runs only phase 2 (Accept) and Decide for new
+// instances, falling back to an ordinary full round for the
+// reported ones.
+//
+// The leader sends a Heartbeat to the other peers once per
+// HeartbeatInterval. Other peers forward their Start()s to
+// a leader they have heard from recently. If they miss
+// DeadHeartbeats heartbeats in a row, they consider it failed,
+// and the next Start() tries to elect a new leader. A leader
+// that sees any of its proposals rejected steps down.
+//
+
+import "time"
+import "sim"
+
+const HeartbeatInterval = time.Millisecond * 100
+
+// followers declare the leader dead if it misses
+// this many heartbeats in a row.
+const DeadHeartbeats = 5
+
+// how many times a peer tries for leadership per Start().
+const electTries = 3
+
+type LeaderPrepareArgs struct {
+  From int // phase 1 for every instance >= From
+  N int
+  Me int
+  Done int
+}
+
+type Proposal struct {
+  Seq int
+  N int
+  Value interface{}
+}
+
+type LeaderPrepareReply struct {
+  OK bool
+  Err Err
+  N int
+  Accepted []Proposal // instances >= From with an accepted value
+  Done int
+}
+
+type HeartbeatArgs struct {
+  N int
+  Me int
+  Done int
+}
+
+type HeartbeatReply struct {
+  OK bool
+  N int
+  Done int
+}
+
+type ForwardArgs struct {
+  Seq int
+  Value interface{}
+}
+
+type ForwardReply struct {
+  OK bool // the instance is decided
+  Value interface{} // the decided value, which may not be the one forwarded
+}
+
+//
+// the acceptor's highest promise for instance seq,
+// taking a leader's promise-for-all into account.
+// caller must hold px.mu.
+//
+func (px *Paxos) promised(seq int, inst *instance) int {
+  if px.allN > inst.np && seq >= px.allFrom {
+    return px.allN
+  }
+  return inst.np
+}
+
+// caller must hold px.mu.
+func (px *Paxos) promiseAll(n int, from int) {
+  if px.allN < 0 || from < px.allFrom {
+    // a lower From only ever promises more.
+    px.allFrom = from
+  }
+  px.allN = n
+}
+
+func (px *Paxos) LeaderPrepare(args *LeaderPrepareArgs, reply *LeaderPrepareReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+
+  highest := px.allN
+  for seq, inst := range px.instances {
+    if seq >= args.From && inst.np > highest {
+      highest = inst.np
+    }
+  }
+
+  if args.N > highest {
+    px.promiseAll(args.N, args.From)
+    reply.OK = px.persist(record{Kind: recPromiseAll, Seq: args.From, N: args.N})
+    for seq, inst := range px.instances {
+      if seq < args.From {
+        continue
+      }
+      if inst.decided {
+        reply.Accepted = append(reply.Accepted, Proposal{seq, inst.na, inst.v})
+      } else if inst.na >= 0 {
+        reply.Accepted = append(reply.Accepted, Proposal{seq, inst.na, inst.va})
+      }
+    }
+    highest = args.N
+  } else {
+    reply.OK = false
+    reply.Err = Reject
+  }
+  reply.N = highest
+
+  return nil
+}
+
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+
+  if args.N >= px.allN {
+    px.leader = args.Me
+    px.lastBeat = px.clock.Now()
+    reply.OK = true
+  } else {
+    reply.OK = false
+  }
+  reply.N = px.allN
+
+  return nil
+}
+
+//
+// a follower wants the leader to get Value decided
+// in instance Seq. the leader only tries the fast
+// phase-2 path; if that fails the follower runs the
+// instance itself.
+//
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+  px.mu.Lock()
+  px.seen(args.Seq)
+  px.mu.Unlock()
+
+  if px.lead(args.Seq, args.Value, true) {
+    reply.OK, reply.Value = px.Status(args.Seq)
+  }
+  return nil
+}
+
+//
+// the peer we think is leader, or -1 if we have not
+// heard from one recently.
+//
+func (px *Paxos) liveLeader() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if px.leading {
+    return px.me
+  }
+  if px.leader >= 0 &&
+     sim.Since(px.clock, px.lastBeat) < HeartbeatInterval * DeadHeartbeats {
+    return px.leader
+  }
+  return -1
+}
+
+// caller must hold px.mu.
+func (px *Paxos) mayLead(seq int) bool {
+  // a membership change since leadFrom means the leader's
+  // phase 1 went to the wrong peers for seq.
+  return px.leading && seq >= px.leadFrom && px.leadSkip[seq] == false &&
+         px.configStart(seq) <= px.leadFrom
+}
+
+//
+// the proposal number and value to use for a phase-2-only
+// round in instance seq, if this peer may skip phase 1 there.
+// a leader must never propose two different values under
+// the same number, so the first value proposed for seq
+// sticks for as long as this peer leads, even after seq is
+// decided; it is only dropped when seq is forgotten.
+//
+func (px *Paxos) leaderBallot(seq int, v interface{}) (int, interface{}, bool) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if decided, _ := px.status(seq); decided || seq < px.min {
+    return 0, nil, false
+  }
+  if px.mayLead(seq) == false {
+    return 0, nil, false
+  }
+  if pv, present := px.leadVals[seq]; present {
+    v = pv
+  } else {
+    px.leadVals[seq] = v
+  }
+  return px.leadN, v, true
+}
+
+func (px *Paxos) stepDown() {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.leading = false
+  px.leadSkip = make(map[int]bool)
+  px.leadVals = make(map[int]interface{})
+  if px.leader == px.me {
+    px.leader = -1
+  }
+}
+
+//
+// Start() in leader mode. returns true if instance seq was
+// already finished, or was decided by a phase-2-only round
+// here or at the leader. if forwarded is set,
+// this peer was asked by a follower and must not forward
+// again or fall back to a full round.
+//
+func (px *Paxos) lead(seq int, v interface{}, forwarded bool) bool {
+  if px.finished(seq) {
+    return true
+  }
+
+  px.mu.Lock()
+  leading := px.mayLead(seq)
+  px.mu.Unlock()
+
+  if !leading && !forwarded {
+    l := px.liveLeader()
+    px.mu.Lock()
+    peers := px.latestPeers()
+    px.mu.Unlock()
+    if l >= 0 && l != px.me && l < len(peers) && peers[l] != "" {
+      args := &ForwardArgs{Seq: seq, Value: v}
+      reply := &ForwardReply{}
+      if call(px.tr, peers[l], "Paxos.Forward", args, reply) && reply.OK {
+        px.mu.Lock()
+        px.learn(seq, reply.Value)
+        px.mu.Unlock()
+        return true
+      }
+    }
+    px.elect(seq)
+  }
+
+  if n, lv, ok := px.leaderBallot(seq, v); ok {
+    if decided, _ := px.SendAccept(seq, n, lv); decided {
+      return true
+    }
+    px.stepDown()
+  }
+
+  if !forwarded {
+    px.SendPrepare(seq, v)
+  }
+  return false
+}
+
+//
+// try to win phase 1 for all instances >= from.
+//
+func (px *Paxos) elect(from int) {
+  px.electMu.Lock()
+  defer px.electMu.Unlock()
+
+  px.mu.Lock()
+  leading := px.mayLead(from)
+  px.mu.Unlock()
+  if leading {
+    return
+  }
+
+  px.mu.Lock()
+  highest := px.allN
+  known := px.configKnown(from)
+  peers := px.peersAt(from)
+  px.mu.Unlock()
+  if !known {
+    return
+  }
+
+  for try := 0; try < electTries && px.dead == false; try++ {
+    n := px.ballot(round(highest) + 1)
+    done := px.myDone()
+
+    nok := 0
+    skip := make(map[int]bool)
+    args := &LeaderPrepareArgs{From: from, N: n, Me: px.me, Done: done}
+    rs := px.fanout(peers, "Paxos.LeaderPrepare", args,
+                    func() interface{} { return &LeaderPrepareReply{} })
+    for nheard := 0; nok < majority(peers) &&
+                     possible(peers, nok, nheard); nheard++ {
+      resp := rs.next()
+      if resp.ok == false {
+        continue
+      }
+      reply := resp.reply.(*LeaderPrepareReply)
+      px.mu.Lock()
+      px.heardDone(resp.peer, reply.Done)
+      px.mu.Unlock()
+      if reply.OK {
+        nok++
+        for _, p := range reply.Accepted {
+          skip[p.Seq] = true
+        }
+      } else if reply.N > highest {
+        highest = reply.N
+      }
+    }
+
+    if nok >= majority(peers) {
+      px.mu.Lock()
+      px.leading = true
+      px.leadN = n
+      px.leadFrom = from
+      px.leadSkip = skip
+      px.leadVals = make(map[int]interface{})
+      px.leader = px.me
+      px.mu.Unlock()
+      return
+    }
+    if n > highest {
+      highest = n
+    }
+  }
+}
+
+//
+// while leading, tell the other peers we are alive.
+// steps down if any peer has promised a higher number.
+//
+func (px *Paxos) heartbeat() {
+  for px.dead == false {
+    px.mu.Lock()
+    leading, n := px.leading, px.leadN
+    px.mu.Unlock()
+
+    if leading {
+      px.mu.Lock()
+      peers := px.latestPeers()
+      px.mu.Unlock()
+      done := px.myDone()
+      for i := range peers {
+        if i == px.me || peers[i] == "" {
+          continue
+        }
+        args := &HeartbeatArgs{N: n, Me: px.me, Done: done}
+        reply := &HeartbeatReply{}
+        if call(px.tr, peers[i], "Paxos.Heartbeat", args, reply) {
+          px.mu.Lock()
+          px.heardDone(i, reply.Done)
+          px.mu.Unlock()
+          if reply.OK == false {
+            px.stepDown()
+            break
+          }
+        }
+      }
+    }
+
+    px.clock.Sleep(HeartbeatInterval)
+  }
+}
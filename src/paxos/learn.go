@@ -0,0 +1,188 @@
+package paxos
+
+//
+// Catch-up for peers that have fallen behind.
+//
+// A peer that was partitioned away or restarted may miss the
+// Decide messages for some instances. It can ask another peer
+// for every instance that peer has decided in a range with the
+// Learn RPC, and install the results as if it had received the
+// Decides. The target of a catch-up is the highest instance
+// this peer knows of, which includes the Max() reported by
+// every peer it has asked.
+//
+// A background thread catches up whenever the lowest undecided
+// instance stays stuck for a whole CatchupInterval; the
+// application can also call CatchUp() when it finds a gap.
+//
+
+import "time"
+
+const CatchupInterval = time.Millisecond * 500
+
+// most instances returned by one Learn RPC.
+const learnBatch = 100
+
+// longest wait between fruitless background catch-ups.
+const maxCatchupBackoff = 8 * CatchupInterval
+
+type LearnArgs struct {
+  From int
+  To int // -1 means through the responder's Max()
+  Me int
+  Done int
+}
+
+type LearnReply struct {
+  Decided []Agreement
+  Max int
+  Min int
+  Done int
+}
+
+func (px *Paxos) Learn(args *LearnArgs, reply *LearnReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  reply.Max = px.maxSeq
+  reply.Min = px.min
+
+  to := args.To
+  if to < 0 || to > px.maxSeq {
+    to = px.maxSeq
+  }
+  from := args.From
+  if from < px.min {
+    from = px.min
+  }
+  for seq := from; seq <= to && len(reply.Decided) < learnBatch; seq++ {
+    if inst, present := px.instances[seq]; present && inst.decided {
+      reply.Decided = append(reply.Decided, Agreement{seq, true, inst.v})
+    }
+  }
+
+  return nil
+}
+
+//
+// record that instance seq was decided with value v.
+// caller must hold px.mu.
+//
+func (px *Paxos) learn(seq int, v interface{}) {
+  if seq < px.min {
+    return
+  }
+  inst := px.instance(seq)
+  if inst.decided {
+    return
+  }
+  inst.decided = true
+  inst.v = v
+  px.persist(record{Kind: recDecide, Seq: seq, Value: v})
+  px.noteReconfig(seq, v)
+  px.notify()
+}
+
+//
+// the lowest instance in [Min(), Max()] that this peer has
+// not seen decided, or -1 if there is none.
+// caller must hold px.mu.
+//
+func (px *Paxos) firstUndecided() int {
+  if px.learned < px.min {
+    px.learned = px.min
+  }
+  for px.learned <= px.maxSeq {
+    inst, present := px.instances[px.learned]
+    if !present || !inst.decided {
+      return px.learned
+    }
+    px.learned++
+  }
+  return -1
+}
+
+//
+// ask the other peers, in random order, for decided instances
+// this peer is missing, until it has caught up with the highest
+// Max() it knows of. returns the number of instances learned.
+//
+func (px *Paxos) CatchUp() int {
+  px.mu.Lock()
+  peers := px.latestPeers()
+  px.mu.Unlock()
+
+  nlearned := 0
+  for _, i := range px.rand.Perm(len(peers)) {
+    if i == px.me || peers[i] == "" || px.dead {
+      continue
+    }
+
+    px.mu.Lock()
+    from := px.firstUndecided()
+    if from < 0 {
+      // nothing missing that we know of; ask anyway, in
+      // case the other peer knows of later instances.
+      from = px.maxSeq + 1
+    }
+    args := &LearnArgs{From: from, To: -1, Me: px.me, Done: px.dones[px.me]}
+    px.mu.Unlock()
+
+    reply := &LearnReply{}
+    if call(px.tr, peers[i], "Paxos.Learn", args, reply) == false {
+      continue
+    }
+
+    px.mu.Lock()
+    px.heardDone(i, reply.Done)
+    px.seen(reply.Max)
+    for _, a := range reply.Decided {
+      if inst, present := px.instances[a.Seq]; !present || !inst.decided {
+        nlearned++
+      }
+      px.learn(a.Seq, a.Value)
+    }
+    caughtUp := px.firstUndecided() < 0
+    px.mu.Unlock()
+
+    if caughtUp {
+      break
+    }
+  }
+  return nlearned
+}
+
+//
+// catch up in the background whenever the lowest undecided
+// instance has not moved for a whole CatchupInterval. a gap
+// that no peer can fill (e.g. an instance nobody has started)
+// is retried less and less often.
+//
+func (px *Paxos) catchupLoop() {
+  stuck := -1
+  backoff := CatchupInterval
+  for px.dead == false {
+    px.clock.Sleep(CatchupInterval)
+
+    px.mu.Lock()
+    first := px.firstUndecided()
+    px.mu.Unlock()
+
+    if first < 0 || first != stuck {
+      stuck = first
+      backoff = CatchupInterval
+      continue
+    }
+
+    if px.CatchUp() > 0 {
+      backoff = CatchupInterval
+    } else {
+      px.clock.Sleep(backoff)
+      if backoff < maxCatchupBackoff {
+        backoff *= 2
+      }
+    }
+  }
+}
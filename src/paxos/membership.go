@@ -0,0 +1,248 @@
+package paxos
+
+//
+// Changing the set of peers, enabled with Options.Alpha.
+//
+// A membership change is an ordinary value agreed on in the
+// log. A Reconfig decided in instance s changes the peer set
+// for every instance >= s + Alpha, so a proposer for instance
+// seq knows its peer set once it has learned every instance
+// up to seq - Alpha; until then it waits and catches up.
+// So with Alpha set, the application must not leave gaps:
+// every instance must eventually be Start()ed by someone.
+//
+// Peers are never renumbered: an added peer gets the next
+// index, and a removed peer's slot is left empty. That keeps
+// proposal numbers unique and lets peers keep addressing
+// each other (and tracking Done() values) by index.
+//
+// To bring up a new peer, call AddPeer() on an existing one,
+// then start the new peer with MakeJoin() and the existing
+// peer's Membership(). The new peer fetches the instances it
+// needs with the catch-up protocol.
+//
+
+import "fmt"
+import "sort"
+import "encoding/gob"
+
+// at most this many peers, ever, in one group.
+const maxPeers = 64
+
+type Reconfig struct {
+  Id int64
+  Add string // address of a peer to add, or ""
+  Remove int // index of a peer to remove, or -1
+}
+
+//
+// what a new peer needs to know to join the group.
+//
+type Membership struct {
+  Seq int // the new peer may ignore instances before Seq
+  Alpha int
+  Peers []string // the group's original peers
+  Changes map[int]Reconfig // seq -> change decided there
+}
+
+func init() {
+  gob.Register(Reconfig{})
+}
+
+//
+// the peers that take part in instance seq. indices are
+// stable; a removed peer's address is "".
+// caller must hold px.mu.
+//
+func (px *Paxos) peersAt(seq int) []string {
+  if len(px.changes) == 0 {
+    return px.peers
+  }
+  peers := append([]string{}, px.peers...)
+  for _, s := range px.changeSeqs() {
+    if s + px.alpha > seq {
+      break
+    }
+    rc := px.changes[s]
+    if rc.Add != "" {
+      peers = append(peers, rc.Add)
+    }
+    if rc.Remove >= 0 && rc.Remove < len(peers) {
+      peers[rc.Remove] = ""
+    }
+  }
+  return peers
+}
+
+//
+// the peers after every change this peer knows of.
+// caller must hold px.mu.
+//
+func (px *Paxos) latestPeers() []string {
+  return px.peersAt(int(^uint(0) >> 1))
+}
+
+//
+// every peer that takes part in some instance >= seq: the
+// peers of seq's config, and of every later one. a removed
+// peer stays in until its removal takes effect after seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) peersFrom(seq int) []string {
+  peers := append([]string{}, px.peersAt(seq)...)
+  for _, s := range px.changeSeqs() {
+    if s + px.alpha <= seq {
+      continue
+    }
+    for i, p := range px.peersAt(s + px.alpha) {
+      if i >= len(peers) {
+        peers = append(peers, p)
+      } else if peers[i] == "" {
+        peers[i] = p
+      }
+    }
+  }
+  return peers
+}
+
+//
+// the first instance governed by the same peer set as seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) configStart(seq int) int {
+  start := 0
+  for _, s := range px.changeSeqs() {
+    if s + px.alpha <= seq {
+      start = s + px.alpha
+    }
+  }
+  return start
+}
+
+// caller must hold px.mu.
+func (px *Paxos) changeSeqs() []int {
+  seqs := make([]int, 0, len(px.changes))
+  for s := range px.changes {
+    seqs = append(seqs, s)
+  }
+  sort.Ints(seqs)
+  return seqs
+}
+
+//
+// does this peer know for sure which peers take part
+// in instance seq? it does once it has learned every
+// instance that could hold a change affecting seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) configKnown(seq int) bool {
+  if px.alpha == 0 {
+    return true
+  }
+  limit := seq - px.alpha
+  if limit < px.min {
+    return true
+  }
+  first := px.firstUndecided()
+  return first < 0 || first > limit
+}
+
+//
+// remember a decided membership change.
+// caller must hold px.mu.
+//
+func (px *Paxos) noteReconfig(seq int, v interface{}) {
+  rc, ok := v.(Reconfig)
+  if !ok || px.alpha == 0 {
+    return
+  }
+  if _, present := px.changes[seq]; present {
+    return
+  }
+  px.changes[seq] = rc
+  px.persist(record{Kind: recReconfig, Seq: seq, Value: rc})
+}
+
+func majority(peers []string) int {
+  n := 0
+  for _, p := range peers {
+    if p != "" {
+      n++
+    }
+  }
+  return n / 2 + 1
+}
+
+//
+// add a peer at address addr. returns its index, and the
+// first instance in which it takes part.
+//
+func (px *Paxos) AddPeer(addr string) (int, int, error) {
+  if addr == "" {
+    return -1, -1, fmt.Errorf("AddPeer: empty address")
+  }
+  px.mu.Lock()
+  n := len(px.latestPeers())
+  px.mu.Unlock()
+  if n >= maxPeers {
+    return -1, -1, fmt.Errorf("AddPeer: group already has %v peers", n)
+  }
+
+  start, err := px.reconfigure(Reconfig{Id: px.rand.Int63(), Add: addr, Remove: -1})
+  if err != nil {
+    return -1, -1, err
+  }
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  peers := px.peersAt(start)
+  for i := len(peers) - 1; i >= 0; i-- {
+    if peers[i] == addr {
+      return i, start, nil
+    }
+  }
+  return -1, -1, fmt.Errorf("AddPeer: %v was not added", addr)
+}
+
+//
+// remove peer i. returns the first instance in which it
+// no longer takes part.
+//
+func (px *Paxos) RemovePeer(i int) (int, error) {
+  return px.reconfigure(Reconfig{Id: px.rand.Int63(), Add: "", Remove: i})
+}
+
+//
+// get rc decided in some instance, and return the first
+// instance it applies to.
+//
+func (px *Paxos) reconfigure(rc Reconfig) (int, error) {
+  if px.alpha == 0 {
+    return -1, fmt.Errorf("membership is fixed; set Options.Alpha")
+  }
+
+  seq := px.place(rc, func(v interface{}) bool {
+    got, ok := v.(Reconfig)
+    return ok && got.Id == rc.Id
+  })
+  if seq >= 0 {
+    return seq + px.alpha, nil
+  }
+  return -1, fmt.Errorf("paxos peer is dead")
+}
+
+//
+// what a new peer needs to join the group.
+//
+func (px *Paxos) Membership() Membership {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  m := Membership{Seq: px.min, Alpha: px.alpha}
+  m.Peers = append([]string{}, px.peers...)
+  m.Changes = make(map[int]Reconfig)
+  for s, rc := range px.changes {
+    m.Changes[s] = rc
+  }
+  return m
+}
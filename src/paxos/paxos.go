@@ -6,28 +6,46 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers is fixed, unless Options.Alpha is set;
+// see membership.go.
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// If given a storage directory, logs its acceptor state to disk
+// before replying to Prepare and Accept, and so can handle
+// crash+restart; otherwise stores nothing persistently.
 //
 // The application interface:
 //
 // px = paxos.Make(peers []string, me string)
+// px = paxos.MakeWithOptions(peers, me, rpcs, paxos.Options{Dir: dir})
+//   -- Options.Transport picks unix sockets, TCP, &c; see package transport.
+//      a transport.Pool keeps connections to the other peers open;
+//      a sim.Node runs the peer in a simulation, on virtual time.
+//      faults.Injector.Wrap() subjects the peer's links to faults.
+//   -- Options.Leader selects Multi-Paxos; see leader.go
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
+// px.WaitDecided(seq int, timeout) (decided bool, v interface{}) -- wait for a decision
+// px.Subscribe(seq int) <-chan Agreement -- decisions from seq on, in order
+// px.StartBatch(seq int, vs []interface{}) -- agree on several values at once
+// px.Entries(seq int) (decided bool, vs []interface{}) -- the values of an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.CatchUp() int -- fetch decided instances this peer missed
+// px.AddPeer(addr string), px.RemovePeer(i int) -- change the peer set
 //
 
 import "net"
 import "net/rpc"
 import "log"
-import "os"
 import "syscall"
-import "sync"
+import "errors"
+import "transport"
+import "sim"
+import "faults"
+import "sync/atomic"
 import "fmt"
-import "math/rand"
+import "time"
 
 type Agreement struct {
   Seq int
@@ -35,63 +53,124 @@ type Agreement struct {
   Value interface{}
 }
 
-
-type Accept struct {
-  Seq int
-  Value interface{}
+//
+// acceptor and learner state for one instance.
+// proposal numbers start at 0, so -1 means "none yet".
+//
+type instance struct {
+  np int          // highest prepare seen
+  na int          // highest accept seen
+  va interface{}  // value of highest accept
+  decided bool
+  v interface{}   // decided value
 }
 
 const (
   OK = "OK"
+  Reject = "Reject"
+  Forgotten = "Forgotten"
 )
 
 type Err string
 
+//
+// every message carries the sender's index and its highest
+// Done() argument, so that peers learn each other's Done()
+// values as a side effect of ordinary agreement.
+//
 type PrepareArgs struct {
   Seq int
+  N int
+  Me int
+  Done int
 }
 
 type PrepareReply struct {
   OK bool
   Err Err
-  Accept Accept
+  N int           // acceptor's n_p, so a rejected proposer can go higher
+  Na int
+  Va interface{}
+  Done int
 }
 
 
 type AcceptArgs struct {
   Seq int
+  N int
   Value interface{}
+  Me int
+  Done int
 }
 
 type AcceptReply struct {
   OK bool
-  Accept Accept
   Err Err
+  N int
+  Done int
 }
 
 type DecideArgs struct {
   Seq int
   Value interface{}
+  Me int
+  Done int
 }
 
-type DecideReply struct {}
+type DecideReply struct {
+  Done int
+}
 
 
 type Paxos struct {
-  mu sync.Mutex
+  mu sim.Mutex
   l net.Listener
   dead bool
-  unreliable bool
-  rpcCount int
-  peers []string
+  rpcCount int32 // requests received; see transport.ServeConn()
+  tr transport.Transport
+  clock sim.Clock // the wall clock, unless tr is simulated
+  rand sim.Rand // likewise
+  peers []string // the original peers; see membership.go
   me int // index into peers[]
 
 
   // Your data here.
-  instances map[int]Agreement
-  agreements map[int]Agreement
-  maxPrepare int
-  accept Accept
+  instances map[int]*instance
+  maxSeq int     // highest instance seq seen
+  dones []int    // highest Done() argument heard from each peer
+  min int        // instances below this have been forgotten
+  learned int    // every instance below this is decided or forgotten
+  store *storage // nil if not durable
+  decision *sim.Cond // broadcast on every decision
+  quit chan struct{} // closed by Kill()
+  alpha int      // membership changes take effect this many instances on
+  changes map[int]Reconfig // decided membership changes, by seq
+
+  // acceptor: promise not to accept anything numbered below
+  // allN in any instance >= allFrom. see leader.go.
+  allN int
+  allFrom int
+
+  // proposer, in leader mode.
+  leaderMode bool
+  electMu sim.Mutex    // one election at a time
+  leading bool         // won phase 1 for all instances >= leadFrom
+  leadN int
+  leadFrom int
+  leadSkip map[int]bool // instances that still need a full round
+  leadVals map[int]interface{} // value proposed in each phase-2 round
+  leader int           // peer we last heard a heartbeat from, or -1
+  lastBeat time.Time
+}
+
+//
+// optional settings for MakeWithOptions().
+//
+type Options struct {
+  Dir string // directory for the write-ahead log; "" means none
+  Leader bool // run as Multi-Paxos with a stable leader
+  Alpha int // allow membership changes, with this window; 0 means never
+  Transport transport.Transport // nil means unix-domain sockets
 }
 
 //
@@ -110,21 +189,17 @@ type Paxos struct {
 // please use call() to send all RPCs, in client.go and server.go.
 // please do not change this function.
 //
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-  c, err := rpc.Dial("unix", srv)
-  if err != nil {
-    err1 := err.(*net.OpError)
-    if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-      fmt.Printf("paxos Dial() failed: %v\n", err1)
-    }
-    return false
-  }
-  defer c.Close()
-
-  err = c.Call(name, args, reply)
+func call(tr transport.Transport, srv string, name string,
+          args interface{}, reply interface{}) bool {
+  err := transport.Call(tr, srv, name, args, reply)
   if err == nil {
     return true
   }
+  if err1, ok := err.(*net.OpError); ok && err1.Op == "dial" {
+    if !errors.Is(err1, syscall.ENOENT) && !errors.Is(err1, syscall.ECONNREFUSED) {
+      fmt.Printf("paxos Dial() failed: %v\n", err1)
+    }
+  }
   return false
 }
 
@@ -138,7 +213,15 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 // is reached.
 //
 func (px *Paxos) Start(seq int, v interface{}) {
-  go px.SendPrepare(seq, v)
+  px.mu.Lock()
+  px.seen(seq)
+  px.mu.Unlock()
+
+  if px.leaderMode {
+    px.clock.Go(func() { px.lead(seq, v, false) })
+  } else {
+    px.clock.Go(func() { px.SendPrepare(seq, v) })
+  }
 }
 
 //
@@ -148,8 +231,14 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
-  // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
 
+  if seq > px.dones[px.me] {
+    px.dones[px.me] = seq
+    px.persist(record{Kind: recDone, Seq: seq})
+    px.forget()
+  }
 }
 
 //
@@ -158,7 +247,9 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
-  return px.maxPrepare
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.maxSeq
 }
 
 //
@@ -192,9 +283,69 @@ func (px *Paxos) Max() int {
 // missed -- the other peers therefor cannot forget these
 // instances.
 //
+// Likewise a peer that RemovePeer() took out of the group
+// holds Min() back until it is Done() with the last instance
+// it took part in.
+//
 func (px *Paxos) Min() int {
-  // You code here.
-  return 0
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.min
+}
+
+//
+// record that peer i has called Done(done).
+// caller must hold px.mu.
+//
+func (px *Paxos) heardDone(i int, done int) {
+  if i < 0 || i >= maxPeers {
+    return
+  }
+  for len(px.dones) <= i {
+    px.dones = append(px.dones, -1)
+  }
+  if done > px.dones[i] {
+    px.dones[i] = done
+    px.forget()
+  }
+}
+
+//
+// advance px.min to one more than the lowest Done() value
+// across all peers, and free every instance below it. a
+// removed peer counts until px.min reaches the first instance
+// it doesn't take part in, since it may still need the ones
+// before.
+// caller must hold px.mu.
+//
+func (px *Paxos) forget() {
+  min := px.dones[px.me]
+  for i, peer := range px.peersFrom(px.min) {
+    if peer == "" {
+      continue
+    }
+    if i >= len(px.dones) {
+      min = -1
+    } else if px.dones[i] < min {
+      min = px.dones[i]
+    }
+  }
+  if min + 1 <= px.min {
+    return
+  }
+  px.min = min + 1
+
+  for seq := range px.instances {
+    if seq < px.min {
+      delete(px.instances, seq)
+    }
+  }
+  for seq := range px.leadVals {
+    if seq < px.min {
+      delete(px.leadVals, seq)
+    }
+  }
+  px.compact()
 }
 
 //
@@ -205,129 +356,519 @@ func (px *Paxos) Min() int {
 // it should not contact other Paxos peers.
 //
 func (px *Paxos) Status(seq int) (bool, interface{}) {
-  agreement, present := px.instances[seq]
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.status(seq)
+}
 
-  if !present {
-    return false, nil
+//
+// like Status(), but if instance seq is not yet decided,
+// wait up to timeout for a decision to arrive.
+//
+func (px *Paxos) WaitDecided(seq int, timeout time.Duration) (bool, interface{}) {
+  deadline := px.clock.Now().Add(timeout)
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  for {
+    decided, v := px.status(seq)
+    left := deadline.Sub(px.clock.Now())
+    if decided || px.dead || seq < px.min || left <= 0 {
+      return decided, v
+    }
+    px.decision.WaitFor(left)
   }
+}
 
-  return agreement.Decided, agreement.Value
+//
+// deliver every decided instance from seq onward, in
+// sequence order, on the returned channel. an instance
+// that is forgotten before it can be delivered is skipped.
+// the channel is closed when the peer is killed. under a
+// sim.Sim, read it from a goroutine that isn't one of the
+// Sim's tasks, since they mustn't wait on channels.
+//
+func (px *Paxos) Subscribe(seq int) <-chan Agreement {
+  ch := make(chan Agreement)
+  go func() {
+    defer close(ch)
+    for px.dead == false {
+      decided, v := px.WaitDecided(seq, time.Second)
+      if decided {
+        select {
+        case ch <- Agreement{Seq: seq, Decided: true, Value: v}:
+          seq++
+        case <-px.quit:
+          return
+        }
+      } else if min := px.Min(); seq < min {
+        seq = min
+      }
+    }
+  }()
+  return ch
 }
 
+//
+// wake up everyone in WaitDecided().
+// caller must hold px.mu.
+//
+func (px *Paxos) notify() {
+  px.decision.Broadcast()
+}
 
-func (px *Paxos) SendPrepare(seq int, value interface{}) {
+// caller must hold px.mu.
+func (px *Paxos) status(seq int) (bool, interface{}) {
+  if seq < px.min {
+    return false, nil
+  }
+  inst, present := px.instances[seq]
+  if !present || !inst.decided {
+    return false, nil
+  }
+  return true, inst.v
+}
 
-  log.Printf("[%d] Sending prepare %d", px.me, seq)
+//
+// return the state for instance seq, creating it if needed.
+// caller must hold px.mu.
+//
+func (px *Paxos) instance(seq int) *instance {
+  inst, present := px.instances[seq]
+  if !present {
+    inst = &instance{np: -1, na: -1}
+    px.instances[seq] = inst
+  }
+  px.seen(seq)
+  return inst
+}
 
-  var args PrepareArgs
-  replies := make([]*PrepareReply, len(px.peers))
-  for i, peer := range px.peers {
-    args = PrepareArgs{Seq: seq}
-    replies[i] = &PrepareReply{}
-    call(peer, "Paxos.Prepare", args, &replies[i])
+// caller must hold px.mu.
+func (px *Paxos) seen(seq int) {
+  if seq > px.maxSeq {
+    px.maxSeq = seq
   }
+}
 
-  numReplies := 0
-  highestAccept := Accept{Value : value}
+//
+// proposal numbers are round * maxPeers + me, so that
+// every peer draws from its own disjoint set of numbers
+// and a higher round always means a higher number.
+//
+func (px *Paxos) ballot(round int) int {
+  return round * maxPeers + px.me
+}
 
-  for _, reply := range replies {
-    if reply.OK {
-      numReplies += 1
-      if reply.Accept.Seq > highestAccept.Seq {
-        highestAccept = reply.Accept
-      }
+// the round of proposal number n.
+func round(n int) int {
+  return n / maxPeers
+}
+
+//
+// is instance seq decided or forgotten, so that there
+// is nothing left for a proposer to do?
+//
+func (px *Paxos) finished(seq int) bool {
+  decided, _ := px.Status(seq)
+  return decided || seq < px.Min()
+}
+
+func (px *Paxos) myDone() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.dones[px.me]
+}
+
+//
+// send an RPC to peer i of peers. calls to ourselves go
+// straight to the handler, so that a peer whose socket is
+// unreachable can still hear its own proposals.
+//
+func (px *Paxos) send(peers []string, i int, name string,
+                      args interface{}, reply interface{}) bool {
+  if i == px.me {
+    switch name {
+    case "Paxos.Prepare":
+      return px.Prepare(args.(*PrepareArgs), reply.(*PrepareReply)) == nil
+    case "Paxos.Accept":
+      return px.Accept(args.(*AcceptArgs), reply.(*AcceptReply)) == nil
+    case "Paxos.Decide":
+      return px.Decide(args.(*DecideArgs), reply.(*DecideReply)) == nil
+    case "Paxos.LeaderPrepare":
+      return px.LeaderPrepare(args.(*LeaderPrepareArgs),
+                              reply.(*LeaderPrepareReply)) == nil
     }
   }
+  if peers[i] == "" {
+    return false
+  }
+  return call(px.tr, peers[i], name, args, reply)
+}
 
-  log.Printf("[%d] Received %d replies for seq %d", px.me, numReplies, seq)
+//
+// a reply from one peer to a fanout().
+//
+type response struct {
+  peer int
+  ok bool // the RPC got through
+  reply interface{}
+}
+
+//
+// the responses to a fanout(), in the order the peers
+// answer.
+//
+type responses struct {
+  mu sim.Mutex
+  arrived *sim.Cond
+  got []response
+}
 
-  if numReplies < (len(px.peers) / 2) {
-    return;
+// wait for the next response.
+func (rs *responses) next() response {
+  rs.mu.Lock()
+  defer rs.mu.Unlock()
+  for len(rs.got) == 0 {
+    rs.arrived.Wait()
   }
+  resp := rs.got[0]
+  rs.got = rs.got[1:]
+  return resp
+}
 
-  acceptArgs := AcceptArgs{Seq   : seq,
-                           Value : highestAccept.Value}
+//
+// send the same RPC to every one of peers at once. a caller
+// that stops reading responses early leaves nothing blocked.
+//
+func (px *Paxos) fanout(peers []string, name string, args interface{},
+                        newReply func() interface{}) *responses {
+  rs := &responses{}
+  rs.arrived = sim.NewCond(&rs.mu)
+  for i := range peers {
+    i := i
+    px.clock.Go(func() {
+      reply := newReply()
+      ok := px.send(peers, i, name, args, reply)
+      rs.mu.Lock()
+      rs.got = append(rs.got, response{i, ok, reply})
+      rs.arrived.Broadcast()
+      rs.mu.Unlock()
+    })
+  }
+  return rs
+}
 
-  acceptedReplies := make([]*AcceptReply, len(px.peers))
-  numAccepted := 0
+//
+// can a majority of peers still say yes, with nyes yes
+// answers out of nheard heard so far?
+//
+func possible(peers []string, nyes int, nheard int) bool {
+  return nyes + len(peers) - nheard >= majority(peers)
+}
+
+//
+// act as proposer for instance seq until it is decided,
+// retrying with a higher proposal number whenever a
+// round is rejected or fails to reach a majority.
+//
+func (px *Paxos) SendPrepare(seq int, value interface{}) {
+  r := 0
+  for px.dead == false && px.finished(seq) == false {
+    px.mu.Lock()
+    known := px.configKnown(seq)
+    peers := px.peersAt(seq)
+    px.mu.Unlock()
+    if !known {
+      // a membership change we have not learned may apply.
+      px.CatchUp()
+      px.clock.Sleep(CatchupInterval / 10)
+      continue
+    }
+
+    n := px.ballot(r)
+    highest := n
+    done := px.myDone()
+
+    // phase 1. any majority's highest accepted value will
+    // do, so stop listening as soon as one has answered.
+    nprepared := 0
+    na := -1
+    v := value
+    args := &PrepareArgs{Seq: seq, N: n, Me: px.me, Done: done}
+    rs := px.fanout(peers, "Paxos.Prepare", args,
+                    func() interface{} { return &PrepareReply{} })
+    for nheard := 0; nprepared < majority(peers) &&
+                     possible(peers, nprepared, nheard); nheard++ {
+      resp := rs.next()
+      if resp.ok == false {
+        continue
+      }
+      reply := resp.reply.(*PrepareReply)
+      px.mu.Lock()
+      px.heardDone(resp.peer, reply.Done)
+      px.mu.Unlock()
+      if reply.OK {
+        nprepared++
+        if reply.Na > na {
+          na = reply.Na
+          v = reply.Va
+        }
+      } else if reply.N > highest {
+        highest = reply.N
+      }
+    }
+
+    // phases 2 and 3
+    if nprepared >= majority(peers) {
+      ok, h := px.SendAccept(seq, n, v)
+      if ok {
+        return
+      }
+      if h > highest {
+        highest = h
+      }
+    }
 
-  for i, peer := range px.peers {
-    acceptedReplies[i] = &AcceptReply{}
-    call(peer, "Paxos.Accept", acceptArgs, &acceptedReplies[i])
+    // pick a round whose proposal number beats anything seen,
+    // and back off a little so duelling proposers can finish.
+    r = round(highest) + 1
+    px.clock.Sleep(time.Duration(px.rand.Int63() % 30) * time.Millisecond)
   }
+}
 
-  for _, reply := range acceptedReplies {
+//
+// ask every peer to accept (n, v) for instance seq, and
+// if a majority does, tell every peer it is decided.
+// returns whether v was decided, and the highest proposal
+// number any rejecting acceptor reported.
+//
+func (px *Paxos) SendAccept(seq int, n int, v interface{}) (bool, int) {
+  px.mu.Lock()
+  peers := px.peersAt(seq)
+  px.mu.Unlock()
+
+  done := px.myDone()
+  highest := n
+  naccepted := 0
+  args := &AcceptArgs{Seq: seq, N: n, Value: v, Me: px.me, Done: done}
+  rs := px.fanout(peers, "Paxos.Accept", args,
+                  func() interface{} { return &AcceptReply{} })
+  for nheard := 0; naccepted < majority(peers) &&
+                   possible(peers, naccepted, nheard); nheard++ {
+    resp := rs.next()
+    if resp.ok == false {
+      continue
+    }
+    reply := resp.reply.(*AcceptReply)
+    px.mu.Lock()
+    px.heardDone(resp.peer, reply.Done)
+    px.mu.Unlock()
     if reply.OK {
-      numAccepted += 1
+      naccepted++
+    } else if reply.N > highest {
+      highest = reply.N
     }
   }
 
-  if numAccepted < len(px.peers) / 2 {
-    return
+  if naccepted < majority(peers) {
+    return false, highest
   }
 
-  log.Printf("[%d] Sending decide for %d, value %v", px.me, seq, highestAccept.Value)
-
-  decideArgs := DecideArgs{Seq   : seq,
-                           Value : highestAccept.Value}
-  decideReply := DecideReply{}
-
-  for _, peer := range px.peers {
-    call(peer, "Paxos.Decide", decideArgs, &decideReply)
+  // learn the value here before returning, and tell the
+  // other peers in the background.
+  dargs := &DecideArgs{Seq: seq, Value: v, Me: px.me, Done: done}
+  px.send(peers, px.me, "Paxos.Decide", dargs, &DecideReply{})
+  for i := range peers {
+    if i == px.me {
+      continue
+    }
+    i := i
+    px.clock.Go(func() {
+      reply := &DecideReply{}
+      if px.send(peers, i, "Paxos.Decide", dargs, reply) {
+        px.mu.Lock()
+        px.heardDone(i, reply.Done)
+        px.mu.Unlock()
+      }
+    })
   }
+  return true, highest
 }
 
 
-func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
-
-  log.Printf("[%d] Received accept call", px.me)
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
   px.mu.Lock()
   defer px.mu.Unlock()
 
-  if (args.Seq >= px.maxPrepare) {
-    px.maxPrepare   = args.Seq
-    px.accept.Seq   = args.Seq
-    px.accept.Value = args.Value
-    px.agreements[args.Seq] = Agreement{Seq: args.Seq,
-                                        Decided: false,
-                                        Value: args.Value}
-    reply.OK = true
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min {
+    reply.OK = false
+    reply.Err = Forgotten
+    return nil
+  }
+
+  inst := px.instance(args.Seq)
+
+  if args.N > px.promised(args.Seq, inst) {
+    inst.np = args.N
+    reply.OK = px.persist(record{Kind: recPrepare, Seq: args.Seq, N: args.N})
+    reply.Na = inst.na
+    reply.Va = inst.va
   } else {
     reply.OK = false
+    reply.Err = Reject
   }
+  reply.N = px.promised(args.Seq, inst)
 
   return nil
 }
 
 
-func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
-
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
   px.mu.Lock()
   defer px.mu.Unlock()
 
-  log.Printf("[%d] Received prepare call", px.me)
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min {
+    reply.OK = false
+    reply.Err = Forgotten
+    return nil
+  }
+
+  inst := px.instance(args.Seq)
 
-  if (args.Seq > px.maxPrepare) {
-    px.maxPrepare = args.Seq
-    reply.OK = true
-    reply.Accept = px.accept
+  if args.N >= px.promised(args.Seq, inst) {
+    inst.np = args.N
+    inst.na = args.N
+    inst.va = args.Value
+    reply.OK = px.persist(record{Kind: recAccept, Seq: args.Seq,
+                                 N: args.N, Value: args.Value})
   } else {
     reply.OK = false
+    reply.Err = Reject
   }
-
-  log.Printf("[%d] Max prepare: %d, Seq: %d, OK: %t", px.me, px.maxPrepare, args.Seq, reply.OK)
+  reply.N = px.promised(args.Seq, inst)
 
   return nil
 }
 
 
 func (px *Paxos) Decide(args *DecideArgs, reply *DecideReply) error {
-  px.instances[args.Seq] = Agreement{Seq: args.Seq,
-                                     Value: args.Value,
-                                     Decided: true }
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  px.learn(args.Seq, args.Value)
   return nil
 }
 
+//
+// write a record to the log, if this peer is durable.
+// returns false if the record could not be made durable,
+// in which case the caller must not acknowledge it.
+// caller must hold px.mu.
+//
+func (px *Paxos) persist(rec record) bool {
+  if px.store == nil {
+    return true
+  }
+  if err := px.store.append(rec); err != nil {
+    log.Printf("[%d] persist failed: %v", px.me, err)
+    return false
+  }
+  return true
+}
+
+//
+// rebuild state from records read back from the log.
+//
+func (px *Paxos) replay(records []record) {
+  for _, rec := range records {
+    switch rec.Kind {
+    case recDone:
+      if rec.Seq > px.dones[px.me] {
+        px.dones[px.me] = rec.Seq
+      }
+      continue
+    case recForget:
+      if rec.Seq > px.min {
+        px.min = rec.Seq
+      }
+      continue
+    case recPromiseAll:
+      px.promiseAll(rec.N, rec.Seq)
+      continue
+    case recReconfig:
+      if rc, ok := rec.Value.(Reconfig); ok {
+        px.changes[rec.Seq] = rc
+      }
+      continue
+    }
+    if rec.Seq < px.min {
+      continue
+    }
+    inst := px.instance(rec.Seq)
+    switch rec.Kind {
+    case recPrepare:
+      if rec.N > inst.np {
+        inst.np = rec.N
+      }
+    case recAccept:
+      if rec.N > inst.np {
+        inst.np = rec.N
+      }
+      inst.na = rec.N
+      inst.va = rec.Value
+    case recDecide:
+      inst.decided = true
+      inst.v = rec.Value
+      if rc, ok := rec.Value.(Reconfig); ok && px.alpha > 0 {
+        px.changes[rec.Seq] = rc
+      }
+    }
+  }
+}
+
+//
+// once forgotten instances make up most of the log,
+// rewrite it to hold just the live state.
+// caller must hold px.mu.
+//
+func (px *Paxos) compact() {
+  if px.store == nil || px.store.n < compactMin ||
+     px.store.n < 3 * len(px.instances) {
+    return
+  }
+
+  records := []record{ {Kind: recDone, Seq: px.dones[px.me]},
+                       {Kind: recForget, Seq: px.min} }
+  if px.allN >= 0 {
+    records = append(records, record{Kind: recPromiseAll, Seq: px.allFrom,
+                                     N: px.allN})
+  }
+  for seq, rc := range px.changes {
+    records = append(records, record{Kind: recReconfig, Seq: seq, Value: rc})
+  }
+  for seq, inst := range px.instances {
+    if inst.na >= 0 {
+      records = append(records, record{Kind: recAccept, Seq: seq,
+                                       N: inst.na, Value: inst.va})
+    }
+    if inst.np > inst.na {
+      records = append(records, record{Kind: recPrepare, Seq: seq, N: inst.np})
+    }
+    if inst.decided {
+      records = append(records, record{Kind: recDecide, Seq: seq, Value: inst.v})
+    }
+  }
+  if err := px.store.rewrite(records); err != nil {
+    log.Printf("[%d] compact failed: %v", px.me, err)
+  }
+}
+
 
 //
 // tell the peer to shut itself down.
@@ -339,6 +880,18 @@ func (px *Paxos) Kill() {
   if px.l != nil {
     px.l.Close()
   }
+  px.mu.Lock()
+  if px.store != nil {
+    // later appends fail, so nothing more gets acknowledged.
+    px.store.close()
+  }
+  select {
+  case <-px.quit:
+  default:
+    close(px.quit)
+    px.notify()
+  }
+  px.mu.Unlock()
 }
 
 //
@@ -347,16 +900,108 @@ func (px *Paxos) Kill() {
 // are in peers[]. this servers port is peers[me].
 //
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+  return MakeWithOptions(peers, me, rpcs, Options{})
+}
+
+//
+// like Make(), but with optional settings. if opts.Dir
+// is set, the peer logs its state there and reloads it
+// when it is restarted with the same directory.
+//
+func MakeWithOptions(peers []string, me int, rpcs *rpc.Server,
+                     opts Options) *Paxos {
+  px := newPaxos(peers, me, opts)
+  px.open(opts.Dir)
+  px.listen(rpcs)
+  return px
+}
+
+//
+// start a peer that is joining an existing group, as peer
+// me of m, which the caller got from an existing peer's
+// Membership() after that peer's AddPeer() returned me.
+// to restart a joined peer, call MakeJoin() again with
+// the same m and opts.Dir.
+//
+func MakeJoin(m Membership, me int, rpcs *rpc.Server, opts Options) *Paxos {
+  opts.Alpha = m.Alpha
+  px := newPaxos(m.Peers, me, opts)
+  for s, rc := range m.Changes {
+    px.changes[s] = rc
+  }
+  px.open(opts.Dir)
+
+  px.mu.Lock()
+  for s, rc := range m.Changes {
+    px.persist(record{Kind: recReconfig, Seq: s, Value: rc})
+  }
+  if m.Seq > px.min {
+    // the group may already have forgotten what came
+    // before m.Seq, so don't wait for it.
+    px.min = m.Seq
+    px.persist(record{Kind: recForget, Seq: m.Seq})
+  }
+  px.heardDone(me, m.Seq - 1)
+  px.persist(record{Kind: recDone, Seq: px.dones[me]})
+  px.mu.Unlock()
+
+  px.listen(rpcs)
+  return px
+}
+
+func newPaxos(peers []string, me int, opts Options) *Paxos {
   px := &Paxos{}
   px.peers = peers
   px.me = me
 
 
   // Your initialization code here.
-  px.instances = make(map[int]Agreement)
-  px.agreements = make(map[int]Agreement)
-  px.accept = Accept{}
-  px.maxPrepare = -1
+  px.instances = make(map[int]*instance)
+  px.maxSeq = -1
+  px.decision = sim.NewCond(&px.mu)
+  px.quit = make(chan struct{})
+  px.dones = make([]int, len(peers))
+  for i := range px.dones {
+    px.dones[i] = -1
+  }
+  px.heardDone(me, -1)
+  px.alpha = opts.Alpha
+  px.tr = opts.Transport
+  px.clock = sim.ClockOf(opts.Transport)
+  px.rand = sim.RandOf(opts.Transport)
+  px.changes = make(map[int]Reconfig)
+  px.allN = -1
+  px.leaderMode = opts.Leader
+  px.leadSkip = make(map[int]bool)
+  px.leadVals = make(map[int]interface{})
+  px.leader = -1
+
+  return px
+}
+
+//
+// reload state from the log in dir, if any.
+//
+func (px *Paxos) open(dir string) {
+  if dir != "" {
+    store, records, err := openStorage(dir, px.me)
+    if err != nil {
+      log.Fatal("paxos storage: ", err)
+    }
+    px.store = store
+    px.replay(records)
+  }
+}
+
+//
+// register with rpcs, or listen on our own socket if
+// rpcs is nil, and start the background threads.
+//
+func (px *Paxos) listen(rpcs *rpc.Server) {
+  me := px.me
+  px.mu.Lock()
+  addr := px.latestPeers()[me]
+  px.mu.Unlock()
 
   if rpcs != nil {
     // caller will create socket &c
@@ -364,11 +1009,10 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
   } else {
     rpcs = rpc.NewServer()
     rpcs.Register(px)
+    faults.Register(rpcs, px.tr)
 
     // prepare to receive connections from clients.
-    // change "unix" to "tcp" to use over a network.
-    os.Remove(peers[me]) // only needed for "unix"
-    l, e := net.Listen("unix", peers[me]);
+    l, e := transport.ListenRPC(px.tr, addr, rpcs);
     if e != nil {
       log.Fatal("listen error: ", e);
     }
@@ -382,23 +1026,9 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
       for px.dead == false {
         conn, err := px.l.Accept()
         if err == nil && px.dead == false {
-          if px.unreliable && (rand.Int63() % 1000) < 100 {
-            // discard the request.
-            conn.Close()
-          } else if px.unreliable && (rand.Int63() % 1000) < 200 {
-            // process the request but force discard of reply.
-            c1 := conn.(*net.UnixConn)
-            f, _ := c1.File()
-            err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-            if err != nil {
-              fmt.Printf("shutdown: %v\n", err)
-            }
-            px.rpcCount++
-            go rpcs.ServeConn(conn)
-          } else {
-            px.rpcCount++
-            go rpcs.ServeConn(conn)
-          }
+          go transport.ServeConn(rpcs, conn, func() {
+            atomic.AddInt32(&px.rpcCount, 1)
+          })
         } else if err == nil {
           conn.Close()
         }
@@ -410,5 +1040,8 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
   }
 
 
-  return px
+  px.clock.Go(px.catchupLoop)
+  if px.leaderMode {
+    px.clock.Go(px.heartbeat)
+  }
 }
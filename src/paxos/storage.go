@@ -0,0 +1,180 @@
+package paxos
+
+//
+// Write-ahead log for a Paxos peer's acceptor state.
+//
+// Every change that a peer promises to remember (a Prepare
+// promise, an accepted proposal, a decided value) is appended
+// to the log and fsync()ed before the RPC reply is sent. When
+// a peer restarts with the same directory, it replays the log
+// to rebuild its state before it accepts any RPCs.
+//
+// Each record is gob-encoded on its own and written with a
+// four-byte length prefix, so that a record torn by a crash
+// can be detected and dropped on replay.
+//
+
+import "os"
+import "io"
+import "bytes"
+import "encoding/gob"
+import "encoding/binary"
+import "path/filepath"
+import "fmt"
+
+const (
+  recPrepare = iota
+  recAccept
+  recDecide
+  recDone    // Seq is this peer's own Done() argument
+  recForget  // instances below Seq were forgotten by compaction
+  recPromiseAll // promised N for every instance >= Seq
+  recReconfig   // membership change Value was decided in Seq
+)
+
+// don't bother compacting logs shorter than this.
+const compactMin = 1000
+
+type record struct {
+  Kind int
+  Seq int
+  N int
+  Value interface{}
+}
+
+type storage struct {
+  f *os.File
+  path string
+  n int // records in the file
+}
+
+func logPath(dir string, me int) string {
+  return filepath.Join(dir, fmt.Sprintf("paxos-%d.log", me))
+}
+
+//
+// open (or create) the log for peer me in dir, and
+// return the records that are already in it.
+//
+func openStorage(dir string, me int) (*storage, []record, error) {
+  if err := os.MkdirAll(dir, 0777); err != nil {
+    return nil, nil, err
+  }
+  f, err := os.OpenFile(logPath(dir, me), os.O_RDWR|os.O_CREATE, 0666)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  records, good := readRecords(f)
+
+  // drop a partially written record at the tail, if any.
+  if err := f.Truncate(good); err != nil {
+    f.Close()
+    return nil, nil, err
+  }
+  if _, err := f.Seek(good, 0); err != nil {
+    f.Close()
+    return nil, nil, err
+  }
+
+  return &storage{f: f, path: logPath(dir, me), n: len(records)}, records, nil
+}
+
+//
+// read records until EOF or the first damaged one.
+// returns the records and the offset just past the
+// last complete record.
+//
+func readRecords(r io.Reader) ([]record, int64) {
+  records := []record{}
+  var good int64
+  var hdr [4]byte
+  for {
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+      break
+    }
+    buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+    if _, err := io.ReadFull(r, buf); err != nil {
+      break
+    }
+    var rec record
+    if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&rec); err != nil {
+      break
+    }
+    records = append(records, rec)
+    good += int64(len(hdr) + len(buf))
+  }
+  return records, good
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+    return nil, err
+  }
+  out := make([]byte, 4 + buf.Len())
+  binary.BigEndian.PutUint32(out, uint32(buf.Len()))
+  copy(out[4:], buf.Bytes())
+  return out, nil
+}
+
+//
+// append a record and force it to disk.
+//
+func (st *storage) append(rec record) error {
+  data, err := encodeRecord(rec)
+  if err != nil {
+    return err
+  }
+  if _, err := st.f.Write(data); err != nil {
+    return err
+  }
+  st.n++
+  return st.f.Sync()
+}
+
+//
+// atomically replace the log's contents with records.
+// the new log is written and synced under a temporary
+// name, then renamed over the old one.
+//
+func (st *storage) rewrite(records []record) error {
+  tmp := st.path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+  if err != nil {
+    return err
+  }
+  for _, rec := range records {
+    data, err := encodeRecord(rec)
+    if err == nil {
+      _, err = f.Write(data)
+    }
+    if err != nil {
+      f.Close()
+      os.Remove(tmp)
+      return err
+    }
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    os.Remove(tmp)
+    return err
+  }
+  if err := os.Rename(tmp, st.path); err != nil {
+    f.Close()
+    os.Remove(tmp)
+    return err
+  }
+  if d, err := os.Open(filepath.Dir(st.path)); err == nil {
+    d.Sync()
+    d.Close()
+  }
+  st.f.Close()
+  st.f = f
+  st.n = len(records)
+  return nil
+}
+
+func (st *storage) close() {
+  st.f.Close()
+}
@@ -7,6 +7,11 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "transport"
+import "sim"
+import "faults"
+import "sync"
+import "sync/atomic"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -19,6 +24,10 @@ func port(tag string, host int) string {
   return s
 }
 
+func storagedir(tag string, host int) string {
+  return port(tag, host) + "-wal"
+}
+
 func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
   count := 0
   var v interface{}
@@ -161,6 +170,83 @@ func TestBasic(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// peers with a storage directory must remember what they
+// promised, accepted and learned across a crash+restart.
+//
+func TestPersist(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("persist", i)
+    os.RemoveAll(storagedir("persist", i))
+    defer os.RemoveAll(storagedir("persist", i))
+  }
+  start := func(i int) {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Dir: storagedir("persist", i)})
+  }
+  for i := 0; i < npaxos; i++ {
+    start(i)
+  }
+
+  fmt.Printf("Test: Decisions survive restart ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[0].Start(seq, seq * 100)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  var before [5]interface{}
+  for seq := 0; seq < 5; seq++ {
+    _, before[seq] = pxa[0].Status(seq)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+    pxa[i] = nil
+  }
+  for i := 0; i < npaxos; i++ {
+    start(i)
+  }
+  for seq := 0; seq < 5; seq++ {
+    for i := 0; i < npaxos; i++ {
+      decided, v := pxa[i].Status(seq)
+      if decided == false || v != before[seq] {
+        t.Fatalf("peer %v lost seq %v after restart; decided=%v v=%v",
+          i, seq, decided, v)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restart in the middle of agreement ...\n")
+
+  for seq := 5; seq < 15; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 100) + i)
+    }
+    // crash and restart a peer while agreements are in flight.
+    i := seq % npaxos
+    pxa[i].Kill()
+    start(i)
+    pxa[i].Start(seq, (seq * 100) + i)
+  }
+  for seq := 5; seq < 15; seq++ {
+    // poke them, since a restarted peer may have missed a Decide.
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 100) + i)
+    }
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestDeaf(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
@@ -294,12 +380,13 @@ func TestManyForget(t *testing.T) {
   var pxh []string = make([]string, npaxos)
   defer cleanup(pxa)
   
+  in := faults.New(sim.Seed(t), nil)
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
   for i := 0; i < npaxos; i++ {
     pxh[i] = port("manygc", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
-    pxa[i].unreliable = true
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: in.Wrap(pxh[i], nil)})
   }
 
   fmt.Printf("Test: Lots of forgetting ...\n")
@@ -334,9 +421,7 @@ func TestManyForget(t *testing.T) {
 
   time.Sleep(5 * time.Second)
   done = true
-  for i := 0; i < npaxos; i++ {
-    pxa[i].unreliable = false
-  }
+  in.ClearRules()
   time.Sleep(2 * time.Second)
 
   for seq := 0; seq < maxseq; seq++ {
@@ -446,7 +531,7 @@ func TestRPCCount(t *testing.T) {
 
   total1 := 0
   for j := 0; j < npaxos; j++ {
-    total1 += pxa[j].rpcCount
+    total1 += int(atomic.LoadInt32(&pxa[j].rpcCount))
   }
 
   // per agreement:
@@ -472,7 +557,7 @@ func TestRPCCount(t *testing.T) {
 
   total2 := 0
   for j := 0; j < npaxos; j++ {
-    total2 += pxa[j].rpcCount
+    total2 += int(atomic.LoadInt32(&pxa[j].rpcCount))
   }
   total2 -= total1
 
@@ -489,6 +574,313 @@ func TestRPCCount(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+func TestNotify(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("notify", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: WaitDecided ...\n")
+
+  decided, _ := pxa[1].WaitDecided(0, 100 * time.Millisecond)
+  if decided {
+    t.Fatalf("WaitDecided() reported an instance nobody started")
+  }
+
+  t0 := time.Now()
+  pxa[0].Start(0, "hello")
+  decided, v := pxa[1].WaitDecided(0, 5 * time.Second)
+  if decided == false || v != "hello" {
+    t.Fatalf("WaitDecided() got %v %v", decided, v)
+  }
+  if time.Since(t0) > time.Second {
+    t.Fatalf("WaitDecided() took %v", time.Since(t0))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Subscribe delivers in order ...\n")
+
+  ch := pxa[2].Subscribe(0)
+  for seq := 5; seq >= 1; seq-- {
+    pxa[seq % npaxos].Start(seq, seq * 10)
+  }
+  for seq := 0; seq <= 5; seq++ {
+    select {
+    case a := <-ch:
+      if a.Seq != seq || a.Decided == false {
+        t.Fatalf("Subscribe() delivered %v, expected seq %v", a, seq)
+      }
+      if seq > 0 && a.Value != seq * 10 {
+        t.Fatalf("Subscribe() delivered value %v for seq %v", a.Value, seq)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("Subscribe() did not deliver seq %v", seq)
+    }
+  }
+
+  pxa[2].Kill()
+  for _ = range ch {
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("batch", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: StartBatch ...\n")
+
+  // ndecided() can't compare batches, so wait on each peer.
+  pxa[0].StartBatch(0, []interface{}{"a", "b", "c"})
+  for i := 0; i < npaxos; i++ {
+    pxa[i].WaitDecided(0, 10 * time.Second)
+    decided, vs := pxa[i].Entries(0)
+    if decided == false || len(vs) != 3 || vs[0] != "a" || vs[1] != "b" || vs[2] != "c" {
+      t.Fatalf("peer %v: wrong entries %v %v", i, decided, vs)
+    }
+  }
+
+  pxa[1].Start(1, "d")
+  waitn(t, pxa, 1, npaxos)
+  decided, vs := pxa[2].Entries(1)
+  if decided == false || len(vs) != 1 || vs[0] != "d" {
+    t.Fatalf("wrong entries for a plain instance %v %v", decided, vs)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Batcher ...\n")
+
+  const nvalues = 30
+  var ba [npaxos]*Batcher
+  for i := 0; i < npaxos; i++ {
+    ba[i] = pxa[i].NewBatcher(50 * time.Millisecond, 8)
+  }
+  var ca [nvalues]<-chan Entry
+  for v := 0; v < nvalues; v++ {
+    ca[v] = ba[v % npaxos].Submit(v)
+  }
+
+  instances := map[int]bool{}
+  for v := 0; v < nvalues; v++ {
+    var e Entry
+    select {
+    case e = <-ca[v]:
+    case <-time.After(10 * time.Second):
+      t.Fatalf("value %v never decided", v)
+    }
+    instances[e.Seq] = true
+    for i := 0; i < npaxos; i++ {
+      pxa[i].WaitDecided(e.Seq, 10 * time.Second)
+      _, vs := pxa[i].Entries(e.Seq)
+      if e.Index >= len(vs) || vs[e.Index] != v {
+        t.Fatalf("peer %v: entry %v does not hold %v", i, e, v)
+      }
+    }
+  }
+  if len(instances) >= nvalues {
+    t.Fatalf("%v values used %v instances", nvalues, len(instances))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Batcher without a limit ...\n")
+
+  nb := pxa[0].NewBatcher(50 * time.Millisecond, 0)
+  ca0 := nb.Submit("x")
+  ca1 := nb.Submit("y")
+  for _, ch := range []<-chan Entry{ca0, ca1} {
+    select {
+    case e := <-ch:
+      if _, vs := pxa[0].Entries(e.Seq); len(vs) != 2 {
+        t.Fatalf("unlimited batch held %v", vs)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("unlimited batch never decided")
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Batcher of a killed peer ...\n")
+
+  kb := pxa[npaxos - 1].NewBatcher(time.Hour, 0)
+  ck := kb.Submit("z")
+  pxa[npaxos - 1].Kill()
+  for _, ch := range []<-chan Entry{ck, kb.Submit("after")} {
+    select {
+    case e, ok := <-ch:
+      if ok {
+        t.Fatalf("killed peer's Batcher delivered %v", e)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("killed peer's Batcher left a channel open")
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// in leader mode, a stable leader should only need
+// Accept and Decide for each instance.
+//
+func TestLeader(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leader", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Leader: true})
+  }
+
+  fmt.Printf("Test: Leader skips phase 1 ...\n")
+
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+
+  total0 := 0
+  for j := 0; j < npaxos; j++ {
+    total0 += int(atomic.LoadInt32(&pxa[j].rpcCount))
+  }
+  t0 := time.Now()
+
+  const ninst = 10
+  for seq := 1; seq <= ninst; seq++ {
+    pxa[0].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  total1 := -total0
+  for j := 0; j < npaxos; j++ {
+    total1 += int(atomic.LoadInt32(&pxa[j].rpcCount))
+  }
+
+  // per agreement, 2 accepts and 2 decides to the
+  // other peers, plus the leader's heartbeats.
+  beats := (int(time.Since(t0) / HeartbeatInterval) + 2) * (npaxos - 1)
+  expected := ninst * (npaxos - 1) * 2 + beats
+  if total1 > expected {
+    t.Fatalf("too many RPCs for a stable leader; got %v, expected %v",
+      total1, expected)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Followers use the leader ...\n")
+
+  for seq := ninst + 1; seq <= 2 * ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 10) + i)
+    }
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: New leader after leader dies ...\n")
+
+  pxa[0].Kill()
+  for seq := 2 * ninst + 1; seq <= 3 * ninst; seq++ {
+    pxa[1 + (seq % 2)].Start(seq, seq)
+    waitmajority(t, pxa, seq)
+  }
+  if pxa[1].liveLeader() < 1 && pxa[2].liveLeader() < 1 {
+    t.Fatalf("no new leader")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// every peer keeps Start()ing its own value for instances
+// the leader has already decided; a late peer that runs
+// the instance itself must still learn the first value.
+//
+func TestLeaderOneValue(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leaderone", i)
+  }
+  // peer 3 starts late; the others are a majority.
+  for i := 0; i < npaxos - 1; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Leader: true})
+  }
+
+  fmt.Printf("Test: Leader decides one value per instance ...\n")
+
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos - 1)
+
+  const ninst = 5
+  for seq := 1; seq <= ninst; seq++ {
+    for try := 0; try < 4; try++ {
+      for i := 0; i < npaxos - 1; i++ {
+        pxa[i].Start(seq, (seq * 100) + (try * 10) + i)
+      }
+      time.Sleep(50 * time.Millisecond)
+    }
+    waitn(t, pxa, seq, npaxos - 1)
+  }
+
+  // no acceptor may hold a different value under a
+  // higher or equal number than the decided one's.
+  for seq := 1; seq <= ninst; seq++ {
+    _, v := pxa[0].Status(seq)
+    for i := 0; i < npaxos - 1; i++ {
+      pxa[i].mu.Lock()
+      inst := pxa[i].instances[seq]
+      if inst.na >= 0 && inst.va != v {
+        pxa[i].mu.Unlock()
+        t.Fatalf("peer %v accepted %v in %v, but %v was decided", i, inst.va, seq, v)
+      }
+      pxa[i].mu.Unlock()
+    }
+  }
+
+  pxa[npaxos - 1] = MakeWithOptions(pxh, npaxos - 1, nil, Options{Leader: true})
+  for seq := 1; seq <= ninst; seq++ {
+    pxa[npaxos - 1].Start(seq, "late")
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements (without failures)
 //
@@ -577,61 +969,154 @@ func TestOld(t *testing.T) {
 }
 
 //
-// many agreements, with unreliable RPC
+// proposers on different instances must not get in each
+// other's way; proposers on the same instance must go to
+// higher ballots until one of them wins.
 //
-func TestManyUnreliable(t *testing.T) {
+func TestBallots(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
-  fmt.Printf("Test: Many instances, unreliable RPC ...\n")
-
-  const npaxos = 3
+  const npaxos = 5
   var pxa []*Paxos = make([]*Paxos, npaxos)
   var pxh []string = make([]string, npaxos)
   defer cleanup(pxa)
 
   for i := 0; i < npaxos; i++ {
-    pxh[i] = port("manyun", i)
+    pxh[i] = port("ballots", i)
   }
   for i := 0; i < npaxos; i++ {
     pxa[i] = Make(pxh, i, nil)
-    pxa[i].unreliable = true
-    pxa[i].Start(0, 0)
   }
 
-  const ninst = 50
-  for seq := 1; seq < ninst; seq++ {
-    // only 3 active instances, to limit the
-    // number of file descriptors.
-    for seq >= 3 && ndecided(t, pxa, seq - 3) < npaxos {
-      time.Sleep(20 * time.Millisecond)
+  fmt.Printf("Test: Concurrent proposers, different instances ...\n")
+
+  const ninst = 20
+  for seq := 0; seq < ninst; seq++ {
+    go pxa[seq % npaxos].Start(seq, seq * 10)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+    if _, v := pxa[0].Status(seq); v != seq * 10 {
+      t.Fatalf("seq %v decided %v, expected %v", seq, v, seq * 10)
     }
+    // the only proposer must have won with its first ballot.
     for i := 0; i < npaxos; i++ {
-      pxa[i].Start(seq, (seq * 10) + i)
+      pxa[i].mu.Lock()
+      na := pxa[i].instances[seq].na
+      pxa[i].mu.Unlock()
+      if na >= 0 && round(na) != 0 {
+        t.Fatalf("seq %v accepted in round %v at peer %v", seq, round(na), i)
+      }
     }
   }
 
-  for {
-    done := true
-    for seq := 1; seq < ninst; seq++ {
-      if ndecided(t, pxa, seq) < npaxos {
-        done = false
-      }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent proposers, one instance ...\n")
+
+  const nsame = 10
+  for seq := ninst; seq < ninst + nsame; seq++ {
+    for i := 0; i < npaxos; i++ {
+      go pxa[i].Start(seq, (seq * 10) + i)
     }
-    if done {
-      break
+  }
+  for seq := ninst; seq < ninst + nsame; seq++ {
+    waitn(t, pxa, seq, npaxos)
+    _, v := pxa[0].Status(seq)
+    if x, ok := v.(int); !ok || x / 10 != seq {
+      t.Fatalf("seq %v decided %v, which nobody proposed", seq, v)
     }
-    time.Sleep(100 * time.Millisecond)
   }
-  
+
   fmt.Printf("  ... Passed\n")
-}
 
-func pp(tag string, src int, dst int) string {
-  s := "/var/tmp/824-"
-  s += strconv.Itoa(os.Getuid()) + "/"
-  s += "px-" + tag + "-"
-  s += strconv.Itoa(os.Getpid()) + "-"
-  s += strconv.Itoa(src) + "-"
+  fmt.Printf("Test: Rejected proposer retries with a higher ballot ...\n")
+
+  // a majority has promised a high ballot to a proposer
+  // that then went away.
+  seq := ninst + nsame
+  gone := (5 * maxPeers) + npaxos - 1
+  for i := 0; i < 3; i++ {
+    var reply PrepareReply
+    pxa[i].Prepare(&PrepareArgs{Seq: seq, N: gone, Me: npaxos - 1, Done: -1}, &reply)
+    if reply.OK == false {
+      t.Fatalf("peer %v rejected the first Prepare", i)
+    }
+  }
+  pxa[0].Start(seq, "retried")
+  waitn(t, pxa, seq, npaxos)
+  if _, v := pxa[0].Status(seq); v != "retried" {
+    t.Fatalf("decided %v, expected retried", v)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].mu.Lock()
+    na := pxa[i].instances[seq].na
+    pxa[i].mu.Unlock()
+    if na >= 0 && na <= gone {
+      t.Fatalf("peer %v accepted ballot %v, not above the promised %v", i, na, gone)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// many agreements, with unreliable RPC
+//
+func TestManyUnreliable(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Many instances, unreliable RPC ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  in := faults.New(sim.Seed(t), nil)
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("manyun", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: in.Wrap(pxh[i], nil)})
+    pxa[i].Start(0, 0)
+  }
+
+  const ninst = 50
+  for seq := 1; seq < ninst; seq++ {
+    // only 3 active instances, to limit the
+    // number of file descriptors.
+    for seq >= 3 && ndecided(t, pxa, seq - 3) < npaxos {
+      time.Sleep(20 * time.Millisecond)
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 10) + i)
+    }
+  }
+
+  for {
+    done := true
+    for seq := 1; seq < ninst; seq++ {
+      if ndecided(t, pxa, seq) < npaxos {
+        done = false
+      }
+    }
+    if done {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  
+  fmt.Printf("  ... Passed\n")
+}
+
+func pp(tag string, src int, dst int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  s += "px-" + tag + "-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += strconv.Itoa(src) + "-"
   s += strconv.Itoa(dst)
   return s
 }
@@ -676,6 +1161,7 @@ func TestPartition(t *testing.T) {
   defer cleanup(pxa)
   defer cleanpp(tag, npaxos)
 
+  in := faults.New(sim.Seed(t), nil)
   for i := 0; i < npaxos; i++ {
     var pxh []string = make([]string, npaxos)
     for j := 0; j < npaxos; j++ {
@@ -685,7 +1171,7 @@ func TestPartition(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: in.Wrap(pxh[i], nil)})
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -742,9 +1228,7 @@ func TestPartition(t *testing.T) {
   for iters := 0; iters < 20; iters++ {
     seq++
 
-    for i := 0; i < npaxos; i++ {
-      pxa[i].unreliable = true
-    }
+    in.SetRule(faults.Any, faults.Any, faults.Unreliable)
 
     part(t, tag, npaxos, []int{0,1,2}, []int{3,4}, []int{})
     for i := 0; i < npaxos; i++ {
@@ -757,11 +1241,575 @@ func TestPartition(t *testing.T) {
     
     part(t, tag, npaxos, []int{0,1}, []int{2,3,4}, []int{})
 
+    in.ClearRules()
+
+    waitn(t, pxa, seq, 5)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a peer that missed decisions while partitioned away
+// should learn them without anyone re-proposing.
+//
+func TestCatchUp(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "catchup"
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  defer cleanup(pxa)
+  defer cleanpp(tag, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    var pxh []string = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[j] = port(tag, i)
+      } else {
+        pxh[j] = pp(tag, i, j)
+      }
+    }
+    pxa[i] = Make(pxh, i, nil)
+  }
+  defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: Lagging peer catches up on demand ...\n")
+
+  part(t, tag, npaxos, []int{0,1}, []int{2}, []int{})
+  const ninst = 20
+  for seq := 0; seq < ninst; seq++ {
+    pxa[seq % 2].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 2)
+  }
+  if ndecided(t, pxa, 0) != 2 {
+    t.Fatalf("partitioned peer heard about a decision")
+  }
+
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+  if n := pxa[2].CatchUp(); n != ninst {
+    t.Fatalf("CatchUp() learned %v instances, expected %v", n, ninst)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    if ndecided(t, pxa, seq) != npaxos {
+      t.Fatalf("seq %v not decided everywhere after CatchUp()", seq)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lagging peer catches up in the background ...\n")
+
+  part(t, tag, npaxos, []int{0,1}, []int{2}, []int{})
+  for seq := ninst; seq < 2 * ninst; seq++ {
+    pxa[seq % 2].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 2)
+  }
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+
+  // peer 2 only knows of the newer instances once it
+  // hears from another peer.
+  pxa[0].Start(2 * ninst, "x")
+  for seq := ninst; seq <= 2 * ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMembership(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "membership"
+  const npaxos = 3
+  const alpha = 5
+  var pxh []string = make([]string, npaxos)
+  var pxa []*Paxos = make([]*Paxos, npaxos + 1)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port(tag, i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Alpha: alpha})
+  }
+
+  seq := 0
+  decide := func(n int, wanted int) {
+    for i := 0; i < n; i++ {
+      pxa[0].Start(seq, seq * 100)
+      waitn(t, pxa, seq, wanted)
+      seq++
+    }
+  }
+
+  fmt.Printf("Test: Fixed membership refuses changes ...\n")
+
+  px := Make([]string{port(tag, 9)}, 0, nil)
+  if _, _, err := px.AddPeer(port(tag, 10)); err == nil {
+    t.Fatalf("AddPeer() succeeded without Options.Alpha")
+  }
+  px.Kill()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Remove a dead peer ...\n")
+
+  decide(alpha, npaxos)
+  pxa[2].Kill()
+  pxa[2] = nil
+
+  start, err := pxa[0].RemovePeer(2)
+  if err != nil {
+    t.Fatalf("RemovePeer(): %v", err)
+  }
+  seq = pxa[0].Max() + 1
+  decide(start + alpha - seq, 2)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Add a new peer ...\n")
+
+  me, start, err := pxa[0].AddPeer(port(tag, 3))
+  if err != nil {
+    t.Fatalf("AddPeer(): %v", err)
+  }
+  if me != 3 {
+    t.Fatalf("AddPeer() gave index %v, expected 3", me)
+  }
+  pxa[3] = MakeJoin(pxa[0].Membership(), me, nil, Options{})
+  seq = pxa[0].Max() + 1
+  if seq < start {
+    decide(start - seq, 2)
+  }
+  decide(alpha, 3)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: New peer forms a majority ...\n")
+
+  pxa[1].Kill()
+  pxa[1] = nil
+  decide(alpha, 2)
+  if d, _ := pxa[3].Status(seq - 1); d == false {
+    t.Fatalf("new peer did not decide")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// clients keep proposing on two peers while the third
+// dies for good, is removed, and is replaced by a new
+// peer that has to start from the group's snapshot.
+//
+func TestReplaceUnderLoad(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "replace"
+  const npaxos = 3
+  const alpha = 5
+  var pxh []string = make([]string, npaxos)
+  var pxa []*Paxos = make([]*Paxos, npaxos + 1)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port(tag, i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Alpha: alpha})
+  }
+
+  // two clients on each of peers 0 and 1 put values in the
+  // next free instance, and are Done() with older ones.
+  var placed [2]int32
+  var stop [2]int32
+  var wg [2]sync.WaitGroup
+  for i := 0; i < 2; i++ {
+    for c := 0; c < 2; c++ {
+      wg[i].Add(1)
+      go func(i int, c int, px *Paxos) {
+        defer wg[i].Done()
+        for k := 0; atomic.LoadInt32(&stop[i]) == 0; k++ {
+          v := fmt.Sprintf("%v-%v-%v", i, c, k)
+          seq := px.place(v, func(got interface{}) bool { return got == v })
+          if seq < 0 {
+            return
+          }
+          atomic.AddInt32(&placed[i], 1)
+          if seq > 10 {
+            px.Done(seq - 10)
+          }
+        }
+      }(i, c, pxa[i])
+    }
+  }
+  defer func() {
+    atomic.StoreInt32(&stop[0], 1)
+    atomic.StoreInt32(&stop[1], 1)
+  }()
+
+  progress := func(i int, n int32) {
+    target := atomic.LoadInt32(&placed[i]) + n
+    for iters := 0; atomic.LoadInt32(&placed[i]) < target; iters++ {
+      if iters > 100 {
+        t.Fatalf("clients on peer %v stopped making progress", i)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  // every live peer that has decided seq agrees, and the
+  // one we care about has decided it.
+  learned := func(seq int, i int) {
+    for iters := 0; ; iters++ {
+      ndecided(t, pxa, seq)
+      if d, _ := pxa[i].Status(seq); d {
+        return
+      }
+      if iters > 100 {
+        t.Fatalf("peer %v never decided %v", i, seq)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  fmt.Printf("Test: Replace a peer under load ...\n")
+
+  progress(0, 20)
+  start, err := pxa[0].RemovePeer(2)
+  if err != nil {
+    t.Fatalf("RemovePeer(): %v", err)
+  }
+  // peer 2 takes part in every instance before start, so
+  // the others mustn't forget them until it is Done().
+  learned(start - 1, 2)
+  progress(0, 20)
+  if m := pxa[0].Min(); m != 0 {
+    t.Fatalf("Min() %v passed instances a removed peer still needs", m)
+  }
+  pxa[2].Done(start - 1)
+  for iters := 0; pxa[0].Min() <= start; iters++ {
+    if iters > 100 {
+      t.Fatalf("Min() stuck at %v after removing a peer", pxa[0].Min())
+    }
+    pxa[2].CatchUp() // tells the others it is done
+    time.Sleep(100 * time.Millisecond)
+  }
+  pxa[2].Kill()
+  pxa[2] = nil
+  progress(0, 20)
+
+  me, start, err := pxa[0].AddPeer(port(tag, 3))
+  if err != nil {
+    t.Fatalf("AddPeer(): %v", err)
+  }
+  m := pxa[0].Membership()
+  if m.Seq == 0 {
+    t.Fatalf("nothing forgotten; the new peer would not need a snapshot")
+  }
+  pxa[3] = MakeJoin(m, me, nil, Options{})
+  progress(0, 20)
+  progress(1, 20)
+  learned(pxa[0].Max(), 3)
+  if d, _ := pxa[3].Status(m.Seq - 1); d {
+    t.Fatalf("new peer knows an instance before its snapshot")
+  }
+
+  // the new peer and peer 0 are now a majority.
+  atomic.StoreInt32(&stop[1], 1)
+  wg[1].Wait()
+  pxa[1].Kill()
+  pxa[1] = nil
+  progress(0, 20)
+  learned(pxa[0].Max() - 1, 3)
+
+  atomic.StoreInt32(&stop[0], 1)
+  wg[0].Wait()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMemTransport(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  mem := transport.NewMem()
+  pool := transport.NewPool(mem, time.Second, 0)
+  defer pool.Close()
+
+  trs := []struct {
+    name string
+    tr transport.Transport
+  }{
+    {"an in-memory transport", mem},
+    {"pooled connections", pool},
+  }
+
+  for k, x := range trs {
+    fmt.Printf("Test: Unreliable agreement over %v ...\n", x.name)
+
+    in := faults.New(sim.Seed(t), nil)
+    in.SetRule(faults.Any, faults.Any, faults.Unreliable)
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
     for i := 0; i < npaxos; i++ {
-      pxa[i].unreliable = false
+      pxh[i] = "px-" + strconv.Itoa(k) + "-" + strconv.Itoa(i)
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: in.Wrap(pxh[i], x.tr)})
     }
 
-    waitn(t, pxa, seq, 5)
+    const ninst = 20
+    for seq := 0; seq < ninst; seq++ {
+      for i := 0; i < npaxos; i++ {
+        pxa[i].Start(seq, seq * 10 + i)
+      }
+    }
+    in.ClearRules()
+    for seq := 0; seq < ninst; seq++ {
+      waitn(t, pxa, seq, npaxos)
+    }
+    cleanup(pxa)
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+//
+// a transport whose calls to one address hang for a while.
+//
+type slowTransport struct {
+  *transport.Mem
+  slow string
+}
+
+func (st slowTransport) Call(addr string, name string,
+                             args interface{}, reply interface{}) error {
+  if addr == st.slow {
+    time.Sleep(3 * time.Second)
+  }
+  return st.Mem.Call(addr, name, args, reply)
+}
+
+func TestSlowPeer(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  mem := transport.NewMem()
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = "slow-" + strconv.Itoa(i)
+  }
+  st := slowTransport{mem, pxh[2]}
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: st})
+  }
+
+  fmt.Printf("Test: A slow peer does not hold up agreement ...\n")
+
+  t0 := time.Now()
+  const ninst = 5
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq)
+    if decided, _ := pxa[0].WaitDecided(seq, 2 * time.Second); !decided {
+      t.Fatalf("no agreement on %v", seq)
+    }
+  }
+  if d := time.Since(t0); d > time.Second {
+    t.Fatalf("agreement took %v; waited for the slow peer?", d)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 5
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0.1)
+
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = "sim-" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: s.Node(pxh[i])})
+  }
+
+  fmt.Printf("Test: Simulated lossy network, changing partitions ...\n")
+
+  // partitions change every virtual second, drawn from
+  // the same seed as the network.
+  rr := sim.RandOf(s.Node("test"))
+  const ninst = 30
+  for seq := 0; seq < ninst; seq++ {
+    if seq % 5 == 0 {
+      var pa [3][]string
+      for i := 0; i < npaxos; i++ {
+        k := rr.Intn(3)
+        pa[k] = append(pa[k], pxh[i])
+      }
+      s.Partition(pa[0], pa[1], pa[2])
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, seq * 10 + i)
+    }
+    s.Sleep(200 * time.Millisecond)
+  }
+
+  s.Partition()
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0)
+  for seq := 0; seq < ninst; seq++ {
+    pxa[seq % npaxos].WaitDecided(seq, time.Minute)
+  }
+  s.Sleep(10 * time.Second)
+  for seq := 0; seq < ninst; seq++ {
+    if nd := ndecided(t, pxa, seq); nd != npaxos {
+      t.Fatalf("seq %v decided at %v peers, expected %v", seq, nd, npaxos)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestAsymmetric(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+  in := faults.New(s.Now().UnixNano(), s)
+
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = "asym-" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    tr := in.Wrap(pxh[i], s.Node(pxh[i]))
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: tr})
+  }
+
+  fmt.Printf("Test: Peer that can hear but not speak ...\n")
+
+  in.Block(pxh[0], pxh[1])
+  in.Block(pxh[0], pxh[2])
+  pxa[0].Start(0, "mute")
+  pxa[1].Start(0, "one")
+  if decided, v := pxa[0].WaitDecided(0, time.Minute); !decided || v != "one" {
+    t.Fatalf("muted peer did not learn the decision")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Peer that can speak but not hear ...\n")
+
+  in.Partition()
+  in.Block(pxh[1], pxh[0])
+  in.Block(pxh[2], pxh[0])
+  pxa[0].Start(1, "deaf")
+  s.Sleep(10 * time.Second)
+  if decided, _ := pxa[0].Status(1); decided {
+    t.Fatalf("deaf peer decided")
+  }
+  pxa[1].Start(1, "one")
+  if decided, _ := pxa[1].WaitDecided(1, time.Minute); !decided {
+    t.Fatalf("majority did not decide around a deaf peer")
+  }
+
+  in.Heal()
+  if decided, _ := pxa[0].WaitDecided(1, time.Minute); !decided {
+    t.Fatalf("deaf peer did not catch up after healing")
+  }
+  ndecided(t, pxa, 1)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lossy, duplicating, reordering links ...\n")
+
+  in.SetRule(faults.Any, faults.Any, faults.Rule{Drop: 0.2, DropReply: 0.2,
+                                                Delay: time.Millisecond,
+                                                Jitter: 10 * time.Millisecond,
+                                                Reorder: 0.2, Duplicate: 0.2})
+  const ninst = 20
+  for seq := 2; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, seq * 10 + i)
+    }
+  }
+  for seq := 2; seq < ninst; seq++ {
+    pxa[seq % npaxos].WaitDecided(seq, time.Minute)
+  }
+  in.ClearRules()
+  for seq := 2; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].WaitDecided(seq, time.Minute)
+    }
+    if nd := ndecided(t, pxa, seq); nd != npaxos {
+      t.Fatalf("seq %v decided at %v peers", seq, nd)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestReplay(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Same seed, same run ...\n")
+
+  // what was decided, and when, in a run on a lossy
+  // network with every peer proposing at once.
+  run := func(seed int64) string {
+    const npaxos = 3
+    s := sim.New(seed)
+    defer s.Stop()
+    s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0.2)
+
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+    for i := 0; i < npaxos; i++ {
+      pxh[i] = "replay-" + strconv.Itoa(i)
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: s.Node(pxh[i])})
+    }
+
+    out := ""
+    for seq := 0; seq < 10; seq++ {
+      for i := 0; i < npaxos; i++ {
+        pxa[i].Start(seq, seq * 10 + i)
+      }
+      decided, v := pxa[seq % npaxos].WaitDecided(seq, time.Minute)
+      out += fmt.Sprintf("%v: %v %v at %v\n", seq, decided, v,
+                         s.Now().Sub(sim.Epoch))
+    }
+    return out
+  }
+
+  seed := sim.Seed(t)
+  r1 := run(seed)
+  r2 := run(seed)
+  r3 := run(seed + 1)
+  if r1 != r2 {
+    t.Fatalf("same seed, different runs:\n%v\n%v", r1, r2)
+  }
+  if r1 == r3 {
+    t.Fatalf("different seeds gave the same run")
   }
 
   fmt.Printf("  ... Passed\n")
@@ -778,6 +1826,8 @@ func TestLots(t *testing.T) {
   defer cleanup(pxa)
   defer cleanpp(tag, npaxos)
 
+  in := faults.New(sim.Seed(t), nil)
+  in.SetRule(faults.Any, faults.Any, faults.Unreliable)
   for i := 0; i < npaxos; i++ {
     var pxh []string = make([]string, npaxos)
     for j := 0; j < npaxos; j++ {
@@ -787,8 +1837,7 @@ func TestLots(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
-    pxa[i].unreliable = true
+    pxa[i] = MakeWithOptions(pxh, i, nil, Options{Transport: in.Wrap(pxh[i], nil)})
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -860,9 +1909,7 @@ func TestLots(t *testing.T) {
   <- ch3
 
   // repair, then check that all instances decided.
-  for i := 0; i < npaxos; i++ {
-    pxa[i].unreliable = false
-  }
+  in.ClearRules()
   part(t, tag, npaxos, []int{0,1,2,3,4}, []int{}, []int{})
   time.Sleep(5 * time.Second)
 
@@ -1,17 +1,32 @@
 package pbservice
 
 import "viewservice"
-import "net/rpc"
-import "time"
+import "transport"
+import "sim"
 
 
 type Clerk struct {
+  mu sim.Mutex // one request at a time
   vs *viewservice.Clerk
+  tr transport.Transport
+  clock sim.Clock
+  me int64 // unique id, so servers can spot retries
+  seq int // number of the latest Put
 }
 
 func MakeClerk(vshost string, me string) *Clerk {
+  return MakeClerkOn(nil, vshost, me)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, vshost string, me string) *Clerk {
   ck := new(Clerk)
-  ck.vs = viewservice.MakeClerk(me, vshost)
+  ck.tr = tr
+  ck.clock = sim.ClockOf(tr)
+  ck.vs = viewservice.MakeClerkOn(tr, me, vshost)
+  ck.me = sim.RandOf(tr).Int63()
   return ck
 }
 
@@ -29,22 +44,14 @@ func MakeClerk(vshost string, me string) *Clerk {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
 }
 
 //
@@ -59,12 +66,12 @@ func (ck *Clerk) Get(key string) string {
   reply := GetReply{}
   args := GetArgs{ Key : key }
   var primary string = ck.vs.Primary()
-  ok := call(primary, "PBServer.Get", args, &reply)
+  ok := call(ck.tr, primary, "PBServer.Get", args, &reply)
 
   for ok == false || primary == "" || reply.Err == ErrWrongServer {
-    time.Sleep(viewservice.PingInterval)
+    ck.clock.Sleep(viewservice.PingInterval)
     primary = ck.vs.Primary()
-    ok = call(primary, "PBServer.Get", args, &reply)
+    ok = call(ck.tr, primary, "PBServer.Get", args, &reply)
   }
 
   if reply.Err == ErrNoKey {
@@ -75,21 +82,68 @@ func (ck *Clerk) Get(key string) string {
 }
 
 //
-// tell the primary to update key's value.
-// must keep trying until it succeeds.
+// send a Put (or a PutHash, Append, &c) to the
+// primary until it succeeds.
 //
-func (ck *Clerk) Put(key string, value string) {
+func (ck *Clerk) put(args PutArgs) PutReply {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+  args.Client = ck.me
+  args.Seq = ck.seq
 
-  args := PutArgs{ Key : key, Value : value }
   reply := PutReply{}
   var primary string = ck.vs.Primary()
-  ok := call(primary, "PBServer.Put", args, &reply)
+  ok := call(ck.tr, primary, "PBServer.Put", args, &reply)
 
   for ok == false || primary == "" || reply.Err != OK {
-    time.Sleep(viewservice.PingInterval)
+    ck.clock.Sleep(viewservice.PingInterval)
     primary = ck.vs.Primary()
-    ok = call(primary, "PBServer.Put", args, &reply)
+    ok = call(ck.tr, primary, "PBServer.Put", args, &reply)
   }
 
-  return
+  return reply
+}
+
+//
+// tell the primary to update key's value.
+// must keep trying until it succeeds.
+//
+func (ck *Clerk) Put(key string, value string) {
+  ck.put(PutArgs{Key: key, Value: value})
+}
+
+//
+// set the value for a key to hash(previous value + value),
+// and return the previous value.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+  return ck.put(PutArgs{Key: key, Value: value, DoHash: true}).PreviousValue
+}
+
+//
+// append arg to a key's value, and return the
+// length of the result.
+//
+func (ck *Clerk) Append(key string, arg string) int {
+  return ck.put(PutArgs{Key: key, Value: arg, DoAppend: true}).Length
+}
+
+//
+// set a key's value to update if its value is now
+// expected (a key that does not exist counts as "").
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) CompareAndSwap(key string, expected string, update string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: update, DoCAS: true, Expected: expected})
+  return reply.Stored, reply.PreviousValue
+}
+
+//
+// set a key's value only if the key does not exist.
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: value, DoIfAbsent: true})
+  return reply.Stored, reply.PreviousValue
 }
@@ -1,19 +1,32 @@
 package pbservice
 
+import "hash/fnv"
+
 const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
   ErrWrongServer = "ErrWrongServer"
+  ErrBackupFailed = "ErrBackupFailed"
 )
 type Err string
 
 type PutArgs struct {
   Key string
   Value string
+  DoHash bool // store hash(previous value + Value)
+  DoAppend bool // store previous value + Value
+  DoCAS bool // store Value only if the current value is Expected
+  Expected string
+  DoIfAbsent bool // store Value only if the key does not exist
+  Client int64 // the Clerk's unique id
+  Seq int // the Clerk's request number; retries reuse it
 }
 
 type PutReply struct {
   Err Err
+  PreviousValue string // for DoHash, DoCAS and DoIfAbsent
+  Length int // of the new value, for DoAppend
+  Stored bool // for DoCAS and DoIfAbsent
 }
 
 type GetArgs struct {
@@ -27,9 +40,24 @@ type GetReply struct {
 
 
 // Your RPC definitions here.
+
+//
+// the result of a client's latest Put, kept so that
+// a retry gets it again instead of re-executing.
+//
+type Dup struct {
+  Seq int
+  PreviousValue string
+  Length int
+  Stored bool
+}
+
 type ForwardArgs struct {
   Key string
-  Value string
+  Value string // the new value, after any hashing or appending
+  KeepValue bool // a conditional put failed; just record Dup
+  Client int64
+  Dup Dup
 }
 
 type ForwardReply struct {
@@ -39,8 +67,15 @@ type ForwardReply struct {
 
 type BackupArgs struct {
   Values map[string]string
+  Dups map[int64]Dup
 }
 
 type BackupReply struct {
   Err Err
 }
+
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
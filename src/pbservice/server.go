@@ -3,25 +3,26 @@ package pbservice
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
+import "faults"
+import "sim"
 import "log"
-import "time"
 import "viewservice"
-import "sync"
-import "os"
-import "syscall"
-import "math/rand"
+import "strconv"
 
 
 type PBServer struct {
-  mu sync.Mutex
+  mu sim.Mutex
   l net.Listener
   dead bool // for testing
-  unreliable bool // for testing
   me string
   vs *viewservice.Clerk
+  tr transport.Transport
+  clock sim.Clock
   // Your declarations here.
   view viewservice.View
   values map[string]string
+  dups map[int64]Dup // by client
 }
 
 func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
@@ -58,28 +59,90 @@ func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
     return nil
   }
 
-  log.Printf("[PbService] Set %s: %s", args.Key, args.Value)
-  pb.values[args.Key] = args.Value
+  d, present := pb.dups[args.Client]
+  if !present || d.Seq < args.Seq {
+    prev, exists := pb.values[args.Key]
+    value := args.Value
+    store := true
+    d = Dup{ Seq : args.Seq }
+    if args.DoHash {
+      d.PreviousValue = prev
+      value = strconv.Itoa(int(hash(prev + value)))
+    } else if args.DoAppend {
+      value = prev + value
+      d.Length = len(value)
+    } else if args.DoCAS {
+      d.PreviousValue = prev
+      store = prev == args.Expected
+      d.Stored = store
+    } else if args.DoIfAbsent {
+      d.PreviousValue = prev
+      store = !exists
+      d.Stored = store
+    }
+
+    // Forward to the backup first; if it does not have the
+    // update, a retry must not find it done here either.
+    if pb.forward(ForwardArgs{ Key : args.Key, Value : value, KeepValue : !store,
+                               Client : args.Client, Dup : d }) == false {
+      reply.Err = ErrBackupFailed
+      return nil
+    }
 
-  // Forward to the backup
-  if pb.view.Backup != "" {
-    forwardArgs := ForwardArgs{ Key : args.Key, Value : args.Value }
-    forwardReply := ForwardReply{}
-    call(pb.view.Backup, "PBServer.Forward", forwardArgs, &forwardReply)
+    if store {
+      log.Printf("[PbService] Set %s: %s", args.Key, value)
+      pb.values[args.Key] = value
+    }
+    pb.dups[args.Client] = d
+  } else {
+    log.Printf("[PbService] Duplicate Put from %d", args.Client)
   }
 
   reply.Err = OK
+  reply.PreviousValue = d.PreviousValue
+  reply.Length = d.Length
+  reply.Stored = d.Stored
   return nil
 }
 
 
+//
+// send an update to the backup, if there is one. a failed
+// Forward may still have reached the backup, so keep at it
+// (serving nothing else meanwhile) until it succeeds, or the
+// view moves on. returns false in the latter case; the update
+// must then not be applied here.
+//
+func (pb *PBServer) forward(args ForwardArgs) bool {
+  backup := pb.view.Backup
+  for backup != "" && pb.dead == false {
+    reply := ForwardReply{}
+    ok := call(pb.tr, backup, "PBServer.Forward", args, &reply)
+    if ok && reply.Err == OK {
+      return true
+    }
+    log.Printf("[PbService] Forward to %s failed", backup)
+    // Ping, not Get: tick() can't ping while this waits.
+    view, err := pb.vs.Ping(pb.view.Viewnum)
+    if err == nil && view.Viewnum != pb.view.Viewnum {
+      return false
+    }
+    pb.clock.Sleep(viewservice.PingInterval / 10)
+  }
+  return backup == ""
+}
+
+
 func (pb *PBServer) Forward(args *ForwardArgs, reply *ForwardReply) error {
   pb.mu.Lock()
   defer pb.mu.Unlock()
 
   log.Printf("[PbService] Forward %s: %s", args.Key, args.Value)
 
-  pb.values[args.Key] = args.Value
+  if !args.KeepValue {
+    pb.values[args.Key] = args.Value
+  }
+  pb.dups[args.Client] = args.Dup
   reply.Err = OK
   return nil
 }
@@ -91,6 +154,10 @@ func (pb *PBServer) Backup(args *BackupArgs, reply *BackupReply) error {
 
   log.Printf("[PbService] Backup received: %d keys", len(args.Values))
   pb.values = args.Values
+  pb.dups = args.Dups
+  if pb.dups == nil {
+    pb.dups = make(map[int64]Dup)
+  }
   reply.Err = OK
   return nil
 }
@@ -110,9 +177,9 @@ func (pb *PBServer) tick() {
     log.Printf("[PbService] Updated View(%d)", result.Viewnum)
 
     if result.Backup != "" && pb.me == result.Primary {
-      args := BackupArgs{ Values : pb.values }
+      args := BackupArgs{ Values : pb.values, Dups : pb.dups }
       reply := BackupReply{}
-      call(result.Backup, "PBServer.Backup", args, &reply)
+      call(pb.tr, result.Backup, "PBServer.Backup", args, &reply)
     }
 
     pb.view = result
@@ -128,18 +195,28 @@ func (pb *PBServer) kill() {
 
 
 func StartServer(vshost string, me string) *PBServer {
+  return StartServerOn(nil, vshost, me)
+}
+
+//
+// like StartServer(), but listens and sends RPCs with tr.
+//
+func StartServerOn(tr transport.Transport, vshost string, me string) *PBServer {
   pb := new(PBServer)
+  pb.tr = tr
+  pb.clock = sim.ClockOf(tr)
   pb.me = me
-  pb.vs = viewservice.MakeClerk(me, vshost)
+  pb.vs = viewservice.MakeClerkOn(tr, me, vshost)
   // Your pb.* initializations here.
   pb.view = viewservice.View{}
   pb.values = make(map[string]string)
+  pb.dups = make(map[int64]Dup)
 
   rpcs := rpc.NewServer()
   rpcs.Register(pb)
+  faults.Register(rpcs, pb.tr)
 
-  os.Remove(pb.me)
-  l, e := net.Listen("unix", pb.me);
+  l, e := transport.ListenRPC(pb.tr, pb.me, rpcs);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -152,21 +229,7 @@ func StartServer(vshost string, me string) *PBServer {
     for pb.dead == false {
       conn, err := pb.l.Accept()
       if err == nil && pb.dead == false {
-        if pb.unreliable && (rand.Int63() % 1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if pb.unreliable && (rand.Int63() % 1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          go rpcs.ServeConn(conn)
-        } else {
-          go rpcs.ServeConn(conn)
-        }
+        go rpcs.ServeConn(conn)
       } else if err == nil {
         conn.Close()
       }
@@ -177,12 +240,12 @@ func StartServer(vshost string, me string) *PBServer {
     }
   }()
 
-  go func() {
+  pb.clock.Go(func() {
     for pb.dead == false {
       pb.tick()
-      time.Sleep(viewservice.PingInterval)
+      pb.clock.Sleep(viewservice.PingInterval)
     }
-  }()
+  })
 
   return pb
 }
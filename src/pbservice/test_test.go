@@ -1,6 +1,9 @@
 package pbservice
 
 import "viewservice"
+import "linearizable"
+import "faults"
+import "sim"
 import "fmt"
 import "io"
 import "net"
@@ -11,6 +14,7 @@ import "runtime"
 import "math/rand"
 import "os"
 import "strconv"
+import "strings"
 
 func check(ck *Clerk, key string, value string) {
   v := ck.Get(key)
@@ -262,11 +266,12 @@ func TestConcurrentSame(t *testing.T) {
   done := false
 
   view1, _ := vck.Get()
+  rec := linearizable.NewRecorder(nil)
   const nclients = 3
   const nkeys = 2
   for xi := 0; xi < nclients; xi++ {
     go func(i int) {
-      ck := MakeClerk(vshost, "")
+      ck := rec.Wrap(MakeClerk(vshost, ""))
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         k := strconv.Itoa(rr.Int() % nkeys)
@@ -281,7 +286,7 @@ func TestConcurrentSame(t *testing.T) {
   time.Sleep(time.Second)
 
   // read from primary
-  ck := MakeClerk(vshost, "")
+  ck := rec.Wrap(MakeClerk(vshost, ""))
   var vals [nkeys]string
   for i := 0; i < nkeys; i++ {
     vals[i] = ck.Get(strconv.Itoa(i))
@@ -316,6 +321,7 @@ func TestConcurrentSame(t *testing.T) {
       t.Fatalf("Get(%v) from backup; wanted %v, got %v", i, vals[i], z)
     }
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -335,14 +341,16 @@ func TestConcurrentSameUnreliable(t *testing.T) {
   vs := viewservice.StartServer(vshost)
   time.Sleep(time.Second)
   vck := viewservice.MakeClerk("", vshost)
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
 
   fmt.Printf("Test: Concurrent Put()s to the same key; unreliable ...\n")
 
   const nservers = 2
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
-    sa[i].unreliable = true
+    sa[i] = StartServerOn(in.Wrap(port(tag, i+1), nil), vshost, port(tag, i+1))
+    in.SetRule(faults.Any, port(tag, i+1), faults.Unreliable)
   }
 
   for iters := 0; iters < viewservice.DeadPings*2; iters++ {
@@ -359,11 +367,12 @@ func TestConcurrentSameUnreliable(t *testing.T) {
   done := false
 
   view1, _ := vck.Get()
+  rec := linearizable.NewRecorder(nil)
   const nclients = 3
   const nkeys = 2
   for xi := 0; xi < nclients; xi++ {
     go func(i int) {
-      ck := MakeClerk(vshost, "")
+      ck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         k := strconv.Itoa(rr.Int() % nkeys)
@@ -378,7 +387,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
   time.Sleep(time.Second)
 
   // read from primary
-  ck := MakeClerk(vshost, "")
+  ck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
   var vals [nkeys]string
   for i := 0; i < nkeys; i++ {
     vals[i] = ck.Get(strconv.Itoa(i))
@@ -413,6 +422,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
       t.Fatalf("Get(%v) from backup; wanted %v, got %v", i, vals[i], z)
     }
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -473,6 +483,7 @@ func TestRepeatedCrash(t *testing.T) {
     }
   } ()
 
+  rec := linearizable.NewRecorder(nil)
   const nth = 2
   var cha [nth]chan bool
   for xi := 0; xi < nth; xi++ {
@@ -480,7 +491,7 @@ func TestRepeatedCrash(t *testing.T) {
     go func(i int) {
       ok := false
       defer func() { cha[i] <- ok } ()
-      ck := MakeClerk(vshost, "")
+      ck := rec.Wrap(MakeClerk(vshost, ""))
       data := map[string]string{}
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
@@ -513,11 +524,12 @@ func TestRepeatedCrash(t *testing.T) {
     }
   }
 
-  ck := MakeClerk(vshost, "")
+  ck := rec.Wrap(MakeClerk(vshost, ""))
   ck.Put("aaa", "bbb")
   if v := ck.Get("aaa"); v != "bbb" {
     t.Fatalf("final Put/Get failed")
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -537,14 +549,16 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
   vs := viewservice.StartServer(vshost)
   time.Sleep(time.Second)
   vck := viewservice.MakeClerk("", vshost)
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
   
   fmt.Printf("Test: Repeated failures/restarts; unreliable ...\n")
 
   const nservers = 3
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
-    sa[i].unreliable = true
+    sa[i] = StartServerOn(in.Wrap(port(tag, i+1), nil), vshost, port(tag, i+1))
+    in.SetRule(faults.Any, port(tag, i+1), faults.Unreliable)
   }
 
   for i := 0; i < viewservice.DeadPings; i++ {
@@ -571,13 +585,14 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
 
-      sa[i] = StartServer(vshost, port(tag, i+1))
+      sa[i] = StartServerOn(in.Wrap(port(tag, i+1), nil), vshost, port(tag, i+1))
 
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
     }
   } ()
 
+  rec := linearizable.NewRecorder(nil)
   const nth = 2
   var cha [nth]chan bool
   for xi := 0; xi < nth; xi++ {
@@ -585,7 +600,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
     go func(i int) {
       ok := false
       defer func() { cha[i] <- ok } ()
-      ck := MakeClerk(vshost, "")
+      ck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
       data := map[string]string{}
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
@@ -618,11 +633,12 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
     }
   }
 
-  ck := MakeClerk(vshost, "")
+  ck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
   ck.Put("aaa", "bbb")
   if v := ck.Get("aaa"); v != "bbb" {
     t.Fatalf("final Put/Get failed")
   }
+  rec.Verify(t)
 
   fmt.Printf("  ... Passed\n")
 
@@ -653,7 +669,6 @@ func proxy(t *testing.T, port string, delay *int) {
       if err != nil {
         t.Fatalf("proxy accept failed: %v\n", err)
       }
-      time.Sleep(time.Duration(*delay) * time.Second)
       c2, err := net.Dial("unix", portx)
       if err != nil {
         t.Fatalf("proxy dial failed: %v\n", err)
@@ -681,6 +696,9 @@ func proxy(t *testing.T, port string, delay *int) {
         if n == 0 {
           break
         }
+        // delay each request, not each connection, since
+        // clerks keep their connections open.
+        time.Sleep(time.Duration(*delay) * time.Second)
         n1, err1 := c2.Write(buf[0:n])
         if err1 != nil || n1 != n {
           t.Fatalf("proxy c2.Write: %v\n", err1)
@@ -879,3 +897,322 @@ func TestPartition2(t *testing.T) {
   s3.kill()
   vs.Kill()
 }
+
+func TestPutHashAppend(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "hash"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+
+  const nservers = 2
+  var sa [nservers]*PBServer
+  for i := 0; i < nservers; i++ {
+    sa[i] = StartServerOn(in.Wrap(port(tag, i+1), nil), vshost, port(tag, i+1))
+  }
+
+  for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+    view, _ := vck.Get()
+    if view.Primary != "" && view.Backup != "" {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+
+  // give p+b time to ack, initialize
+  time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+  fmt.Printf("Test: Basic PutHash/Append ...\n")
+
+  ck := MakeClerkOn(ctr, vshost, "")
+  ck.Put("h", "x")
+  if prev := ck.PutHash("h", "y"); prev != "x" {
+    t.Fatalf("PutHash returned %v, wanted x", prev)
+  }
+  check(ck, "h", strconv.Itoa(int(hash("xy"))))
+
+  if n := ck.Append("l", "ab"); n != 2 {
+    t.Fatalf("Append returned %v, wanted 2", n)
+  }
+  if n := ck.Append("l", "c"); n != 3 {
+    t.Fatalf("Append returned %v, wanted 3", n)
+  }
+  check(ck, "l", "abc")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent PutHash/Append, unreliable, then failover ...\n")
+
+  for i := 0; i < nservers; i++ {
+    in.SetRule(faults.Any, port(tag, i+1), faults.Unreliable)
+  }
+
+  view1, _ := vck.Get()
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 3
+  var ca [nclients]chan bool
+  for xi := 0; xi < nclients; xi++ {
+    ca[xi] = make(chan bool)
+    go func(i int) {
+      defer func() { ca[i] <- true }()
+      myck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
+      rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
+      for j := 0; j < 20; j++ {
+        if rr.Int() % 2 == 0 {
+          myck.PutHash("ph", strconv.Itoa(i))
+        } else {
+          myck.Append("ap", strconv.Itoa(i))
+        }
+      }
+    }(xi)
+  }
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+
+  // kill the primary; the backup must know what
+  // was already done, so that retries stay deduplicated.
+  for i := 0; i < nservers; i++ {
+    if view1.Primary == sa[i].me {
+      sa[i].kill()
+      break
+    }
+  }
+  for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+    view, _ := vck.Get()
+    if view.Primary == view1.Backup {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+
+  nappends := 0
+  for _, op := range rec.History() {
+    if op.Kind == linearizable.Append {
+      nappends++
+    }
+  }
+  rck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
+  rck.Get("ph")
+  if v := rck.Get("ap"); len(v) != nappends {
+    t.Fatalf("%v Appends left %v", nappends, v)
+  }
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < nservers; i++ {
+    sa[i].kill()
+  }
+  time.Sleep(time.Second)
+  vs.Kill()
+  time.Sleep(time.Second)
+}
+
+func TestConditional(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "cond"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+  in := faults.New(sim.Seed(t), nil)
+  ctr := in.Wrap("client", nil)
+
+  const nservers = 2
+  var sa [nservers]*PBServer
+  for i := 0; i < nservers; i++ {
+    sa[i] = StartServerOn(in.Wrap(port(tag, i+1), nil), vshost, port(tag, i+1))
+  }
+
+  for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+    view, _ := vck.Get()
+    if view.Primary != "" && view.Backup != "" {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+
+  // give p+b time to ack, initialize
+  time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+  fmt.Printf("Test: Basic CompareAndSwap/PutIfAbsent ...\n")
+
+  ck := MakeClerkOn(ctr, vshost, "")
+  if ok, prev := ck.PutIfAbsent("a", "1"); !ok || prev != "" {
+    t.Fatalf("PutIfAbsent on a new key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.PutIfAbsent("a", "2"); ok || prev != "1" {
+    t.Fatalf("PutIfAbsent on an existing key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "0", "2"); ok || prev != "1" {
+    t.Fatalf("CompareAndSwap from the wrong value -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "1", "2"); !ok || prev != "1" {
+    t.Fatalf("CompareAndSwap -> %v %v", ok, prev)
+  }
+  check(ck, "a", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Counter, unreliable, with failover ...\n")
+
+  for i := 0; i < nservers; i++ {
+    in.SetRule(faults.Any, port(tag, i+1), faults.Unreliable)
+  }
+
+  view1, _ := vck.Get()
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 3
+  const nincr = 10
+  var ca [nclients]chan bool
+  for xi := 0; xi < nclients; xi++ {
+    ca[xi] = make(chan bool)
+    go func(i int) {
+      defer func() { ca[i] <- true }()
+      myck := rec.Wrap(MakeClerkOn(ctr, vshost, ""))
+      for j := 0; j < nincr; j++ {
+        for {
+          old := myck.Get("counter")
+          n, _ := strconv.Atoi(old)
+          if ok, _ := myck.CompareAndSwap("counter", old, strconv.Itoa(n+1)); ok {
+            break
+          }
+        }
+      }
+    }(xi)
+  }
+
+  // kill the primary while the clients are running.
+  time.Sleep(viewservice.PingInterval * 2)
+  for i := 0; i < nservers; i++ {
+    if view1.Primary == sa[i].me {
+      sa[i].kill()
+      break
+    }
+  }
+
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+  check(ck, "counter", strconv.Itoa(nclients * nincr))
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < nservers; i++ {
+    sa[i].kill()
+  }
+  time.Sleep(time.Second)
+  vs.Kill()
+  time.Sleep(time.Second)
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+
+  vshost := "viewserver"
+  vs := viewservice.StartServerOn(s.Node(vshost), vshost)
+  defer vs.Kill()
+  vck := viewservice.MakeClerkOn(s.Node("vck"), "", vshost)
+
+  fmt.Printf("Test: Primary failure, on simulated time ...\n")
+
+  var sa [2]*PBServer
+  for i := 0; i < len(sa); i++ {
+    me := "pb-" + strconv.Itoa(i)
+    sa[i] = StartServerOn(s.Node(me), vshost, me)
+    defer sa[i].kill()
+  }
+  for i := 0; i < viewservice.DeadPings * 4; i++ {
+    if v, _ := vck.Get(); v.Primary != "" && v.Backup != "" {
+      break
+    }
+    s.Sleep(viewservice.PingInterval)
+  }
+  v0, _ := vck.Get()
+  if v0.Primary == "" || v0.Backup == "" {
+    t.Fatalf("view never formed: %v", v0)
+  }
+  s.Sleep(3 * viewservice.PingInterval)
+
+  ck := MakeClerkOn(s.Node("ck"), vshost, "")
+  ck.Put("a", "aa")
+  check(ck, "a", "aa")
+
+  for i := 0; i < len(sa); i++ {
+    if sa[i].me == v0.Primary {
+      sa[i].kill()
+    }
+  }
+  for i := 0; i < viewservice.DeadPings * 4; i++ {
+    if vck.Primary() == v0.Backup {
+      break
+    }
+    s.Sleep(viewservice.PingInterval)
+  }
+  if vck.Primary() != v0.Backup {
+    t.Fatalf("backup never took over")
+  }
+  check(ck, "a", "aa")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent Appends, simulated lossy network ...\n")
+
+  s.SetNetwork(time.Millisecond, 10 * time.Millisecond, 0.1)
+  const nclients = 3
+  const nappends = 10
+  var mu sim.Mutex
+  ndone := 0
+  for i := 0; i < nclients; i++ {
+    cki := MakeClerkOn(s.Node("ck-" + strconv.Itoa(i)), vshost, "")
+    i := i
+    s.Go(func() {
+      for j := 0; j < nappends; j++ {
+        cki.Append("log", fmt.Sprintf("%v.%v,", i, j))
+      }
+      mu.Lock()
+      ndone++
+      mu.Unlock()
+    })
+  }
+  for {
+    mu.Lock()
+    n := ndone
+    mu.Unlock()
+    if n == nclients {
+      break
+    }
+    s.Sleep(100 * time.Millisecond)
+  }
+
+  s.SetNetwork(time.Millisecond, 10 * time.Millisecond, 0)
+  v := ck.Get("log")
+  for i := 0; i < nclients; i++ {
+    last := -1
+    for _, e := range strings.Split(v, ",") {
+      var ci, cj int
+      if n, _ := fmt.Sscanf(e, "%d.%d", &ci, &cj); n != 2 || ci != i {
+        continue
+      }
+      if cj != last + 1 {
+        t.Fatalf("client %v's appends out of order, or not exactly once: %v", i, v)
+      }
+      last = cj
+    }
+    if last != nappends - 1 {
+      t.Fatalf("client %v's appends missing: %v", i, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
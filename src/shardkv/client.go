@@ -1,23 +1,37 @@
 package shardkv
 
 import "shardmaster"
-import "net/rpc"
+import "transport"
+import "sim"
 import "time"
-import "sync"
 // import "fmt"
 
 type Clerk struct {
-  mu sync.Mutex // one RPC at a time
+  mu sim.Mutex // one RPC at a time
   sm *shardmaster.Clerk
+  tr transport.Transport
+  clock sim.Clock
   config shardmaster.Config
   // You'll have to modify Clerk.
+  me int64 // unique id, so servers can spot retries
+  seq int // number of the latest request
 }
 
 
 func MakeClerk(shardmasters []string) *Clerk {
+  return MakeClerkOn(nil, shardmasters)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, shardmasters []string) *Clerk {
   ck := new(Clerk)
-  ck.sm = shardmaster.MakeClerk(shardmasters)
+  ck.tr = tr
+  ck.clock = sim.ClockOf(tr)
+  ck.sm = shardmaster.MakeClerkOn(tr, shardmasters)
   // You'll have to modify MakeClerk.
+  ck.me = sim.RandOf(tr).Int63()
   return ck
 }
 
@@ -34,22 +48,14 @@ func MakeClerk(shardmasters []string) *Clerk {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
 }
 
 //
@@ -77,6 +83,7 @@ func (ck *Clerk) Get(key string) string {
 
 
   // You'll have to modify Get().
+  ck.seq++
 
   for {
     shard := key2shard(key)
@@ -90,15 +97,17 @@ func (ck *Clerk) Get(key string) string {
       for _, srv := range servers {
         args := &GetArgs{}
         args.Key = key
+        args.Client = ck.me
+        args.Seq = ck.seq
         var reply GetReply
-        ok := call(srv, "ShardKV.Get", args, &reply)
+        ok := call(ck.tr, srv, "ShardKV.Get", args, &reply)
         if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
           return reply.Value
         }
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
 
     // ask master for a new configuration.
     ck.config = ck.sm.Query(-1)
@@ -106,15 +115,22 @@ func (ck *Clerk) Get(key string) string {
   return ""
 }
 
-func (ck *Clerk) Put(key string, value string) {
+//
+// send a Put (or a PutHash, Append, &c) to the group
+// that serves args.Key, until it succeeds.
+//
+func (ck *Clerk) put(args PutArgs) PutReply {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
 
   // You'll have to modify Put().
+  ck.seq++
+  args.Client = ck.me
+  args.Seq = ck.seq
 
   for {
-    shard := key2shard(key)
+    shard := key2shard(args.Key)
 
     gid := ck.config.Shards[shard]
 
@@ -124,20 +140,65 @@ func (ck *Clerk) Put(key string, value string) {
     if ok {
       // try each server in the shard's replication group.
       for _, srv := range servers {
-        args := &PutArgs{}
-        args.Key = key
-        args.Value = value
         var reply PutReply
-        ok := call(srv, "ShardKV.Put", args, &reply)
+        ok := call(ck.tr, srv, "ShardKV.Put", &args, &reply)
         if ok && reply.Err == OK {
-          return
+          return reply
         }
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
 
     // ask master for a new configuration.
     ck.config = ck.sm.Query(-1)
   }
 }
+
+func (ck *Clerk) Put(key string, value string) {
+  ck.put(PutArgs{Key: key, Value: value})
+}
+
+//
+// set the value for a key, and remove the key ttl
+// after the Put takes effect, unless it is set again
+// before then.
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+  ck.put(PutArgs{Key: key, Value: value, TTL: ttl})
+}
+
+//
+// set the value for a key to hash(previous value + value),
+// and return the previous value.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+  return ck.put(PutArgs{Key: key, Value: value, DoHash: true}).PreviousValue
+}
+
+//
+// append arg to a key's value, and return the
+// length of the result.
+//
+func (ck *Clerk) Append(key string, arg string) int {
+  return ck.put(PutArgs{Key: key, Value: arg, DoAppend: true}).Length
+}
+
+//
+// set a key's value to update if its value is now
+// expected (a key that does not exist counts as "").
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) CompareAndSwap(key string, expected string, update string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: update, DoCAS: true, Expected: expected})
+  return reply.Stored, reply.PreviousValue
+}
+
+//
+// set a key's value only if the key does not exist.
+// returns whether it did, and the value the key had.
+//
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string) {
+  reply := ck.put(PutArgs{Key: key, Value: value, DoIfAbsent: true})
+  return reply.Stored, reply.PreviousValue
+}
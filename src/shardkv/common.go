@@ -1,5 +1,8 @@
 package shardkv
 
+import "hash/fnv"
+import "time"
+
 //
 // Sharded key/value server.
 // Lots of replica groups, each running op-at-a-time paxos.
@@ -13,23 +16,59 @@ const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
   ErrWrongGroup = "ErrWrongGroup"
+  ErrNotReady = "ErrNotReady" // the group hasn't yet reached the config
 )
 type Err string
 
 type PutArgs struct {
   Key string
   Value string
+  DoHash bool // store hash(previous value + Value)
+  DoAppend bool // store previous value + Value
+  DoCAS bool // store Value only if the current value is Expected
+  Expected string
+  DoIfAbsent bool // store Value only if the key does not exist
+  TTL time.Duration // for a plain Put: remove the key this long after; 0 means never
+  Client int64 // the Clerk's unique id
+  Seq int // the Clerk's request number; retries reuse it
 }
 
 type PutReply struct {
   Err Err
+  PreviousValue string // for DoHash, DoCAS and DoIfAbsent
+  Length int // of the new value, for DoAppend
+  Stored bool // for DoCAS and DoIfAbsent
 }
 
 type GetArgs struct {
   Key string
+  Client int64
+  Seq int
 }
 
 type GetReply struct {
   Err Err
   Value string
 }
+
+//
+// ask the group that served Shard before config Num for
+// the shard's keys, once it has moved on to config Num.
+//
+type FetchArgs struct {
+  Num int
+  Shard int
+}
+
+type FetchReply struct {
+  Err Err
+  Data map[string]string
+  Expires map[string]int64 // log time at which keys in Data expire
+  Dups map[int64]dup
+}
+
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
@@ -3,54 +3,467 @@ package shardkv
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
+import "faults"
+import "sim"
 import "log"
 import "time"
 import "paxos"
-import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
-import "math/rand"
 import "shardmaster"
+import "errors"
+import "strconv"
+import "sort"
 
 
+const (
+  GetOp = "Get"
+  PutOp = "Put"
+  PutHashOp = "PutHash"
+  AppendOp = "Append"
+  CASOp = "CompareAndSwap"
+  PutIfAbsentOp = "PutIfAbsent"
+  ReconfigOp = "Reconfig"
+  InstallOp = "Install"
+  TickOp = "Tick"
+)
+
 type Op struct {
   // Your definitions here.
+  Client int64
+  Seq int // the client's request number
+  Time int64 // proposer's clock, in nanoseconds
+  Kind string
+  Key string
+  Value string
+  TTL time.Duration // for PutOp; see ttl.go
+  Expected string // for CASOp
+  Config shardmaster.Config // for ReconfigOp
+  Num int // for InstallOp: the config the shard arrives in
+  Shard int
+  Data map[string]string
+  Expires map[string]int64
+  Dups map[int64]dup
+}
+
+//
+// the outcome of a client's latest request, kept so that
+// a retry gets the original result instead of re-executing.
+// the table goes with the shards when they move, so that a
+// retry sent to a shard's new group is caught there too.
+//
+type dup struct {
+  Seq int
+  Err Err
+  Value string // a Get's value, or the previous value
+  Length int // an Append's new length
+  Stored bool // a conditional put's outcome
 }
 
+var errKilled = errors.New("shardkv: server killed")
+
 type ShardKV struct {
-  mu sync.Mutex
+  mu sim.Mutex
   l net.Listener
   me int
   dead bool // for testing
-  unreliable bool // for testing
   sm *shardmaster.Clerk
   px *paxos.Paxos
+  tr transport.Transport
+  clock sim.Clock
 
   gid int64 // my replica group ID
 
   // Your definitions here.
+  data map[string]string
+  dups map[int64]dup // by client
+  config shardmaster.Config // the latest applied
+  prev shardmaster.Config // the one before it
+  pending map[int]bool // shards gained in config whose keys haven't arrived
+  applied int // instances below this have been applied
+  now int64 // highest Time applied
+  expires map[string]int64 // log time at which keys expire
+  expiring expiryHeap
+
+  opClient int64 // Client and Seq of this server's own Ops
+  opSeq int
+}
+
+//
+// may the group serve requests for shard, as of the
+// instances applied?
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) serves(shard int) bool {
+  return kv.config.Shards[shard] == kv.gid && kv.pending[shard] == false
+}
+
+// caller must hold kv.mu.
+func (kv *ShardKV) dropShard(shard int) {
+  for key := range kv.data {
+    if key2shard(key) == shard {
+      delete(kv.data, key)
+      delete(kv.expires, key)
+    }
+  }
+}
+
+//
+// move on to config c, if it is the next one and every
+// shard gained in the current one has arrived. the group
+// stops serving the shards it loses straight away, and
+// starts serving the ones it gains once their keys arrive
+// from the group that had them, in an InstallOp.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) reconfigure(c shardmaster.Config) {
+  if c.Num != kv.config.Num + 1 || len(kv.pending) > 0 {
+    return
+  }
+  for shard, gid := range c.Shards {
+    if gid != kv.gid || kv.config.Shards[shard] == kv.gid {
+      continue
+    }
+    if kv.config.Shards[shard] == 0 {
+      kv.dropShard(shard) // nobody had it; it starts out empty.
+    } else {
+      kv.pending[shard] = true
+    }
+  }
+  kv.prev = kv.config
+  kv.config = c
+}
+
+//
+// take in a shard's keys, and the duplicate table of the
+// group that had it, keeping each client's later entry.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) install(op Op) {
+  if op.Num != kv.config.Num || kv.pending[op.Shard] == false {
+    return
+  }
+  kv.dropShard(op.Shard)
+  for key, value := range op.Data {
+    kv.data[key] = value
+  }
+  for key, at := range op.Expires {
+    kv.expireAt(key, at)
+  }
+  for client, d := range op.Dups {
+    if cur, present := kv.dups[client]; !present || cur.Seq < d.Seq {
+      kv.dups[client] = d
+    }
+  }
+  delete(kv.pending, op.Shard)
+}
+
+//
+// execute op unless the client has already had it (or a
+// later request) executed, and note its result. a request
+// for a shard the group doesn't serve at this point in the
+// log is left out of the duplicate table, so that the
+// client can retry it at the right group.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) perform(op Op) {
+  if op.Time > kv.now {
+    kv.now = op.Time
+  }
+  kv.expire()
+  switch op.Kind {
+  case ReconfigOp:
+    kv.reconfigure(op.Config)
+    return
+  case InstallOp:
+    kv.install(op)
+    return
+  case TickOp:
+    return
+  }
+  if d, present := kv.dups[op.Client]; present && d.Seq >= op.Seq {
+    return
+  }
+  if kv.serves(key2shard(op.Key)) == false {
+    return
+  }
+
+  d := dup{Seq: op.Seq, Err: OK}
+  switch op.Kind {
+  case GetOp:
+    value, present := kv.data[op.Key]
+    if present {
+      d.Value = value
+    } else {
+      d.Err = ErrNoKey
+    }
+  case PutOp:
+    kv.data[op.Key] = op.Value
+    kv.setTTL(op.Key, op.TTL)
+  case PutHashOp:
+    d.Value = kv.data[op.Key]
+    kv.data[op.Key] = strconv.Itoa(int(hash(d.Value + op.Value)))
+  case AppendOp:
+    kv.data[op.Key] += op.Value
+    d.Length = len(kv.data[op.Key])
+  case CASOp:
+    d.Value = kv.data[op.Key]
+    if d.Value == op.Expected {
+      kv.data[op.Key] = op.Value
+      d.Stored = true
+      kv.setTTL(op.Key, 0)
+    }
+  case PutIfAbsentOp:
+    value, present := kv.data[op.Key]
+    d.Value = value
+    if !present {
+      kv.data[op.Key] = op.Value
+      d.Stored = true
+      kv.setTTL(op.Key, 0)
+    }
+  }
+  kv.dups[op.Client] = d
+}
+
+// caller must hold kv.mu.
+func (kv *ShardKV) apply(seq int, vs []interface{}) {
+  for _, v := range vs {
+    if op, ok := v.(Op); ok {
+      kv.perform(op)
+    }
+  }
+  kv.applied = seq + 1
+  kv.px.Done(seq)
+}
+
+//
+// apply every instance this server knows to be decided.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) catchUp() {
+  for kv.dead == false {
+    if decided, _ := kv.px.Status(kv.applied); decided == false {
+      return
+    }
+    _, vs := kv.px.Entries(kv.applied)
+    kv.apply(kv.applied, vs)
+  }
+}
+
+//
+// get op into the log, applying every instance before
+// it, and the one that holds it. returns false if the
+// server is killed first.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) agree(op Op) bool {
+  for kv.dead == false {
+    seq := kv.applied
+    if decided, _ := kv.px.Status(seq); decided == false {
+      kv.px.Start(seq, op)
+    }
+    to := 10 * time.Millisecond
+    for kv.dead == false {
+      if decided, _ := kv.px.WaitDecided(seq, to); decided {
+        break
+      }
+      if to < time.Second {
+        to *= 2
+      }
+    }
+    if kv.dead {
+      break
+    }
+    _, vs := kv.px.Entries(seq)
+    kv.apply(seq, vs)
+    for _, v := range vs {
+      if o, ok := v.(Op); ok && o.Client == op.Client && o.Seq == op.Seq {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+//
+// run a client's op through the log, unless it is a retry
+// of a request that has already been executed, and return
+// its result.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) execute(op Op) (dup, error) {
+  kv.catchUp()
+  if d, present := kv.dups[op.Client]; present && d.Seq >= op.Seq {
+    return d, nil
+  }
+  if kv.serves(key2shard(op.Key)) == false {
+    return dup{Err: ErrWrongGroup}, nil
+  }
+  op.Time = kv.clock.Now().UnixNano()
+  if kv.agree(op) == false {
+    return dup{}, errKilled
+  }
+  if d, present := kv.dups[op.Client]; present && d.Seq >= op.Seq {
+    return d, nil
+  }
+  return dup{Err: ErrWrongGroup}, nil
+}
+
+//
+// propose one of this server's own Ops.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) agreeOwn(op Op) bool {
+  kv.opSeq++
+  op.Client = kv.opClient
+  op.Seq = kv.opSeq
+  op.Time = kv.clock.Now().UnixNano()
+  return kv.agree(op)
 }
 
 
 func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
 
   // Your code here.
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
 
+  op := Op{Client: args.Client, Seq: args.Seq, Kind: GetOp, Key: args.Key}
+  d, err := kv.execute(op)
+  if err != nil {
+    return err
+  }
+  reply.Err = d.Err
+  reply.Value = d.Value
   return nil
 }
 
 func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
   // Your code here.
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
 
+  op := Op{Client: args.Client, Seq: args.Seq, Kind: PutOp,
+           Key: args.Key, Value: args.Value, TTL: args.TTL}
+  if args.DoHash {
+    op.Kind = PutHashOp
+  } else if args.DoAppend {
+    op.Kind = AppendOp
+  } else if args.DoCAS {
+    op.Kind = CASOp
+    op.Expected = args.Expected
+  } else if args.DoIfAbsent {
+    op.Kind = PutIfAbsentOp
+  }
+  d, err := kv.execute(op)
+  if err != nil {
+    return err
+  }
+  reply.Err = d.Err
+  reply.PreviousValue = d.Value
+  reply.Length = d.Length
+  reply.Stored = d.Stored
   return nil
 }
 
+//
+// hand over a shard's keys, and the duplicate table, to
+// the group that gets the shard in config args.Num. this
+// group no longer serves the shard once it has applied
+// that config, so the keys can't change after that.
+//
+func (kv *ShardKV) Fetch(args *FetchArgs, reply *FetchReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  kv.catchUp()
+  if kv.config.Num < args.Num {
+    reply.Err = ErrNotReady
+    return nil
+  }
+  reply.Data = map[string]string{}
+  reply.Expires = map[string]int64{}
+  for key, value := range kv.data {
+    if key2shard(key) == args.Shard {
+      reply.Data[key] = value
+      if at, present := kv.expires[key]; present {
+        reply.Expires[key] = at
+      }
+    }
+  }
+  reply.Dups = make(map[int64]dup, len(kv.dups))
+  for client, d := range kv.dups {
+    reply.Dups[client] = d
+  }
+  reply.Err = OK
+  return nil
+}
+
+//
+// get shard's keys for config num from one of servers.
+//
+func (kv *ShardKV) fetch(servers []string, num int, shard int) (FetchReply, bool) {
+  for _, srv := range servers {
+    args := &FetchArgs{Num: num, Shard: shard}
+    var reply FetchReply
+    ok := call(kv.tr, srv, "ShardKV.Fetch", args, &reply)
+    if ok && reply.Err == OK {
+      return reply, true
+    }
+  }
+  return FetchReply{}, false
+}
+
+//
+// take one step towards the latest config: fetch the
+// shards still to arrive in this one, or else move on to
+// the next. returns false if there was nothing to do, or
+// it couldn't be done yet.
+//
+func (kv *ShardKV) step() bool {
+  kv.mu.Lock()
+  kv.catchUp()
+  num := kv.config.Num
+  prev := kv.prev
+  var shards []int
+  for shard := range kv.pending {
+    shards = append(shards, shard)
+  }
+  kv.mu.Unlock()
+
+  if len(shards) > 0 {
+    sort.Ints(shards)
+    for _, shard := range shards {
+      reply, ok := kv.fetch(prev.Groups[prev.Shards[shard]], num, shard)
+      if ok == false {
+        return false
+      }
+      kv.mu.Lock()
+      kv.agreeOwn(Op{Kind: InstallOp, Num: num, Shard: shard,
+                     Data: reply.Data, Expires: reply.Expires,
+                     Dups: reply.Dups})
+      kv.mu.Unlock()
+    }
+    return true
+  }
+
+  c := kv.sm.Query(num + 1)
+  if c.Num != num + 1 {
+    return false
+  }
+  kv.mu.Lock()
+  kv.agreeOwn(Op{Kind: ReconfigOp, Config: c})
+  kv.mu.Unlock()
+  return true
+}
+
 //
 // Ask the shardmaster if there's a new configuration;
 // if so, re-configure.
 //
 func (kv *ShardKV) tick() {
+  for kv.dead == false && kv.step() {
+  }
 }
 
 
@@ -72,28 +485,45 @@ func (kv *ShardKV) kill() {
 //
 func StartServer(gid int64, shardmasters []string,
                  servers []string, me int) *ShardKV {
+  return StartServerOn(nil, gid, shardmasters, servers, me)
+}
+
+//
+// like StartServer(), but listens and sends RPCs with tr.
+//
+func StartServerOn(tr transport.Transport, gid int64, shardmasters []string,
+                   servers []string, me int) *ShardKV {
   gob.Register(Op{})
 
   kv := new(ShardKV)
   kv.me = me
   kv.gid = gid
-  kv.sm = shardmaster.MakeClerk(shardmasters)
+  kv.tr = tr
+  kv.clock = sim.ClockOf(tr)
+  kv.sm = shardmaster.MakeClerkOn(tr, shardmasters)
 
   // Your initialization code here.
   // Don't call Join().
+  kv.data = make(map[string]string)
+  kv.dups = make(map[int64]dup)
+  kv.pending = make(map[int]bool)
+  kv.opClient = sim.RandOf(tr).Int63()
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
+  faults.Register(rpcs, kv.tr)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  kv.px = paxos.MakeWithOptions(servers, me, rpcs,
+                                paxos.Options{Transport: tr})
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := transport.ListenRPC(kv.tr, servers[me], rpcs);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
   kv.l = l
 
+  kv.clock.Go(kv.ticker)
+
   // please do not change any of the following code,
   // or do anything to subvert it.
 
@@ -101,21 +531,7 @@ func StartServer(gid int64, shardmasters []string,
     for kv.dead == false {
       conn, err := kv.l.Accept()
       if err == nil && kv.dead == false {
-        if kv.unreliable && (rand.Int63() % 1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if kv.unreliable && (rand.Int63() % 1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          go rpcs.ServeConn(conn)
-        } else {
-          go rpcs.ServeConn(conn)
-        }
+        go rpcs.ServeConn(conn)
       } else if err == nil {
         conn.Close()
       }
@@ -126,12 +542,12 @@ func StartServer(gid int64, shardmasters []string,
     }
   }()
 
-  go func() {
+  kv.clock.Go(func() {
     for kv.dead == false {
       kv.tick()
-      time.Sleep(250 * time.Millisecond)
+      kv.clock.Sleep(250 * time.Millisecond)
     }
-  }()
+  })
 
   return kv
 }
@@ -9,6 +9,10 @@ import "time"
 import "fmt"
 import "sync"
 import "math/rand"
+import "linearizable"
+import "transport"
+import "faults"
+import "sim"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -37,7 +41,11 @@ func cleanup(sa [][]*ShardKV) {
   }
 }
 
-func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*ShardKV, func()) {
+//
+// start the shardmasters and replica groups. the replica
+// groups send through in, unless it is nil.
+//
+func setup(tag string, in *faults.Injector) ([]string, []int64, [][]string, [][]*ShardKV, func()) {
   runtime.GOMAXPROCS(4)
   
   const nmasters = 3
@@ -65,8 +73,46 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
       ha[i][j] = port(tag+"s", (i*nreplicas)+j)
     }
     for j := 0; j < nreplicas; j++ {
-      sa[i][j] = StartServer(gids[i], smh, ha[i], j)
-      sa[i][j].unreliable = unreliable
+      var tr transport.Transport
+      if in != nil {
+        tr = in.Wrap(ha[i][j], nil)
+      }
+      sa[i][j] = StartServerOn(tr, gids[i], smh, ha[i], j)
+    }
+  }
+
+  clean := func() { cleanup(sa) ; mcleanup(sma) }
+  return smh, gids, ha, sa, clean
+}
+
+//
+// like setup(), but every server is a node of s.
+//
+func simSetup(s *sim.Sim) ([]string, []int64, [][]string, [][]*ShardKV, func()) {
+  const nmasters = 3
+  var sma []*shardmaster.ShardMaster = make([]*shardmaster.ShardMaster, nmasters)
+  var smh []string = make([]string, nmasters)
+  for i := 0; i < nmasters; i++ {
+    smh[i] = "m-" + strconv.Itoa(i)
+  }
+  for i := 0; i < nmasters; i++ {
+    sma[i] = shardmaster.StartServerOn(s.Node(smh[i]), smh, i)
+  }
+
+  const ngroups = 3
+  const nreplicas = 3
+  gids := make([]int64, ngroups)
+  ha := make([][]string, ngroups)
+  sa := make([][]*ShardKV, ngroups)
+  for i := 0; i < ngroups; i++ {
+    gids[i] = int64(i + 100)
+    sa[i] = make([]*ShardKV, nreplicas)
+    ha[i] = make([]string, nreplicas)
+    for j := 0; j < nreplicas; j++ {
+      ha[i][j] = "s-" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+    }
+    for j := 0; j < nreplicas; j++ {
+      sa[i][j] = StartServerOn(s.Node(ha[i][j]), gids[i], smh, ha[i], j)
     }
   }
 
@@ -75,7 +121,7 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
 }
 
 func TestBasic(t *testing.T) {
-  smh, gids, ha, _, clean := setup("basic", false)
+  smh, gids, ha, _, clean := setup("basic", nil)
   defer clean()
 
   fmt.Printf("Test: Basic Join/Leave ...\n")
@@ -132,7 +178,7 @@ func TestBasic(t *testing.T) {
 }
 
 func TestMove(t *testing.T) {
-  smh, gids, ha, _, clean := setup("move", false)
+  smh, gids, ha, _, clean := setup("move", nil)
   defer clean()
 
   fmt.Printf("Test: Shards really move ...\n")
@@ -190,7 +236,7 @@ func TestMove(t *testing.T) {
 }
 
 func TestLimp(t *testing.T) {
-  smh, gids, ha, sa, clean := setup("limp", false)
+  smh, gids, ha, sa, clean := setup("limp", nil)
   defer clean()
 
   fmt.Printf("Test: Reconfiguration with some dead replicas ...\n")
@@ -254,14 +300,24 @@ func TestLimp(t *testing.T) {
 }
 
 func doConcurrent(t *testing.T, unreliable bool) {
-  smh, gids, ha, _, clean := setup("conc"+strconv.FormatBool(unreliable), unreliable)
+  in := faults.New(sim.Seed(t), nil)
+  smh, gids, ha, _, clean := setup("conc"+strconv.FormatBool(unreliable), in)
   defer clean()
+  if unreliable {
+    for i := range ha {
+      for _, h := range ha[i] {
+        in.SetRule(faults.Any, h, faults.Unreliable)
+      }
+    }
+  }
+  ctr := in.Wrap("client", nil)
 
   mck := shardmaster.MakeClerk(smh)
   for i := 0; i < len(gids); i++ {
     mck.Join(gids[i], ha[i])
   }
 
+  rec := linearizable.NewRecorder(nil)
   const npara = 11
   var ca [npara]chan bool
   for i := 0; i < npara; i++ {
@@ -269,7 +325,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
     go func(me int) {
       ok := true
       defer func() { ca[me] <- ok }()
-      ck := MakeClerk(smh)
+      ck := rec.Wrap(MakeClerkOn(ctr, smh))
       mymck := shardmaster.MakeClerk(smh)
       key := strconv.Itoa(me)
       last := ""
@@ -296,6 +352,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
       t.Fatalf("something is wrong")
     }
   }
+  rec.Verify(t)
 }
 
 func TestConcurrent(t *testing.T) {
@@ -309,3 +366,351 @@ func TestConcurrentUnreliable(t *testing.T) {
   doConcurrent(t, true)
   fmt.Printf("  ... Passed\n")
 }
+
+func TestPutHashAppend(t *testing.T) {
+  in := faults.New(sim.Seed(t), nil)
+  smh, gids, ha, _, clean := setup("hash", in)
+  defer clean()
+  ctr := in.Wrap("client", nil)
+
+  mck := shardmaster.MakeClerk(smh)
+  for i := 0; i < len(gids); i++ {
+    mck.Join(gids[i], ha[i])
+  }
+
+  ck := MakeClerkOn(ctr, smh)
+
+  fmt.Printf("Test: Basic PutHash/Append ...\n")
+
+  ck.Put("h", "x")
+  if prev := ck.PutHash("h", "y"); prev != "x" {
+    t.Fatalf("PutHash returned %v, wanted x", prev)
+  }
+  if v := ck.Get("h"); v != strconv.Itoa(int(hash("xy"))) {
+    t.Fatalf("Get(h) -> %v, wanted hash(xy)", v)
+  }
+  if n := ck.Append("l", "ab"); n != 2 {
+    t.Fatalf("Append returned %v, wanted 2", n)
+  }
+  if n := ck.Append("l", "c"); n != 3 {
+    t.Fatalf("Append returned %v, wanted 3", n)
+  }
+  if v := ck.Get("l"); v != "abc" {
+    t.Fatalf("Get(l) -> %v, wanted abc", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Append retried after its shard moves ...\n")
+
+  shard := key2shard("r")
+  mck.Move(shard, gids[0])
+  pargs := &PutArgs{Key: "r", Value: "x", DoAppend: true, Client: 1, Seq: 1}
+  var preply PutReply
+  for call(nil, ha[0][0], "ShardKV.Put", pargs, &preply) == false || preply.Err != OK {
+    time.Sleep(100 * time.Millisecond)
+  }
+  mck.Move(shard, gids[1])
+  for iters := 0; ; iters++ {
+    preply = PutReply{}
+    if call(nil, ha[1][0], "ShardKV.Put", pargs, &preply) && preply.Err == OK {
+      break
+    }
+    if iters > 50 {
+      t.Fatalf("retried Append at the new group: %v", preply.Err)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if preply.Length != 1 {
+    t.Fatalf("retried Append returned length %v, wanted 1", preply.Length)
+  }
+  if v := ck.Get("r"); v != "x" {
+    t.Fatalf("Get(r) -> %v after a retried Append, wanted x", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent PutHash/Append/Move, unreliable ...\n")
+
+  for i := range ha {
+    for _, h := range ha[i] {
+      in.SetRule(faults.Any, h, faults.Unreliable)
+    }
+  }
+
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 5
+  const nappends = 10
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      defer func() { ca[cli] <- true }()
+      myck := rec.Wrap(MakeClerkOn(ctr, smh))
+      for i := 0; i < nappends; i++ {
+        myck.PutHash("ph", strconv.Itoa(cli))
+        myck.Append("ap", strconv.Itoa(cli))
+        myck.Get("ap")
+        if i % 3 == 0 {
+          mck.Move(key2shard("ap"), gids[rand.Int() % len(gids)])
+          mck.Move(key2shard("ph"), gids[rand.Int() % len(gids)])
+        }
+      }
+    }(xcli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+  if v := ck.Get("ap"); len(v) != nclients * nappends {
+    t.Fatalf("%v Appends left %v", nclients * nappends, v)
+  }
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestConditional(t *testing.T) {
+  in := faults.New(sim.Seed(t), nil)
+  smh, gids, ha, _, clean := setup("cond", in)
+  defer clean()
+  ctr := in.Wrap("client", nil)
+
+  mck := shardmaster.MakeClerk(smh)
+  for i := 0; i < len(gids); i++ {
+    mck.Join(gids[i], ha[i])
+  }
+
+  ck := MakeClerkOn(ctr, smh)
+
+  fmt.Printf("Test: Basic CompareAndSwap/PutIfAbsent ...\n")
+
+  if ok, prev := ck.PutIfAbsent("a", "1"); !ok || prev != "" {
+    t.Fatalf("PutIfAbsent on a new key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.PutIfAbsent("a", "2"); ok || prev != "1" {
+    t.Fatalf("PutIfAbsent on an existing key -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "0", "2"); ok || prev != "1" {
+    t.Fatalf("CompareAndSwap from the wrong value -> %v %v", ok, prev)
+  }
+  if ok, prev := ck.CompareAndSwap("a", "1", "2"); !ok || prev != "1" {
+    t.Fatalf("CompareAndSwap -> %v %v", ok, prev)
+  }
+  if v := ck.Get("a"); v != "2" {
+    t.Fatalf("Get(a) -> %v, wanted 2", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Election and counter, unreliable, with moves ...\n")
+
+  for i := range ha {
+    for _, h := range ha[i] {
+      in.SetRule(faults.Any, h, faults.Unreliable)
+    }
+  }
+
+  rec := linearizable.NewRecorder(nil)
+  const nclients = 5
+  const nincr = 5
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      won := false
+      defer func() { ca[cli] <- won }()
+      myck := rec.Wrap(MakeClerkOn(ctr, smh))
+      won, _ = myck.PutIfAbsent("leader", strconv.Itoa(cli))
+      for i := 0; i < nincr; i++ {
+        for {
+          old := myck.Get("counter")
+          n, _ := strconv.Atoi(old)
+          if ok, _ := myck.CompareAndSwap("counter", old, strconv.Itoa(n+1)); ok {
+            break
+          }
+        }
+        mck.Move(key2shard("counter"), gids[rand.Int() % len(gids)])
+      }
+    }(xcli)
+  }
+  nwon := 0
+  for cli := 0; cli < nclients; cli++ {
+    if <- ca[cli] {
+      nwon++
+    }
+  }
+  if nwon != 1 {
+    t.Fatalf("%v clients won the election", nwon)
+  }
+  if v := ck.Get("counter"); v != strconv.Itoa(nclients * nincr) {
+    t.Fatalf("counter is %v, wanted %v", v, nclients * nincr)
+  }
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTTL(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("ttl", nil)
+  defer clean()
+
+  mck := shardmaster.MakeClerk(smh)
+  for i := 0; i < len(gids); i++ {
+    mck.Join(gids[i], ha[i])
+  }
+
+  ck := MakeClerk(smh)
+
+  fmt.Printf("Test: Keys expire while idle ...\n")
+
+  ck.Put("keep", "1")
+  ck.PutWithTTL("s", "1", 500 * time.Millisecond)
+  if v := ck.Get("s"); v != "1" {
+    t.Fatalf("Get(s) -> %v before expiry", v)
+  }
+  // no requests now; ticks move log time on.
+  time.Sleep(time.Second)
+  g := 0
+  for gids[g] != mck.Query(-1).Shards[key2shard("s")] {
+    g++
+  }
+  for i := 0; i < len(sa[g]); i++ {
+    sa[g][i].mu.Lock()
+    sa[g][i].catchUp()
+    _, present := sa[g][i].data["s"]
+    sa[g][i].mu.Unlock()
+    if present {
+      t.Fatalf("server %d did not expire an idle key", i)
+    }
+  }
+  if v := ck.Get("s"); v != "" {
+    t.Fatalf("Get(s) -> %v after expiry", v)
+  }
+  if v := ck.Get("keep"); v != "1" {
+    t.Fatalf("Get(keep) -> %v", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Puts renew or clear TTLs ...\n")
+
+  ck.PutWithTTL("p", "1", 300 * time.Millisecond)
+  ck.Put("p", "2")
+  ck.PutWithTTL("r", "1", 300 * time.Millisecond)
+  ck.PutWithTTL("r", "2", 2 * time.Second)
+  ck.PutWithTTL("a", "x", 300 * time.Millisecond)
+  ck.Append("a", "y")
+  time.Sleep(time.Second)
+  if v := ck.Get("p"); v != "2" {
+    t.Fatalf("Get(p) -> %v, wanted 2", v)
+  }
+  if v := ck.Get("r"); v != "2" {
+    t.Fatalf("Get(r) -> %v, wanted 2", v)
+  }
+  if v := ck.Get("a"); v != "" {
+    t.Fatalf("Get(a) -> %v, wanted it expired", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: TTLs move with their shard ...\n")
+
+  shard := key2shard("m")
+  from := mck.Query(-1).Shards[shard]
+  to := gids[0]
+  if to == from {
+    to = gids[1]
+  }
+  ck.PutWithTTL("m", "x", time.Second)
+  mck.Move(shard, to)
+  if v := ck.Get("m"); v != "x" {
+    t.Fatalf("Get(m) -> %v after a move", v)
+  }
+  time.Sleep(1500 * time.Millisecond)
+  if v := ck.Get("m"); v != "" {
+    t.Fatalf("Get(m) -> %v, wanted it expired at the new group", v)
+  }
+  g = 0
+  for gids[g] != to {
+    g++
+  }
+  // compare the replicas at the same point in the log,
+  // which ticks may keep moving.
+  states := make([]string, len(sa[g]))
+  for {
+    applied := make([]int, len(sa[g]))
+    for i := 0; i < len(sa[g]); i++ {
+      sa[g][i].mu.Lock()
+      sa[g][i].catchUp()
+      applied[i] = sa[g][i].applied
+      states[i] = fmt.Sprint(sa[g][i].data, sa[g][i].expires)
+      sa[g][i].mu.Unlock()
+    }
+    if applied[0] == applied[1] && applied[0] == applied[2] {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if states[0] != states[1] || states[0] != states[2] {
+    t.Fatalf("replicas disagree:\n%v\n%v\n%v", states[0], states[1], states[2])
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+  smh, gids, ha, _, clean := simSetup(s)
+  defer clean()
+
+  fmt.Printf("Test: Concurrent Append/Get/Move, simulated lossy network ...\n")
+
+  mck := shardmaster.MakeClerkOn(s.Node("mck"), smh)
+  for i := 0; i < len(gids); i++ {
+    mck.Join(gids[i], ha[i])
+  }
+  ck := MakeClerkOn(s.Node("ck"), smh)
+
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0.1)
+  rr := sim.RandOf(s.Node("test"))
+  rec := linearizable.NewRecorder(s)
+  const nclients = 5
+  const nappends = 10
+  var mu sim.Mutex
+  ndone := 0
+  for cli := 0; cli < nclients; cli++ {
+    myck := rec.Wrap(MakeClerkOn(s.Node("ck-" + strconv.Itoa(cli)), smh))
+    cli := cli
+    s.Go(func() {
+      for i := 0; i < nappends; i++ {
+        myck.Append("ap", strconv.Itoa(cli))
+        myck.Get("ap")
+      }
+      mu.Lock()
+      ndone++
+      mu.Unlock()
+    })
+  }
+  // move the shard around until the clients are done.
+  for {
+    mu.Lock()
+    n := ndone
+    mu.Unlock()
+    if n == nclients {
+      break
+    }
+    mck.Move(key2shard("ap"), gids[rr.Intn(len(gids))])
+    s.Sleep(500 * time.Millisecond)
+  }
+
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0)
+  if v := ck.Get("ap"); len(v) != nclients * nappends {
+    t.Fatalf("%v Appends left %v", nclients * nappends, v)
+  }
+  rec.Verify(t)
+
+  fmt.Printf("  ... Passed\n")
+}
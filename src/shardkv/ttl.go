@@ -0,0 +1,123 @@
+package shardkv
+
+//
+// Keys that expire.
+//
+// A Put with a TTL sets the key to expire TTL after the log
+// time at which it is applied; a later Put without one (or a
+// CompareAndSwap or PutIfAbsent that stores a value) makes
+// the key permanent again, while Append and PutHash leave the
+// TTL alone. Log time is the highest Op.Time the group has
+// applied, so every replica removes an expired key at the
+// same point in its log, just before the first Op stamped at
+// or after its expiry.
+//
+// A key's expiry is a log time, and goes with the key when
+// its shard moves. The new group's log time comes from other
+// clocks, so the key may last a little more or less there,
+// but the replicas of that group still agree on when.
+//
+// Log time only moves when Ops are applied, so while any key
+// has a TTL, an idle replica proposes a TickOp to move it on,
+// waiting longer the higher its index, to keep down the
+// number of ticks.
+//
+
+import "container/heap"
+import "time"
+
+// how often log time should move while keys have TTLs.
+const TickInterval = 100 * time.Millisecond
+
+type expiry struct {
+  key string
+  at int64
+}
+
+//
+// expiries by time. an entry is stale, and skipped, if the
+// key's TTL has changed since.
+//
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+  old := *h
+  x := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return x
+}
+
+//
+// give key a TTL from the current log time, or none if
+// ttl is 0.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) setTTL(key string, ttl time.Duration) {
+  if ttl <= 0 {
+    delete(kv.expires, key)
+    return
+  }
+  kv.expireAt(key, kv.now + int64(ttl))
+}
+
+//
+// remove key at log time at.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) expireAt(key string, at int64) {
+  if kv.expires == nil {
+    kv.expires = make(map[string]int64)
+  }
+  kv.expires[key] = at
+  heap.Push(&kv.expiring, expiry{key, at})
+}
+
+//
+// remove every key that has expired by the log time.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) expire() {
+  for len(kv.expiring) > 0 && kv.expiring[0].at <= kv.now {
+    e := heap.Pop(&kv.expiring).(expiry)
+    if at, present := kv.expires[e.key]; !present || at != e.at {
+      continue
+    }
+    delete(kv.expires, e.key)
+    delete(kv.data, e.key)
+  }
+}
+
+//
+// propose a TickOp now and then while keys have TTLs.
+// the proposal is made without kv.mu, so that requests
+// are not held up behind a tick when there is no majority;
+// if something else is decided in the instance instead,
+// a later round tries again.
+//
+func (kv *ShardKV) ticker() {
+  started := -1 // the instance of the last tick proposed
+  for kv.dead == false {
+    kv.clock.Sleep(TickInterval)
+
+    kv.mu.Lock()
+    kv.catchUp()
+    lag := kv.clock.Now().UnixNano() - kv.now
+    seq := kv.applied
+    if len(kv.expires) == 0 || lag <= int64(TickInterval) * int64(1 + kv.me) || seq == started {
+      kv.mu.Unlock()
+      continue
+    }
+    kv.opSeq++
+    op := Op{Client: kv.opClient, Seq: kv.opSeq, Kind: TickOp}
+    op.Time = kv.clock.Now().UnixNano()
+    kv.mu.Unlock()
+
+    started = seq
+    kv.px.Start(seq, op)
+    kv.px.WaitDecided(seq, TickInterval)
+  }
+}
@@ -5,15 +5,27 @@ package shardmaster
 // Please don't change this file.
 //
 
-import "net/rpc"
+import "transport"
+import "sim"
 import "time"
 
 type Clerk struct {
   servers []string // shardmaster replicas
+  tr transport.Transport
+  clock sim.Clock
 }
 
 func MakeClerk(servers []string) *Clerk {
+  return MakeClerkOn(nil, servers)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, servers []string) *Clerk {
   ck := new(Clerk)
+  ck.tr = tr
+  ck.clock = sim.ClockOf(tr)
   ck.servers = servers
   return ck
 }
@@ -31,22 +43,14 @@ func MakeClerk(servers []string) *Clerk {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
 }
 
 func (ck *Clerk) Query(num int) Config {
@@ -56,12 +60,12 @@ func (ck *Clerk) Query(num int) Config {
       args := &QueryArgs{}
       args.Num = num
       var reply QueryReply
-      ok := call(srv, "ShardMaster.Query", args, &reply)
+      ok := call(ck.tr, srv, "ShardMaster.Query", args, &reply)
       if ok {
         return reply.Config
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
   }
   return Config{}
 }
@@ -74,12 +78,12 @@ func (ck *Clerk) Join(gid int64, servers []string) {
       args.GID = gid
       args.Servers = servers
       var reply JoinReply
-      ok := call(srv, "ShardMaster.Join", args, &reply)
+      ok := call(ck.tr, srv, "ShardMaster.Join", args, &reply)
       if ok {
         return
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
   }
 }
 
@@ -90,12 +94,12 @@ func (ck *Clerk) Leave(gid int64) {
       args := &LeaveArgs{}
       args.GID = gid
       var reply LeaveReply
-      ok := call(srv, "ShardMaster.Leave", args, &reply)
+      ok := call(ck.tr, srv, "ShardMaster.Leave", args, &reply)
       if ok {
         return
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
   }
 }
 
@@ -107,11 +111,11 @@ func (ck *Clerk) Move(shard int, gid int64) {
       args.Shard = shard
       args.GID = gid
       var reply LeaveReply
-      ok := call(srv, "ShardMaster.Move", args, &reply)
+      ok := call(ck.tr, srv, "ShardMaster.Move", args, &reply)
       if ok {
         return
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    ck.clock.Sleep(100 * time.Millisecond)
   }
 }
@@ -3,52 +3,239 @@ package shardmaster
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
+import "faults"
 import "log"
 import "paxos"
-import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
-import "math/rand"
+import "sort"
+import "errors"
+import "sim"
+import "time"
+
+var errKilled = errors.New("shardmaster: server killed")
 
 type ShardMaster struct {
-  mu sync.Mutex
+  mu sim.Mutex
   l net.Listener
   me int
   dead bool // for testing
-  unreliable bool // for testing
   px *paxos.Paxos
+  tr transport.Transport
 
   configs []Config // indexed by config num
+  applied int // instances below this have been applied to configs
+  id int64 // tells this server's Ops from the others'
+  seq int // number of this server's latest Op
 }
 
 
+const (
+  JoinOp = "Join"
+  LeaveOp = "Leave"
+  MoveOp = "Move"
+  QueryOp = "Query"
+)
+
 type Op struct {
   // Your data here.
+  Server int64 // sm.id of the proposer
+  Seq int // sm.seq when proposed
+  Kind string
+  GID int64 // for JoinOp, LeaveOp and MoveOp
+  Servers []string // for JoinOp
+  Shard int // for MoveOp
+}
+
+//
+// a new config, like the latest but numbered one past it,
+// with its own Groups map.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) next() Config {
+  old := sm.configs[len(sm.configs) - 1]
+  c := Config{Num: old.Num + 1, Shards: old.Shards}
+  c.Groups = make(map[int64][]string, len(old.Groups))
+  for gid, servers := range old.Groups {
+    c.Groups[gid] = servers
+  }
+  return c
+}
+
+//
+// spread the shards evenly over c's groups, moving as few
+// as possible: each group ends up with NShards/len(groups)
+// shards, or one more, and the extra ones go to the groups
+// that have the most already. ties are broken by GID, so
+// that every server makes the same choices.
+//
+func rebalance(c *Config) {
+  gids := make([]int64, 0, len(c.Groups))
+  for gid := range c.Groups {
+    gids = append(gids, gid)
+  }
+  if len(gids) == 0 {
+    for s := range c.Shards {
+      c.Shards[s] = 0
+    }
+    return
+  }
+  var free []int
+  count := map[int64]int{}
+  for s, gid := range c.Shards {
+    if _, present := c.Groups[gid]; present {
+      count[gid]++
+    } else {
+      free = append(free, s)
+    }
+  }
+  sort.Slice(gids, func(i, j int) bool {
+    if count[gids[i]] != count[gids[j]] {
+      return count[gids[i]] > count[gids[j]]
+    }
+    return gids[i] < gids[j]
+  })
+  target := map[int64]int{}
+  for i, gid := range gids {
+    target[gid] = NShards / len(gids)
+    if i < NShards % len(gids) {
+      target[gid]++
+    }
+  }
+  for s, gid := range c.Shards {
+    if _, present := c.Groups[gid]; present && count[gid] > target[gid] {
+      count[gid]--
+      free = append(free, s)
+    }
+  }
+  for _, gid := range gids {
+    for count[gid] < target[gid] {
+      c.Shards[free[0]] = gid
+      free = free[1:]
+      count[gid]++
+    }
+  }
+}
+
+//
+// apply op to the configs. a Join of a group that is
+// already there, or a Leave of one that isn't, changes
+// nothing.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) perform(op Op) {
+  c := sm.next()
+  switch op.Kind {
+  case JoinOp:
+    if _, present := c.Groups[op.GID]; present {
+      return
+    }
+    c.Groups[op.GID] = op.Servers
+    rebalance(&c)
+  case LeaveOp:
+    if _, present := c.Groups[op.GID]; !present {
+      return
+    }
+    delete(c.Groups, op.GID)
+    rebalance(&c)
+  case MoveOp:
+    c.Shards[op.Shard] = op.GID
+  default:
+    return
+  }
+  sm.configs = append(sm.configs, c)
 }
 
+//
+// get op into the log, applying every instance before it,
+// and the one that holds it. returns false if the server
+// is killed first.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) agree(op Op) bool {
+  sm.seq++
+  op.Server = sm.id
+  op.Seq = sm.seq
+  for sm.dead == false {
+    seq := sm.applied
+    if decided, _ := sm.px.Status(seq); decided == false {
+      sm.px.Start(seq, op)
+    }
+    to := 10 * time.Millisecond
+    for sm.dead == false {
+      if decided, _ := sm.px.WaitDecided(seq, to); decided {
+        break
+      }
+      if to < time.Second {
+        to *= 2
+      }
+    }
+    if sm.dead {
+      break
+    }
+    _, vs := sm.px.Entries(seq)
+    mine := false
+    for _, v := range vs {
+      if o, ok := v.(Op); ok {
+        sm.perform(o)
+        mine = mine || (o.Server == op.Server && o.Seq == op.Seq)
+      }
+    }
+    sm.applied = seq + 1
+    sm.px.Done(seq)
+    if mine {
+      return true
+    }
+  }
+  return false
+}
 
 func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
   // Your code here.
-
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  if sm.agree(Op{Kind: JoinOp, GID: args.GID, Servers: args.Servers}) == false {
+    return errKilled
+  }
   return nil
 }
 
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
   // Your code here.
-
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  if sm.agree(Op{Kind: LeaveOp, GID: args.GID}) == false {
+    return errKilled
+  }
   return nil
 }
 
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
   // Your code here.
-
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  if sm.agree(Op{Kind: MoveOp, Shard: args.Shard, GID: args.GID}) == false {
+    return errKilled
+  }
   return nil
 }
 
+//
+// a Query goes through the log too, so that it sees every
+// config made before it was sent.
+//
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
   // Your code here.
-
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  if sm.agree(Op{Kind: QueryOp}) == false {
+    return errKilled
+  }
+  if args.Num < 0 || args.Num >= len(sm.configs) {
+    reply.Config = sm.configs[len(sm.configs) - 1]
+  } else {
+    reply.Config = sm.configs[args.Num]
+  }
   return nil
 }
 
@@ -66,21 +253,31 @@ func (sm *ShardMaster) Kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *ShardMaster {
+  return StartServerOn(nil, servers, me)
+}
+
+//
+// like StartServer(), but listens and sends RPCs with tr.
+//
+func StartServerOn(tr transport.Transport, servers []string, me int) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
+  sm.tr = tr
   sm.me = me
+  sm.id = sim.RandOf(tr).Int63()
 
   sm.configs = make([]Config, 1)
   sm.configs[0].Groups = map[int64][]string{}
 
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
+  faults.Register(rpcs, sm.tr)
 
-  sm.px = paxos.Make(servers, me, rpcs)
+  sm.px = paxos.MakeWithOptions(servers, me, rpcs,
+                                paxos.Options{Transport: tr})
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := transport.ListenRPC(sm.tr, servers[me], rpcs);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -93,21 +290,7 @@ func StartServer(servers []string, me int) *ShardMaster {
     for sm.dead == false {
       conn, err := sm.l.Accept()
       if err == nil && sm.dead == false {
-        if sm.unreliable && (rand.Int63() % 1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if sm.unreliable && (rand.Int63() % 1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          go rpcs.ServeConn(conn)
-        } else {
-          go rpcs.ServeConn(conn)
-        }
+        go rpcs.ServeConn(conn)
       } else if err == nil {
         conn.Close()
       }
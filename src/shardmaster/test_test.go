@@ -4,9 +4,10 @@ import "testing"
 import "runtime"
 import "strconv"
 import "os"
-// import "time"
+import "time"
 import "fmt"
 import "math/rand"
+import "sim"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -286,10 +287,9 @@ func TestUnreliable(t *testing.T) {
   }
   for i := 0; i < nservers; i++ {
     sma[i] = StartServer(kvh, i)
-    // don't turn on unreliable because the assignment
-    // doesn't require the shardmaster to detect duplicate
-    // client requests.
-    // sma[i].unreliable = true
+    // don't make it unreliable (faults.Unreliable) because
+    // the assignment doesn't require the shardmaster to
+    // detect duplicate client requests.
   }
 
   ck := MakeClerk(kvh)
@@ -359,3 +359,74 @@ func TestFreshQuery(t *testing.T) {
   fmt.Printf("  ... Passed\n")
   os.Remove(portx)
 }
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = "sm-" + strconv.Itoa(i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServerOn(s.Node(kvh[i]), kvh, i)
+  }
+  ck := MakeClerkOn(s.Node("ck"), kvh)
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerkOn(s.Node("ck-" + strconv.Itoa(i)), []string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Concurrent leave/join, simulated lossy network ...\n")
+
+  // server 0 is cut off, and every clerk's messages may be
+  // lost, so Joins and Leaves may be repeated.
+  s.SetNetwork(time.Millisecond, 20 * time.Millisecond, 0.1)
+  s.Partition([]string{kvh[0]})
+  rr := sim.RandOf(s.Node("test"))
+  const npara = 10
+  gids := make([]int64, npara)
+  var mu sim.Mutex
+  ndone := 0
+  for xi := 0; xi < npara; xi++ {
+    gids[xi] = int64(xi+1)
+    gid := gids[xi]
+    s.Go(func() {
+      cka[1 + rr.Intn(2)].Join(gid+1000, []string{"a", "b", "c"})
+      cka[1 + rr.Intn(2)].Join(gid, []string{"a", "b", "c"})
+      cka[1 + rr.Intn(2)].Leave(gid+1000)
+      mu.Lock()
+      ndone++
+      mu.Unlock()
+    })
+  }
+  for {
+    mu.Lock()
+    n := ndone
+    mu.Unlock()
+    if n == npara {
+      break
+    }
+    s.Sleep(100 * time.Millisecond)
+  }
+  check(t, gids, ck)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Cut-off server catches up ...\n")
+
+  s.Partition()
+  c1 := cka[1].Query(-1)
+  c0 := cka[0].Query(-1)
+  if c0.Num != c1.Num || c0.Shards != c1.Shards {
+    t.Fatalf("server 0 has config %v, server 1 has %v", c0, c1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,101 @@
+package sim
+
+import "time"
+import "sync"
+import "math/big"
+import "math/rand"
+import crand "crypto/rand"
+import "transport"
+
+//
+// where a server gets the time from, and starts its
+// goroutines with. code that sleeps, reads the time, or
+// runs something in the background should go through a
+// Clock, so that it can run under a Sim's scheduler.
+//
+type Clock interface {
+  Now() time.Time
+  Sleep(d time.Duration)
+  Go(f func())
+}
+
+// the wall clock, and plain goroutines.
+type Real struct{}
+
+func (Real) Now() time.Time { return time.Now() }
+func (Real) Sleep(d time.Duration) { time.Sleep(d) }
+func (Real) Go(f func()) { go f() }
+
+//
+// the clock that goes with transport tr: a simulated
+// network's virtual clock, or else the wall clock.
+//
+func ClockOf(tr transport.Transport) Clock {
+  if c, ok := tr.(Clock); ok {
+    return c
+  }
+  return Real{}
+}
+
+func Since(c Clock, t time.Time) time.Duration {
+  return c.Now().Sub(t)
+}
+
+//
+// where a server gets random numbers from. code that makes
+// random choices should use the Rand that goes with its
+// transport, so that under a Sim they follow the seed.
+//
+type Rand interface {
+  Int63() int64
+  Intn(n int) int
+  Perm(n int) []int
+}
+
+//
+// the random source that goes with transport tr: a Sim
+// node's own stream, derived from the seed and the node's
+// name, or else one stream seeded at random.
+//
+func RandOf(tr transport.Transport) Rand {
+  if r, ok := tr.(interface{ Rand() Rand }); ok {
+    return r.Rand()
+  }
+  return realRand
+}
+
+// a rand.Rand that can be shared between goroutines.
+type lockedRand struct {
+  mu sync.Mutex
+  r *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+  return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (lr *lockedRand) Int63() int64 {
+  lr.mu.Lock()
+  defer lr.mu.Unlock()
+  return lr.r.Int63()
+}
+
+func (lr *lockedRand) Intn(n int) int {
+  lr.mu.Lock()
+  defer lr.mu.Unlock()
+  return lr.r.Intn(n)
+}
+
+func (lr *lockedRand) Perm(n int) []int {
+  lr.mu.Lock()
+  defer lr.mu.Unlock()
+  return lr.r.Perm(n)
+}
+
+var realRand = newLockedRand(randomSeed())
+
+func randomSeed() int64 {
+  max := big.NewInt(int64(1) << 62)
+  x, _ := crand.Int(crand.Reader, max)
+  return x.Int64()
+}
@@ -0,0 +1,260 @@
+package sim
+
+//
+// The simulated network. Each node has a name, normally the
+// address it listens on, and sends with the Transport that
+// Node(name) returns. A message from one node to another is
+// delayed, or lost, according to that link's own random
+// stream, and is never delivered across a partition.
+//
+// A server that listens with ListenRPC() has its handlers
+// called directly, in the calling task, with the arguments
+// and reply copied as if they had crossed the wire, so that
+// the whole exchange stays on the scheduler. Calls to a plain
+// Listen()er go through an in-memory connection, which works,
+// but whose handlers run outside the scheduler and so must
+// not wait on the Sim.
+//
+
+import "time"
+import "net"
+import "net/rpc"
+import "encoding/gob"
+import "bytes"
+import "io"
+import "errors"
+import "hash/fnv"
+import "math/rand"
+
+var ErrLost = errors.New("sim: message lost")
+
+type link struct {
+  from string
+  to string
+}
+
+type linkState struct {
+  rand *rand.Rand
+}
+
+//
+// set how long messages take, and the chance that a
+// request or a reply is lost.
+//
+func (s *Sim) SetNetwork(minDelay time.Duration, maxDelay time.Duration,
+                         drop float64) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.minDelay = minDelay
+  s.maxDelay = maxDelay
+  s.drop = drop
+}
+
+//
+// split the nodes into partitions; nodes can only reach
+// nodes in the same one. nodes not named are together in
+// a partition of their own. Partition() with no arguments
+// heals the network.
+//
+func (s *Sim) Partition(groups ...[]string) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.parts = make(map[string]int)
+  for i, g := range groups {
+    for _, name := range g {
+      s.parts[name] = i + 1
+    }
+  }
+}
+
+//
+// the transport for node name.
+//
+func (s *Sim) Node(name string) *Node {
+  return &Node{s: s, name: name}
+}
+
+type Node struct {
+  s *Sim
+  name string
+}
+
+func (n *Node) Listen(addr string) (net.Listener, error) {
+  return n.s.net.Listen(addr)
+}
+
+//
+// listen on addr, and serve calls to it with rpcs.
+//
+func (n *Node) ListenRPC(addr string, rpcs *rpc.Server) (net.Listener, error) {
+  l, err := n.s.net.Listen(addr)
+  if err != nil {
+    return nil, err
+  }
+  n.s.mu.Lock()
+  n.s.servers[addr] = rpcs
+  n.s.mu.Unlock()
+  return &rpcListener{Listener: l, s: n.s, addr: addr, rpcs: rpcs}, nil
+}
+
+type rpcListener struct {
+  net.Listener
+  s *Sim
+  addr string
+  rpcs *rpc.Server
+}
+
+func (l *rpcListener) Close() error {
+  l.s.mu.Lock()
+  if l.s.servers[l.addr] == l.rpcs {
+    delete(l.s.servers, l.addr)
+  }
+  l.s.mu.Unlock()
+  return l.Listener.Close()
+}
+
+func (n *Node) Dial(addr string) (net.Conn, error) {
+  return n.s.net.Dial(addr)
+}
+
+func (n *Node) Now() time.Time { return n.s.Now() }
+func (n *Node) Sleep(d time.Duration) { n.s.Sleep(d) }
+func (n *Node) Go(f func()) { n.s.Go(f) }
+func (n *Node) Rand() Rand { return n.s.rand(n.name) }
+
+//
+// deliver a request from n to addr, and the reply back.
+//
+func (n *Node) Call(addr string, name string, args interface{}, reply interface{}) error {
+  s := n.s
+  d1, lost1 := s.fate(n.name, addr)
+  s.Sleep(d1)
+  if lost1 || !s.connected(n.name, addr) {
+    return ErrLost
+  }
+
+  s.mu.Lock()
+  rpcs := s.servers[addr]
+  s.mu.Unlock()
+  var err error
+  if rpcs != nil {
+    err = callDirect(rpcs, name, args, reply)
+  } else {
+    err = s.net.Call(addr, name, args, reply)
+  }
+
+  d2, lost2 := s.fate(addr, n.name)
+  s.Sleep(d2)
+  if lost2 || !s.connected(addr, n.name) {
+    return ErrLost
+  }
+  return err
+}
+
+//
+// node name's own random stream, derived from the seed
+// and the name, like a link's.
+//
+func (s *Sim) rand(name string) Rand {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  r := s.rands[name]
+  if r == nil {
+    h := fnv.New64a()
+    h.Write([]byte{0})
+    h.Write([]byte(name))
+    r = newLockedRand(s.seed ^ int64(h.Sum64()))
+    s.rands[name] = r
+  }
+  return r
+}
+
+//
+// the delay and loss of the next message from one node to
+// another, drawn from that link's own stream.
+//
+func (s *Sim) fate(from string, to string) (time.Duration, bool) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  l := link{from, to}
+  ls := s.links[l]
+  if ls == nil {
+    h := fnv.New64a()
+    h.Write([]byte(from))
+    h.Write([]byte{0})
+    h.Write([]byte(to))
+    ls = &linkState{rand: rand.New(rand.NewSource(s.seed ^ int64(h.Sum64())))}
+    s.links[l] = ls
+  }
+
+  d := s.minDelay
+  if s.maxDelay > s.minDelay {
+    d += time.Duration(ls.rand.Int63n(int64(s.maxDelay - s.minDelay)))
+  }
+  lost := ls.rand.Float64() < s.drop
+  return d, lost
+}
+
+func (s *Sim) connected(from string, to string) bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.parts[from] == s.parts[to]
+}
+
+//
+// call handler name of rpcs in this goroutine, with a
+// copy of args, and copy what it replies into reply.
+//
+func callDirect(rpcs *rpc.Server, name string, args interface{}, reply interface{}) error {
+  c := &callCodec{name: name, reply: reply}
+  if err := gob.NewEncoder(&c.args).Encode(args); err != nil {
+    return err
+  }
+  rpcs.ServeRequest(c)
+  return c.err
+}
+
+// a net/rpc server codec for a single call.
+type callCodec struct {
+  name string
+  args bytes.Buffer
+  reply interface{}
+  read bool
+  err error
+}
+
+func (c *callCodec) ReadRequestHeader(r *rpc.Request) error {
+  if c.read {
+    return io.EOF
+  }
+  c.read = true
+  r.ServiceMethod = c.name
+  return nil
+}
+
+func (c *callCodec) ReadRequestBody(body interface{}) error {
+  if body == nil {
+    return nil
+  }
+  return gob.NewDecoder(&c.args).Decode(body)
+}
+
+func (c *callCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+  if r.Error != "" {
+    c.err = rpc.ServerError(r.Error)
+    return nil
+  }
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+    c.err = err
+    return err
+  }
+  c.err = gob.NewDecoder(&buf).Decode(c.reply)
+  return nil
+}
+
+func (c *callCodec) Close() error {
+  return nil
+}
@@ -0,0 +1,404 @@
+package sim
+
+//
+// The scheduler.
+//
+// The goroutines of a simulation are tasks: the one that
+// called New(), and every one started with Go(). Only one
+// task runs at a time. A task runs until it blocks -- in
+// Sleep(), on a Mutex or a Cond -- or returns, and then
+// the scheduler picks the next from the runnable ones with
+// its own stream from the seed. When none is runnable, every
+// task is waiting, so the clock jumps to the next timer and
+// wakes whoever set it.
+//
+// So tasks must only block in ways the scheduler can see:
+// on the Sim's clock, a Mutex or a Cond, or a Call() over
+// the simulated network, not on a channel or a sync.Mutex
+// that another task might hold for a while. Goroutines
+// that aren't tasks (an accept loop, say) can use Mutex and
+// Cond too; for them they work like their sync
+// counterparts, and a Cond times out on the wall clock.
+//
+
+import "sync"
+import "sync/atomic"
+import "runtime"
+import "strconv"
+import "bytes"
+import "time"
+import "container/heap"
+
+type task struct {
+  s *Sim
+  g int64 // goroutine id, once running
+  gate chan struct{} // the task may run when it receives
+  gen int64 // bumped on every wakeup; see wake()
+  blocked bool // waiting, not in the run queue
+}
+
+//
+// someone waiting for t to be woken with generation gen.
+// once t has been woken, by this or anything else, gen is
+// stale and the wakeup does nothing.
+//
+type waiter struct {
+  t *task
+  gen int64
+}
+
+//
+// the tasks of every Sim, by goroutine id. ntasks lets
+// code that runs without a Sim skip the lookup.
+//
+var registry struct {
+  mu sync.Mutex
+  tasks map[int64]*task
+}
+
+var ntasks int32
+
+func goid() int64 {
+  var buf [64]byte
+  b := buf[:runtime.Stack(buf[:], false)]
+  b = bytes.TrimPrefix(b, []byte("goroutine "))
+  if i := bytes.IndexByte(b, ' '); i >= 0 {
+    b = b[:i]
+  }
+  id, _ := strconv.ParseInt(string(b), 10, 64)
+  return id
+}
+
+func register(t *task) {
+  t.g = goid()
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  if registry.tasks == nil {
+    registry.tasks = make(map[int64]*task)
+  }
+  registry.tasks[t.g] = t
+  atomic.AddInt32(&ntasks, 1)
+}
+
+func unregister(t *task) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  if t.g != 0 && registry.tasks[t.g] == t {
+    delete(registry.tasks, t.g)
+    atomic.AddInt32(&ntasks, -1)
+  }
+}
+
+// the task this goroutine is, or nil.
+func current() *task {
+  if atomic.LoadInt32(&ntasks) == 0 {
+    return nil
+  }
+  g := goid()
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  return registry.tasks[g]
+}
+
+//
+// run f as a new task.
+//
+func (s *Sim) Go(f func()) {
+  t := &task{s: s, gate: make(chan struct{}, 1)}
+  s.mu.Lock()
+  s.tasks[t] = true
+  s.runq = append(s.runq, t)
+  s.poke()
+  s.mu.Unlock()
+
+  go func() {
+    <-t.gate
+    register(t)
+    defer s.exit(t)
+    f()
+  }()
+}
+
+func (s *Sim) exit(t *task) {
+  unregister(t)
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  delete(s.tasks, t)
+  if s.cur == t {
+    s.dispatch()
+  }
+}
+
+//
+// hand the processor to the next runnable task, first
+// moving the clock on if none is. leaves no task running
+// if the simulation has stopped, or if every task waits
+// for something other than a timer.
+// caller must hold s.mu.
+//
+func (s *Sim) dispatch() {
+  s.cur = nil
+  if s.stopped {
+    return
+  }
+  for len(s.runq) == 0 {
+    if !s.advance() {
+      return
+    }
+  }
+  i := s.sched.Intn(len(s.runq))
+  t := s.runq[i]
+  copy(s.runq[i:], s.runq[i+1:])
+  s.runq = s.runq[:len(s.runq) - 1]
+  s.cur = t
+  t.gate <- struct{}{}
+}
+
+//
+// if no task is running, start one. for wakeups from
+// goroutines that aren't tasks.
+// caller must hold s.mu.
+//
+func (s *Sim) poke() {
+  if s.cur == nil {
+    s.dispatch()
+  }
+}
+
+//
+// move the clock to the next timer that still has someone
+// to wake, and fire every timer due then, in the order they
+// were set. false if there are none.
+// caller must hold s.mu.
+//
+func (s *Sim) advance() bool {
+  for len(s.timers) > 0 {
+    at := s.timers[0].at
+    fired := false
+    for len(s.timers) > 0 && s.timers[0].at == at {
+      tm := heap.Pop(&s.timers).(*timer)
+      if tm.ch != nil {
+        s.now = at
+        tm.ch <- Epoch.Add(at)
+        fired = true
+      } else if tm.t.gen == tm.gen {
+        s.now = at
+        s.wake(tm.t, tm.gen)
+        fired = true
+      }
+    }
+    if fired {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// set a timer to wake t, as of generation gen, after d.
+// caller must hold s.mu.
+//
+func (s *Sim) addTimer(d time.Duration, t *task, gen int64) {
+  if d < 0 {
+    d = 0
+  }
+  heap.Push(&s.timers, &timer{at: s.now + d, seq: s.ntimers, t: t, gen: gen})
+  s.ntimers++
+}
+
+//
+// make t runnable, unless it has been woken since gen.
+// caller must hold s.mu.
+//
+func (s *Sim) wake(t *task, gen int64) bool {
+  if t.gen != gen {
+    return false
+  }
+  t.gen++
+  if t.blocked {
+    t.blocked = false
+    s.runq = append(s.runq, t)
+  }
+  return true
+}
+
+//
+// wake t, from any goroutine.
+//
+func (s *Sim) ready(t *task, gen int64) bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  ok := s.wake(t, gen)
+  s.poke()
+  return ok
+}
+
+//
+// t's current generation, for someone about to wait.
+//
+func (s *Sim) gen(t *task) int64 {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return t.gen
+}
+
+//
+// block t until it is woken, unless it already has been
+// since gen, and let another task run meanwhile.
+// caller must hold s.mu, which park() releases.
+//
+func (s *Sim) park(t *task, gen int64) {
+  if t.gen != gen {
+    s.mu.Unlock()
+    return
+  }
+  t.blocked = true
+  s.dispatch()
+  s.mu.Unlock()
+  <-t.gate
+}
+
+//
+// let the other runnable tasks go first.
+// caller must hold s.mu, which yield() releases.
+//
+func (s *Sim) yield(t *task) {
+  s.runq = append(s.runq, t)
+  s.dispatch()
+  s.mu.Unlock()
+  <-t.gate
+}
+
+//
+// a mutual exclusion lock that a task can wait for without
+// holding up the simulation. the zero value is unlocked.
+//
+type Mutex struct {
+  mu sync.Mutex
+  wmu sync.Mutex // protects waiters
+  waiters []waiter
+}
+
+func (m *Mutex) Lock() {
+  if m.mu.TryLock() {
+    return
+  }
+  t := current()
+  if t == nil {
+    m.mu.Lock()
+    return
+  }
+  for {
+    m.wmu.Lock()
+    if m.mu.TryLock() {
+      m.wmu.Unlock()
+      return
+    }
+    gen := t.s.gen(t)
+    m.waiters = append(m.waiters, waiter{t, gen})
+    m.wmu.Unlock()
+
+    t.s.mu.Lock()
+    t.s.park(t, gen)
+  }
+}
+
+func (m *Mutex) Unlock() {
+  m.wmu.Lock()
+  m.mu.Unlock()
+  for len(m.waiters) > 0 {
+    w := m.waiters[0]
+    m.waiters = m.waiters[1:]
+    if w.t.s.ready(w.t, w.gen) {
+      break
+    }
+  }
+  m.wmu.Unlock()
+}
+
+//
+// a condition variable on a Mutex, like sync.Cond, but
+// with a timeout. the caller must hold L for every method.
+//
+type Cond struct {
+  L *Mutex
+  waiters []waiter
+  ch chan struct{} // for waiters that aren't tasks; closed by Broadcast()
+}
+
+func NewCond(l *Mutex) *Cond {
+  return &Cond{L: l}
+}
+
+func (c *Cond) Wait() {
+  c.wait(-1)
+}
+
+//
+// like Wait(), but give up after d on the waiter's clock.
+//
+func (c *Cond) WaitFor(d time.Duration) {
+  if d < 0 {
+    d = 0
+  }
+  c.wait(d)
+}
+
+// d < 0 means no timeout.
+func (c *Cond) wait(d time.Duration) {
+  t := current()
+  if t == nil {
+    if c.ch == nil {
+      c.ch = make(chan struct{})
+    }
+    ch := c.ch
+    c.L.Unlock()
+    if d < 0 {
+      <-ch
+    } else {
+      select {
+      case <-ch:
+      case <-time.After(d):
+      }
+    }
+    c.L.Lock()
+    return
+  }
+
+  s := t.s
+  s.mu.Lock()
+  gen := t.gen
+  if d >= 0 {
+    s.addTimer(d, t, gen)
+  }
+  s.mu.Unlock()
+  c.waiters = append(c.waiters, waiter{t, gen})
+  c.L.Unlock()
+
+  s.mu.Lock()
+  s.park(t, gen)
+  c.L.Lock()
+
+  // if the timer woke us, we are still on the list.
+  for i, w := range c.waiters {
+    if w == (waiter{t, gen}) {
+      c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+      break
+    }
+  }
+}
+
+//
+// wake everyone in Wait().
+//
+func (c *Cond) Broadcast() {
+  ws := c.waiters
+  c.waiters = nil
+  if c.ch != nil {
+    close(c.ch)
+    c.ch = nil
+  }
+  for _, w := range ws {
+    w.t.s.ready(w.t, w.gen)
+  }
+}
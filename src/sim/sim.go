@@ -0,0 +1,191 @@
+package sim
+
+//
+// Deterministic simulation.
+//
+// A Sim is a virtual clock, a scheduler, and a simulated
+// network. Servers and clerks that are given one of its nodes
+// as their transport (see Node()) take their time from the
+// virtual clock, start their goroutines with its Go(), and
+// talk over the simulated network:
+//
+//   s := sim.New(sim.Seed(t))
+//   defer s.Stop()
+//   px := paxos.MakeWithOptions(peers, i, nil,
+//                               paxos.Options{Transport: s.Node(peers[i])})
+//
+// The goroutine that calls New(), and every goroutine started
+// with Go(), is a task, and only one task runs at a time; see
+// sched.go. Virtual time only moves when every task is
+// blocked, and then jumps straight to the next timer, so a
+// test spends no real time waiting out timeouts.
+//
+// Every choice is drawn from the seed: which runnable task
+// goes next, how long a message takes and whether it is lost
+// (from a per-link stream, so the n'th message on a link
+// always meets the same fate), and the random choices servers
+// and clerks make with their node's stream (see RandOf()).
+// Timers that are due at the same moment fire in the order
+// they were set. So a run is a function of its seed: running
+// a failing test again with SIMSEED set to the seed it logged
+// replays it exactly, as long as the tasks only block in ways
+// the scheduler can see, and don't let Go's random map order
+// decide what they do.
+//
+
+import "time"
+import "sync"
+import "container/heap"
+import "os"
+import "strconv"
+import "hash/fnv"
+import "math/rand"
+import "net/rpc"
+import "transport"
+
+// the virtual clock starts here.
+var Epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Sim struct {
+  mu sync.Mutex
+  seed int64
+  now time.Duration // since Epoch
+  timers timerHeap
+  ntimers int64 // timers ever set, to order simultaneous ones
+  stopped bool
+
+  sched *rand.Rand // picks the next task to run
+  tasks map[*task]bool
+  cur *task // the running task, if any
+  runq []*task // runnable tasks, in the order they became so
+
+  net *transport.Mem
+  servers map[string]*rpc.Server // see Node.ListenRPC()
+  links map[link]*linkState
+  rands map[string]*lockedRand
+  parts map[string]int // node -> partition; absent means 0
+  minDelay time.Duration
+  maxDelay time.Duration
+  drop float64 // chance that a request, or a reply, is lost
+}
+
+//
+// a timer wakes task t, if it hasn't been woken since gen,
+// or else sends on ch.
+//
+type timer struct {
+  at time.Duration
+  seq int64
+  t *task
+  gen int64
+  ch chan time.Time
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+  if h[i].at != h[j].at {
+    return h[i].at < h[j].at
+  }
+  return h[i].seq < h[j].seq
+}
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(*timer)) }
+func (h *timerHeap) Pop() interface{} {
+  old := *h
+  t := old[len(old) - 1]
+  *h = old[:len(old) - 1]
+  return t
+}
+
+//
+// the seed for a simulated test: $SIMSEED if set, or else
+// a fresh one. either way it is logged with t.Logf(), so
+// that a failure can be retried with the same seed.
+//
+func Seed(t interface{ Logf(string, ...interface{}) }) int64 {
+  seed := time.Now().UnixNano()
+  if s := os.Getenv("SIMSEED"); s != "" {
+    if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+      seed = n
+    }
+  }
+  t.Logf("SIMSEED=%v", seed)
+  return seed
+}
+
+//
+// start a simulation, with the calling goroutine as its
+// first task. messages take between 1 and 10 milliseconds,
+// and none are lost, until SetNetwork() says otherwise.
+//
+func New(seed int64) *Sim {
+  s := &Sim{seed: seed}
+  h := fnv.New64a()
+  h.Write([]byte("sched"))
+  s.sched = rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+  s.tasks = make(map[*task]bool)
+  s.net = transport.NewMem()
+  s.servers = make(map[string]*rpc.Server)
+  s.links = make(map[link]*linkState)
+  s.rands = make(map[string]*lockedRand)
+  s.parts = make(map[string]int)
+  s.minDelay = time.Millisecond
+  s.maxDelay = 10 * time.Millisecond
+
+  t := &task{s: s, gate: make(chan struct{}, 1)}
+  register(t)
+  s.tasks[t] = true
+  s.cur = t
+  return s
+}
+
+//
+// stop the simulation. tasks still waiting stay waiting,
+// and the caller goes on as an ordinary goroutine.
+//
+func (s *Sim) Stop() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.stopped = true
+  s.cur = nil
+  for t := range s.tasks {
+    unregister(t)
+  }
+  s.tasks = make(map[*task]bool)
+}
+
+func (s *Sim) Now() time.Time {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return Epoch.Add(s.now)
+}
+
+//
+// wait for d of virtual time. Sleep(0) lets any other
+// runnable tasks go first.
+//
+func (s *Sim) Sleep(d time.Duration) {
+  t := current()
+  s.mu.Lock()
+  if t == nil || t.s != s {
+    // not one of ours; wait on a channel for the clock.
+    if d < 0 {
+      d = 0
+    }
+    ch := make(chan time.Time, 1)
+    heap.Push(&s.timers, &timer{at: s.now + d, seq: s.ntimers, ch: ch})
+    s.ntimers++
+    s.poke()
+    s.mu.Unlock()
+    <-ch
+    return
+  }
+  if d <= 0 {
+    s.yield(t)
+    return
+  }
+  s.addTimer(d, t, t.gen)
+  s.park(t, t.gen)
+}
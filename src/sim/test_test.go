@@ -0,0 +1,262 @@
+package sim
+
+import "testing"
+import "net/rpc"
+import "time"
+import "fmt"
+
+type Echo struct{}
+
+func (e *Echo) Echo(args *string, reply *string) error {
+  *reply = *args
+  return nil
+}
+
+func serve(s *Sim, addr string) {
+  rpcs := rpc.NewServer()
+  rpcs.Register(&Echo{})
+  l, _ := s.Node(addr).ListenRPC(addr, rpcs)
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go rpcs.ServeConn(conn)
+    }
+  }()
+}
+
+func TestClock(t *testing.T) {
+  fmt.Printf("Test: Virtual clock ...\n")
+
+  s := New(Seed(t))
+  defer s.Stop()
+
+  t0 := time.Now()
+  v0 := s.Now()
+  s.Sleep(time.Hour)
+  if d := s.Now().Sub(v0); d != time.Hour {
+    t.Fatalf("Sleep(1h) took %v of virtual time", d)
+  }
+  if time.Since(t0) > 5 * time.Second {
+    t.Fatalf("Sleep(1h) took %v of real time", time.Since(t0))
+  }
+
+  // timers fire in order of deadline.
+  var mu Mutex
+  var fired []int
+  for _, d := range []int{30, 10, 20, 0} {
+    d := d
+    s.Go(func() {
+      s.Sleep(time.Duration(d) * time.Millisecond)
+      mu.Lock()
+      fired = append(fired, d)
+      mu.Unlock()
+    })
+  }
+  s.Sleep(time.Second)
+  mu.Lock()
+  if fmt.Sprint(fired) != "[0 10 20 30]" {
+    t.Fatalf("timers fired in order %v", fired)
+  }
+  mu.Unlock()
+
+  // the clock stands still while a task runs.
+  v1 := s.Now()
+  s.Go(func() { s.Sleep(time.Millisecond) })
+  time.Sleep(50 * time.Millisecond)
+  if d := s.Now().Sub(v1); d != 0 {
+    t.Fatalf("clock moved %v while a task ran", d)
+  }
+
+  // a Cond wakes on Broadcast(), or when its wait times out.
+  c := NewCond(&mu)
+  ready := false
+  s.Go(func() {
+    s.Sleep(time.Second)
+    mu.Lock()
+    ready = true
+    c.Broadcast()
+    mu.Unlock()
+  })
+  mu.Lock()
+  v2 := s.Now()
+  for ready == false {
+    c.WaitFor(time.Hour)
+  }
+  if d := s.Now().Sub(v2); d != time.Second {
+    t.Fatalf("Broadcast() after 1s woke a waiter after %v", d)
+  }
+  c.WaitFor(time.Minute)
+  if d := s.Now().Sub(v2); d != time.Second + time.Minute {
+    t.Fatalf("WaitFor(1m) returned after %v", d - time.Second)
+  }
+  mu.Unlock()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSchedule(t *testing.T) {
+  fmt.Printf("Test: Same seed, same schedule ...\n")
+
+  trace := func(seed int64) string {
+    s := New(seed)
+    defer s.Stop()
+    var mu Mutex
+    var out []string
+    for i := 0; i < 5; i++ {
+      i := i
+      s.Go(func() {
+        for j := 0; j < 20; j++ {
+          mu.Lock()
+          out = append(out, fmt.Sprintf("%v@%v", i, s.Now().Sub(Epoch)))
+          mu.Unlock()
+          s.Sleep(time.Duration(j % 3) * time.Millisecond)
+        }
+      })
+    }
+    s.Sleep(time.Second)
+    mu.Lock()
+    defer mu.Unlock()
+    if len(out) != 100 {
+      t.Fatalf("tasks ran %v steps, expected 100", len(out))
+    }
+    return fmt.Sprint(out)
+  }
+
+  seed := Seed(t)
+  t1 := trace(seed)
+  t2 := trace(seed)
+  t3 := trace(seed + 1)
+  if t1 != t2 {
+    t.Fatalf("same seed, different schedules:\n%v\n%v", t1, t2)
+  }
+  if t1 == t3 {
+    t.Fatalf("different seeds gave the same schedule")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestReplay(t *testing.T) {
+  fmt.Printf("Test: Same seed, same network ...\n")
+
+  fates := func(seed int64, drop float64) []string {
+    s := New(seed)
+    defer s.Stop()
+    s.SetNetwork(time.Millisecond, 50 * time.Millisecond, drop)
+    var out []string
+    for i := 0; i < 100; i++ {
+      d, lost := s.fate("a", "b")
+      out = append(out, fmt.Sprintf("%v/%v", d, lost))
+      // traffic on other links must not disturb a->b.
+      if i % 3 == 0 {
+        s.fate("b", "a")
+        s.fate("c", "b")
+      }
+    }
+    return out
+  }
+
+  seed := Seed(t)
+  f1 := fates(seed, 0.3)
+  f2 := fates(seed, 0.3)
+  f3 := fates(seed + 1, 0.3)
+  same3 := true
+  for i := range f1 {
+    if f1[i] != f2[i] {
+      t.Fatalf("message %v: %v then %v with the same seed", i, f1[i], f2[i])
+    }
+    if f1[i] != f3[i] {
+      same3 = false
+    }
+  }
+  if same3 {
+    t.Fatalf("different seeds gave the same network")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRand(t *testing.T) {
+  fmt.Printf("Test: Same seed, same random choices ...\n")
+
+  draws := func(seed int64, name string) []int64 {
+    s := New(seed)
+    defer s.Stop()
+    // other nodes' draws must not disturb name's.
+    RandOf(s.Node("other")).Int63()
+    var out []int64
+    for i := 0; i < 20; i++ {
+      out = append(out, RandOf(s.Node(name)).Int63())
+    }
+    return out
+  }
+
+  seed := Seed(t)
+  r1 := draws(seed, "a")
+  r2 := draws(seed, "a")
+  r3 := draws(seed, "b")
+  r4 := draws(seed + 1, "a")
+  for i := range r1 {
+    if r1[i] != r2[i] {
+      t.Fatalf("draw %v: %v then %v with the same seed", i, r1[i], r2[i])
+    }
+  }
+  if fmt.Sprint(r1) == fmt.Sprint(r3) {
+    t.Fatalf("different nodes drew the same numbers")
+  }
+  if fmt.Sprint(r1) == fmt.Sprint(r4) {
+    t.Fatalf("different seeds drew the same numbers")
+  }
+  if RandOf(nil) == nil {
+    t.Fatalf("no random source without a Sim")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestNetwork(t *testing.T) {
+  fmt.Printf("Test: Simulated network ...\n")
+
+  s := New(Seed(t))
+  defer s.Stop()
+  serve(s, "server")
+  ck := s.Node("client")
+
+  args := "hello"
+  var reply string
+  v0 := s.Now()
+  if err := ck.Call("server", "Echo.Echo", &args, &reply); err != nil {
+    t.Fatalf("Call(): %v", err)
+  }
+  if reply != args {
+    t.Fatalf("wrong reply %v", reply)
+  }
+  if d := s.Now().Sub(v0); d < 2 * time.Millisecond {
+    t.Fatalf("round trip took only %v", d)
+  }
+
+  s.Partition([]string{"server"}, []string{"client"})
+  if err := ck.Call("server", "Echo.Echo", &args, &reply); err != ErrLost {
+    t.Fatalf("Call() across a partition returned %v", err)
+  }
+  s.Partition()
+  if err := ck.Call("server", "Echo.Echo", &args, &reply); err != nil {
+    t.Fatalf("Call() after healing: %v", err)
+  }
+
+  s.SetNetwork(time.Millisecond, time.Millisecond, 0.5)
+  nlost := 0
+  for i := 0; i < 100; i++ {
+    if ck.Call("server", "Echo.Echo", &args, &reply) == ErrLost {
+      nlost++
+    }
+  }
+  if nlost < 50 || nlost > 95 {
+    t.Fatalf("%v of 100 calls lost with drop 0.5", nlost)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,144 @@
+package transport
+
+//
+// An in-process network. Listeners and connections exist
+// only in memory, so tests that use a Mem need no socket
+// files and can run side by side without clashing.
+//
+
+import "net"
+import "io"
+import "sync"
+import "time"
+import "errors"
+
+var ErrRefused = errors.New("transport: connection refused")
+
+type Mem struct {
+  mu sync.Mutex
+  listeners map[string]*memListener
+}
+
+func NewMem() *Mem {
+  m := &Mem{}
+  m.listeners = make(map[string]*memListener)
+  return m
+}
+
+func (m *Mem) Listen(addr string) (net.Listener, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if old, present := m.listeners[addr]; present {
+    // like removing a stale unix socket file.
+    old.shut()
+  }
+  l := &memListener{m: m, addr: addr}
+  l.conns = make(chan net.Conn)
+  l.done = make(chan struct{})
+  m.listeners[addr] = l
+  return l, nil
+}
+
+func (m *Mem) Dial(addr string) (net.Conn, error) {
+  m.mu.Lock()
+  l := m.listeners[addr]
+  m.mu.Unlock()
+  if l == nil {
+    return nil, ErrRefused
+  }
+
+  client, server := memPipe(addr)
+  select {
+  case l.conns <- server:
+    return client, nil
+  case <-l.done:
+    return nil, ErrRefused
+  }
+}
+
+func (m *Mem) Call(addr string, name string, args interface{}, reply interface{}) error {
+  return dialCall(m, addr, name, args, reply)
+}
+
+type memListener struct {
+  m *Mem
+  addr string
+  conns chan net.Conn
+  done chan struct{}
+  once sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+  select {
+  case c := <-l.conns:
+    return c, nil
+  case <-l.done:
+    return nil, errors.New("transport: listener closed")
+  }
+}
+
+func (l *memListener) shut() {
+  l.once.Do(func() { close(l.done) })
+}
+
+func (l *memListener) Close() error {
+  l.m.mu.Lock()
+  if l.m.listeners[l.addr] == l {
+    delete(l.m.listeners, l.addr)
+  }
+  l.m.mu.Unlock()
+  l.shut()
+  return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+  return memAddr(l.addr)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string { return string(a) }
+
+//
+// one end of an in-memory connection. unlike net.Pipe(),
+// each direction can be closed on its own, so CloseWrite()
+// works as it does for sockets.
+//
+type memConn struct {
+  r *io.PipeReader
+  w *io.PipeWriter
+  addr string
+}
+
+func memPipe(addr string) (*memConn, *memConn) {
+  r1, w1 := io.Pipe()
+  r2, w2 := io.Pipe()
+  return &memConn{r: r1, w: w2, addr: addr}, &memConn{r: r2, w: w1, addr: addr}
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+  return c.r.Read(p)
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+  return c.w.Write(p)
+}
+
+func (c *memConn) CloseWrite() error {
+  return c.w.Close()
+}
+
+func (c *memConn) Close() error {
+  c.w.Close()
+  return c.r.Close()
+}
+
+func (c *memConn) LocalAddr() net.Addr { return memAddr(c.addr) }
+func (c *memConn) RemoteAddr() net.Addr { return memAddr(c.addr) }
+
+// deadlines are not supported.
+func (c *memConn) SetDeadline(t time.Time) error { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,224 @@
+package transport
+
+//
+// A connection pool. A Pool wraps another Transport and keeps
+// one net/rpc client open per server address, instead of
+// dialing a new connection for every RPC. Every call has a
+// deadline; a call that misses it is abandoned, but the
+// connection stays open for the calls that share it. A call
+// that fails because the connection broke closes it, and the
+// next call to that address dials a fresh one.
+//
+// At most limit calls to one address may be outstanding at
+// once; further calls wait for a slot until their deadline.
+//
+// A Pool is itself a Transport, so it can be passed anywhere
+// a Transport is expected:
+//
+//   pool := transport.NewPool(transport.Unix{}, time.Second, 16)
+//   px := paxos.MakeWithOptions(peers, me, nil,
+//                               paxos.Options{Transport: pool})
+//
+// TCP{} and Unix{} send every call through a shared Pool of
+// their own.
+//
+
+import "net"
+import "net/rpc"
+import "io"
+import "reflect"
+import "sync"
+import "time"
+import "errors"
+
+var ErrTimeout = errors.New("transport: call timed out")
+
+// the deadline and outstanding-call limit for TCP{}'s Pool.
+const DefaultTimeout = 10 * time.Second
+const DefaultLimit = 256
+
+type Pool struct {
+  tr Transport
+  timeout time.Duration
+  limit int
+
+  mu sync.Mutex
+  conns map[string]*pooled
+  closed bool
+}
+
+type pooled struct {
+  conn net.Conn
+  c *rpc.Client
+  slots chan struct{} // one token per outstanding call
+  ready chan struct{} // closed once dialing is over
+  err error // why dialing failed
+}
+
+//
+// make a pool that dials with tr (nil means Default), gives
+// every call timeout to complete, and allows limit outstanding
+// calls per address (0 means no limit).
+//
+func NewPool(tr Transport, timeout time.Duration, limit int) *Pool {
+  if tr == nil {
+    tr = Default
+  }
+  p := &Pool{tr: tr, timeout: timeout, limit: limit}
+  p.conns = make(map[string]*pooled)
+  return p
+}
+
+func (p *Pool) Listen(addr string) (net.Listener, error) {
+  return p.tr.Listen(addr)
+}
+
+func (p *Pool) Dial(addr string) (net.Conn, error) {
+  return p.tr.Dial(addr)
+}
+
+func (p *Pool) Call(addr string, name string, args interface{}, reply interface{}) error {
+  deadline := time.NewTimer(p.timeout)
+  defer deadline.Stop()
+
+  pc, err := p.get(addr, deadline.C)
+  if err != nil {
+    return err
+  }
+
+  if pc.slots != nil {
+    select {
+    case pc.slots <- struct{}{}:
+      defer func() { <-pc.slots }()
+    case <-deadline.C:
+      return ErrTimeout
+    }
+  }
+
+  // net/rpc fills in the reply whenever it arrives, perhaps
+  // after we've given up, so decode into a private one.
+  r := reflect.New(reflect.TypeOf(reply).Elem())
+  call := pc.c.Go(name, args, r.Interface(), make(chan *rpc.Call, 1))
+  select {
+  case <-call.Done:
+    err = call.Error
+    if err == nil {
+      reflect.ValueOf(reply).Elem().Set(r.Elem())
+    } else if broken(err) {
+      p.drop(addr, pc)
+    }
+  case <-deadline.C:
+    // just this call; the connection may be fine.
+    err = ErrTimeout
+  }
+  return err
+}
+
+//
+// did err come from the connection, rather than the call?
+//
+func broken(err error) bool {
+  switch err {
+  case rpc.ErrShutdown, io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+    return true
+  }
+  _, ok := err.(net.Error)
+  return ok
+}
+
+//
+// the open connection to addr, dialing one if need be.
+// only one dial is made at a time; every caller, the
+// first included, waits for it until its deadline.
+//
+func (p *Pool) get(addr string, deadline <-chan time.Time) (*pooled, error) {
+  p.mu.Lock()
+  if p.closed {
+    p.mu.Unlock()
+    return nil, rpc.ErrShutdown
+  }
+  pc, present := p.conns[addr]
+  if present && p.moved(addr, pc) {
+    delete(p.conns, addr)
+    pc.c.Close()
+    present = false
+  }
+  if !present {
+    pc = &pooled{ready: make(chan struct{})}
+    if p.limit > 0 {
+      pc.slots = make(chan struct{}, p.limit)
+    }
+    p.conns[addr] = pc
+    go p.dial(addr, pc)
+  }
+  p.mu.Unlock()
+
+  select {
+  case <-pc.ready:
+  case <-deadline:
+    return nil, ErrTimeout
+  }
+  if pc.err != nil {
+    return nil, pc.err
+  }
+  return pc, nil
+}
+
+func (p *Pool) dial(addr string, pc *pooled) {
+  conn, err := p.tr.Dial(addr)
+  if err == nil {
+    pc.conn = conn
+    pc.c = rpc.NewClient(conn)
+  } else {
+    pc.err = err
+    p.drop(addr, pc)
+  }
+  close(pc.ready)
+}
+
+//
+// has addr come to name a different server than the one
+// pc was dialed to? see unix.go. caller must hold p.mu.
+//
+func (p *Pool) moved(addr string, pc *pooled) bool {
+  select {
+  case <-pc.ready:
+  default:
+    return false // still dialing
+  }
+  m, ok := p.tr.(interface{ moved(string, net.Conn) bool })
+  return ok && pc.conn != nil && m.moved(addr, pc.conn)
+}
+
+//
+// forget the connection pc to addr, if it is still the
+// current one, and close it.
+//
+func (p *Pool) drop(addr string, pc *pooled) {
+  p.mu.Lock()
+  if p.conns[addr] == pc {
+    delete(p.conns, addr)
+  }
+  p.mu.Unlock()
+  if pc.c != nil {
+    pc.c.Close()
+  }
+}
+
+//
+// close every pooled connection. later calls fail.
+//
+func (p *Pool) Close() {
+  p.mu.Lock()
+  conns := p.conns
+  p.conns = make(map[string]*pooled)
+  p.closed = true
+  p.mu.Unlock()
+
+  for _, pc := range conns {
+    <-pc.ready
+    if pc.c != nil {
+      pc.c.Close()
+    }
+  }
+}
@@ -0,0 +1,360 @@
+package transport
+
+import "testing"
+import "net"
+import "net/rpc"
+import "strconv"
+import "os"
+import "fmt"
+import "sync"
+import "time"
+
+type Echo struct{}
+
+func (e *Echo) Echo(args *string, reply *string) error {
+  *reply = *args
+  return nil
+}
+
+func (e *Echo) Sleep(args *time.Duration, reply *bool) error {
+  time.Sleep(*args)
+  *reply = true
+  return nil
+}
+
+func port(tag string) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "tr-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag
+  return s
+}
+
+//
+// serve an Echo on l. if deaf, replies are discarded.
+//
+func serve(l net.Listener, deaf bool) {
+  rpcs := rpc.NewServer()
+  rpcs.Register(&Echo{})
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      if deaf {
+        CloseWrite(conn)
+      }
+      go rpcs.ServeConn(conn)
+    }
+  }()
+}
+
+func check(t *testing.T, tr Transport, addr string) {
+  for i := 0; i < 10; i++ {
+    args := fmt.Sprintf("hello %v", i)
+    var reply string
+    if err := tr.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+      t.Fatalf("Call(): %v", err)
+    }
+    if reply != args {
+      t.Fatalf("wrong reply %v, expected %v", reply, args)
+    }
+  }
+}
+
+func TestTransports(t *testing.T) {
+  mem := NewMem()
+  trs := []struct {
+    name string
+    tr Transport
+    addr string
+  }{
+    {"unix", Unix{}, port("basic")},
+    {"tcp", TCP{}, "127.0.0.1:0"},
+    {"mem", mem, "basic"},
+  }
+
+  for _, x := range trs {
+    fmt.Printf("Test: RPC over %v ...\n", x.name)
+
+    l, err := x.tr.Listen(x.addr)
+    if err != nil {
+      t.Fatalf("Listen(%v): %v", x.addr, err)
+    }
+    addr := l.Addr().String()
+    serve(l, false)
+    check(t, x.tr, addr)
+
+    l.Close()
+    var reply string
+    args := "x"
+    if x.name == "tcp" {
+      // TCP calls are pooled, and the pooled connection
+      // outlives the listener; a new one must fail.
+      if conn, err := x.tr.Dial(addr); err == nil {
+        conn.Close()
+        t.Fatalf("Dial() succeeded after Close()")
+      }
+    } else if x.tr.Call(addr, "Echo.Echo", &args, &reply) == nil {
+      t.Fatalf("Call() succeeded after Close()")
+    }
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func TestMem(t *testing.T) {
+  fmt.Printf("Test: In-memory network ...\n")
+
+  mem := NewMem()
+  var reply string
+  args := "x"
+  if err := mem.Call("nobody", "Echo.Echo", &args, &reply); err != ErrRefused {
+    t.Fatalf("Call() to a missing address returned %v", err)
+  }
+
+  // separate networks don't see each other.
+  l, _ := mem.Listen("a")
+  serve(l, false)
+  check(t, mem, "a")
+  if NewMem().Call("a", "Echo.Echo", &args, &reply) == nil {
+    t.Fatalf("Call() reached a listener on another network")
+  }
+
+  // a half-closed connection loses the reply.
+  l1, _ := mem.Listen("deaf")
+  serve(l1, true)
+  if mem.Call("deaf", "Echo.Echo", &args, &reply) == nil {
+    t.Fatalf("Call() succeeded though the reply was discarded")
+  }
+
+  // listening again on an address replaces the old listener.
+  l2, _ := mem.Listen("deaf")
+  serve(l2, false)
+  check(t, mem, "deaf")
+
+  l.Close()
+  l1.Close()
+  l2.Close()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+type slowDial struct {
+  Transport
+}
+
+func (s slowDial) Dial(addr string) (net.Conn, error) {
+  time.Sleep(500 * time.Millisecond)
+  return s.Transport.Dial(addr)
+}
+
+func TestPool(t *testing.T) {
+  mem := NewMem()
+  l, _ := mem.Listen("pool")
+  defer l.Close()
+
+  var mu sync.Mutex
+  var conns []net.Conn
+  rpcs := rpc.NewServer()
+  rpcs.Register(&Echo{})
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      mu.Lock()
+      conns = append(conns, conn)
+      mu.Unlock()
+      go rpcs.ServeConn(conn)
+    }
+  }()
+  naccepted := func() int {
+    mu.Lock()
+    defer mu.Unlock()
+    return len(conns)
+  }
+
+  pool := NewPool(mem, 300 * time.Millisecond, 1)
+  defer pool.Close()
+
+  fmt.Printf("Test: Pool reuses connections ...\n")
+
+  check(t, pool, "pool")
+  check(t, pool, "pool")
+  if n := naccepted(); n != 1 {
+    t.Fatalf("pool opened %v connections, expected 1", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool reconnects after a failure ...\n")
+
+  mu.Lock()
+  conns[0].Close()
+  mu.Unlock()
+  args := "x"
+  var reply string
+  pool.Call("pool", "Echo.Echo", &args, &reply) // may fail
+  check(t, pool, "pool")
+  if n := naccepted(); n != 2 {
+    t.Fatalf("pool opened %v connections, expected 2", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool calls time out ...\n")
+
+  d := time.Second
+  var ok bool
+  t0 := time.Now()
+  if err := pool.Call("pool", "Echo.Sleep", &d, &ok); err != ErrTimeout {
+    t.Fatalf("slow call returned %v, expected ErrTimeout", err)
+  }
+  if time.Since(t0) > d {
+    t.Fatalf("slow call did not time out early")
+  }
+  check(t, pool, "pool")
+  if n := naccepted(); n != 2 {
+    t.Fatalf("a timed-out call closed the connection")
+  }
+  time.Sleep(d)
+  if ok {
+    t.Fatalf("a timed-out call's reply arrived after all")
+  }
+
+  // a call that fails at the server leaves the connection be.
+  if err := pool.Call("pool", "Echo.Nope", &args, &reply); err == nil {
+    t.Fatalf("call to a missing method succeeded")
+  }
+  check(t, pool, "pool")
+  if n := naccepted(); n != 2 {
+    t.Fatalf("a failed call closed the connection")
+  }
+
+  if err := NewPool(mem, time.Second, 0).Call("nobody", "Echo.Echo",
+                                              &args, &reply); err != ErrRefused {
+    t.Fatalf("call to a missing address returned %v", err)
+  }
+
+  // the first caller's dial is under its deadline too.
+  t0 = time.Now()
+  slow := NewPool(slowDial{mem}, 100 * time.Millisecond, 0)
+  if err := slow.Call("pool", "Echo.Echo", &args, &reply); err != ErrTimeout {
+    t.Fatalf("call with a slow dial returned %v, expected ErrTimeout", err)
+  }
+  if time.Since(t0) > 400 * time.Millisecond {
+    t.Fatalf("slow dial did not time out early")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool limits outstanding calls ...\n")
+
+  done := make(chan bool)
+  go func() {
+    d := 200 * time.Millisecond
+    var ok bool
+    done <- pool.Call("pool", "Echo.Sleep", &d, &ok) == nil
+  }()
+  time.Sleep(50 * time.Millisecond)
+  t0 = time.Now()
+  check(t, pool, "pool")
+  if time.Since(t0) < 100 * time.Millisecond {
+    t.Fatalf("call did not wait for an outstanding call")
+  }
+  if <-done == false {
+    t.Fatalf("slow call failed")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestUnixPool(t *testing.T) {
+  addr := port("upool")
+  defer os.Remove(addr)
+
+  var mu sync.Mutex
+  naccepted := 0
+  nrequests := 0
+  start := func() net.Listener {
+    l, err := Unix{}.Listen(addr)
+    if err != nil {
+      t.Fatalf("Listen(): %v", err)
+    }
+    rpcs := rpc.NewServer()
+    rpcs.Register(&Echo{})
+    go func() {
+      for {
+        conn, err := l.Accept()
+        if err != nil {
+          return
+        }
+        mu.Lock()
+        naccepted++
+        mu.Unlock()
+        go ServeConn(rpcs, conn, func() {
+          mu.Lock()
+          nrequests++
+          mu.Unlock()
+        })
+      }
+    }()
+    return l
+  }
+  counts := func() (int, int) {
+    mu.Lock()
+    defer mu.Unlock()
+    return naccepted, nrequests
+  }
+
+  fmt.Printf("Test: Unix calls share a connection ...\n")
+
+  var u Unix
+  l := start()
+  check(t, u, addr)
+  check(t, u, addr)
+  if na, nr := counts(); na != 1 || nr != 20 {
+    t.Fatalf("%v connections for %v requests, expected 1 for 20", na, nr)
+  }
+  check(t, Unix{Fresh: true}, addr)
+  if na, nr := counts(); na != 11 || nr != 30 {
+    t.Fatalf("%v connections for %v requests with Fresh, expected 11 for 30",
+      na, nr)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Unix pool notices faults ...\n")
+
+  args := "x"
+  var reply string
+  // a removed socket file (a deaf server).
+  os.Rename(addr, addr + "-x")
+  if u.Call(addr, "Echo.Echo", &args, &reply) == nil {
+    t.Fatalf("call succeeded after the socket file was removed")
+  }
+  os.Rename(addr + "-x", addr)
+  check(t, u, addr)
+
+  // a closed listener (a killed server).
+  l.Close()
+  if u.Call(addr, "Echo.Echo", &args, &reply) == nil {
+    t.Fatalf("call succeeded after the listener closed")
+  }
+
+  // a restarted one.
+  l = start()
+  defer l.Close()
+  na, _ := counts()
+  check(t, u, addr)
+  if n, _ := counts(); n != na + 1 {
+    t.Fatalf("restarted server got %v connections, expected 1", n - na)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
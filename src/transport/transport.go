@@ -0,0 +1,174 @@
+package transport
+
+//
+// How peers and clients reach each other.
+//
+// A Transport knows how to listen on an address, dial one,
+// and send a single RPC to one. Servers and clerks take a
+// Transport in their constructors; nil means Unix, the
+// domain sockets under /var/tmp that the labs always used.
+//
+// Unix{} -- unix-domain sockets; addresses are file names.
+//           calls share one connection per address; see unix.go
+// TCP{} -- TCP; addresses are host:port. calls share one
+//          connection per address; see pool.go
+// NewMem() -- an in-process network, for tests
+//
+
+import "net"
+import "net/rpc"
+import "encoding/gob"
+import "bufio"
+import "io"
+import "errors"
+
+type Transport interface {
+  Listen(addr string) (net.Listener, error)
+  Dial(addr string) (net.Conn, error)
+
+  // send one RPC and wait for the reply. the reply is
+  // only valid if Call() returns nil.
+  Call(addr string, name string, args interface{}, reply interface{}) error
+}
+
+// the transport to use when none was given.
+var Default Transport = Unix{}
+
+//
+// send an RPC with tr, or with Default if tr is nil.
+//
+func Call(tr Transport, addr string, name string,
+          args interface{}, reply interface{}) error {
+  if tr == nil {
+    tr = Default
+  }
+  return tr.Call(addr, name, args, reply)
+}
+
+//
+// listen with tr, or with Default if tr is nil.
+//
+func Listen(tr Transport, addr string) (net.Listener, error) {
+  if tr == nil {
+    tr = Default
+  }
+  return tr.Listen(addr)
+}
+
+//
+// like Listen(), for a server that will serve rpcs on the
+// listener. a transport that can hand calls straight to
+// rpcs, as a simulated one does, is told about it.
+//
+func ListenRPC(tr Transport, addr string, rpcs *rpc.Server) (net.Listener, error) {
+  if tr == nil {
+    tr = Default
+  }
+  if r, ok := tr.(interface{
+    ListenRPC(addr string, rpcs *rpc.Server) (net.Listener, error)
+  }); ok {
+    return r.ListenRPC(addr, rpcs)
+  }
+  return tr.Listen(addr)
+}
+
+//
+// dial addr and send one RPC over a fresh connection.
+//
+func dialCall(tr Transport, addr string, name string,
+              args interface{}, reply interface{}) error {
+  conn, err := tr.Dial(addr)
+  if err != nil {
+    return err
+  }
+  c := rpc.NewClient(conn)
+  defer c.Close()
+
+  return c.Call(name, args, reply)
+}
+
+//
+// serve conn with rpcs, as rpcs.ServeConn(conn) does, and
+// call counted() for every request that arrives on it. a
+// connection can carry many requests, so counting accepted
+// connections doesn't count RPCs.
+//
+func ServeConn(rpcs *rpc.Server, conn net.Conn, counted func()) {
+  buf := bufio.NewWriter(conn)
+  rpcs.ServeCodec(&countCodec{
+    rwc: conn,
+    dec: gob.NewDecoder(bufio.NewReader(conn)),
+    enc: gob.NewEncoder(buf),
+    buf: buf,
+    counted: counted,
+  })
+}
+
+// net/rpc's gob server codec, plus a count.
+type countCodec struct {
+  rwc io.ReadWriteCloser
+  dec *gob.Decoder
+  enc *gob.Encoder
+  buf *bufio.Writer
+  counted func()
+}
+
+func (c *countCodec) ReadRequestHeader(r *rpc.Request) error {
+  err := c.dec.Decode(r)
+  if err == nil {
+    c.counted()
+  }
+  return err
+}
+
+func (c *countCodec) ReadRequestBody(body interface{}) error {
+  return c.dec.Decode(body)
+}
+
+func (c *countCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+  if err := c.enc.Encode(r); err != nil {
+    if c.buf.Flush() == nil {
+      c.Close()
+    }
+    return err
+  }
+  if err := c.enc.Encode(body); err != nil {
+    if c.buf.Flush() == nil {
+      c.Close()
+    }
+    return err
+  }
+  return c.buf.Flush()
+}
+
+func (c *countCodec) Close() error {
+  return c.rwc.Close()
+}
+
+//
+// shut down the sending half of an accepted connection,
+// so that the server's reply is lost but the request is
+// still processed. used to simulate unreliable networks.
+//
+func CloseWrite(conn net.Conn) error {
+  if c, ok := conn.(interface{ CloseWrite() error }); ok {
+    return c.CloseWrite()
+  }
+  return errors.New("transport: connection cannot be half-closed")
+}
+
+type TCP struct{}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+  return net.Listen("tcp", addr)
+}
+
+func (TCP) Dial(addr string) (net.Conn, error) {
+  return net.Dial("tcp", addr)
+}
+
+var tcpPool = NewPool(TCP{}, DefaultTimeout, DefaultLimit)
+
+func (TCP) Call(addr string, name string, args interface{}, reply interface{}) error {
+  return tcpPool.Call(addr, name, args, reply)
+}
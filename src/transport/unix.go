@@ -0,0 +1,140 @@
+package transport
+
+//
+// Unix-domain sockets. Calls go through a shared Pool, so
+// that they reuse one connection per address. The tests fault
+// a server by what they do to its socket file, though, and an
+// open connection doesn't see that: partitions and deaf peers
+// remove the file (or a link to it), and a killed server
+// closes its listener, which removes it too. So before each
+// call the pool checks that addr still names the listener its
+// connection was dialed to, and dials again if not.
+//
+// Unix{Fresh: true} dials a connection for every call, as the
+// labs used to, for servers that fault themselves when they
+// accept one.
+//
+
+import "net"
+import "os"
+import "sync"
+import "syscall"
+
+type Unix struct {
+  Fresh bool // don't pool; one connection per call
+}
+
+var unixPool = NewPool(Unix{}, DefaultTimeout, DefaultLimit)
+
+// a socket file, as it is known to the file system.
+type fileID struct {
+  dev uint64
+  ino uint64
+}
+
+//
+// the listeners this process has open, by socket file, each
+// with a number that is never reused, since a new socket can
+// get an old one's inode.
+//
+var listening struct {
+  mu sync.Mutex
+  files map[fileID]int64
+  n int64
+}
+
+func statID(addr string) (fileID, bool) {
+  fi, err := os.Stat(addr)
+  if err != nil {
+    return fileID{}, false
+  }
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  if !ok {
+    return fileID{}, false
+  }
+  return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// the number of the listener open on socket file id, or 0.
+func listener(id fileID) int64 {
+  listening.mu.Lock()
+  defer listening.mu.Unlock()
+  return listening.files[id]
+}
+
+func (Unix) Listen(addr string) (net.Listener, error) {
+  os.Remove(addr)
+  l, err := net.Listen("unix", addr)
+  if err != nil {
+    return nil, err
+  }
+  ul := &unixListener{Listener: l}
+  if id, ok := statID(addr); ok {
+    listening.mu.Lock()
+    if listening.files == nil {
+      listening.files = make(map[fileID]int64)
+    }
+    listening.n++
+    listening.files[id] = listening.n
+    ul.id = id
+    ul.n = listening.n
+    listening.mu.Unlock()
+  }
+  return ul, nil
+}
+
+func (Unix) Dial(addr string) (net.Conn, error) {
+  id, _ := statID(addr)
+  conn, err := net.Dial("unix", addr)
+  if err != nil {
+    return nil, err
+  }
+  return &unixConn{Conn: conn, id: id, n: listener(id)}, nil
+}
+
+func (u Unix) Call(addr string, name string, args interface{}, reply interface{}) error {
+  if u.Fresh {
+    return dialCall(u, addr, name, args, reply)
+  }
+  return unixPool.Call(addr, name, args, reply)
+}
+
+//
+// true if addr no longer names the listener that conn was
+// dialed to: the file is gone, is another socket, or is a
+// socket whose listener this process has closed.
+//
+func (Unix) moved(addr string, conn net.Conn) bool {
+  uc, ok := conn.(*unixConn)
+  if !ok {
+    return false
+  }
+  id, ok := statID(addr)
+  return !ok || id != uc.id || listener(id) != uc.n
+}
+
+type unixListener struct {
+  net.Listener
+  id fileID
+  n int64
+}
+
+func (l *unixListener) Close() error {
+  listening.mu.Lock()
+  if l.n != 0 && listening.files[l.id] == l.n {
+    delete(listening.files, l.id)
+  }
+  listening.mu.Unlock()
+  return l.Listener.Close()
+}
+
+type unixConn struct {
+  net.Conn
+  id fileID
+  n int64 // listener number when dialed; 0 if not ours
+}
+
+// so that CloseWrite() still works on a dialed connection.
+func (c *unixConn) CloseWrite() error {
+  return CloseWrite(c.Conn)
+}
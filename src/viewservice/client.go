@@ -1,6 +1,6 @@
 package viewservice
 
-import "net/rpc"
+import "transport"
 import "fmt"
 
 //
@@ -10,10 +10,19 @@ import "fmt"
 type Clerk struct {
   me string      // client's name (host:port)
   server string  // viewservice's host:port
+  tr transport.Transport
 }
 
 func MakeClerk(me string, server string) *Clerk {
+  return MakeClerkOn(nil, me, server)
+}
+
+//
+// like MakeClerk(), but sends RPCs with tr.
+//
+func MakeClerkOn(tr transport.Transport, me string, server string) *Clerk {
   ck := new(Clerk)
+  ck.tr = tr
   ck.me = me
   ck.server = server
   return ck
@@ -32,22 +41,14 @@ func MakeClerk(me string, server string) *Clerk {
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
 //
+// tr is the transport to use; nil means unix-domain sockets.
+//
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-  return false
+  return transport.Call(tr, srv, rpcname, args, reply) == nil
 }
 
 func (ck *Clerk) Ping(viewnum uint) (View, error) {
@@ -58,7 +59,7 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
   var reply PingReply
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.server, "ViewServer.Ping", args, &reply)
+  ok := call(ck.tr, ck.server, "ViewServer.Ping", args, &reply)
   if ok == false {
     return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
   }
@@ -69,7 +70,7 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
 func (ck *Clerk) Get() (View, bool) {
   args := &GetArgs{}
   var reply GetReply
-  ok := call(ck.server, "ViewServer.Get", args, &reply)
+  ok := call(ck.tr, ck.server, "ViewServer.Get", args, &reply)
   if ok == false {
     return View{}, false
   }
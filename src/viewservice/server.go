@@ -2,17 +2,20 @@ package viewservice
 
 import "net"
 import "net/rpc"
+import "transport"
+import "faults"
+import "sim"
 import "log"
 import "time"
-import "sync"
 //import "fmt"
-import "os"
 
 type ViewServer struct {
-  mu sync.Mutex
+  mu sim.Mutex
   l net.Listener
   dead bool
   me string
+  tr transport.Transport
+  clock sim.Clock
 
 
   // Your declarations here.
@@ -29,7 +32,7 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
   vs.mu.Lock()
   defer vs.mu.Unlock()
 
-  vs.times[args.Me] = time.Now()
+  vs.times[args.Me] = vs.clock.Now()
 
   //log.Printf("[View Service] Received ping(%d): %s", args.Viewnum, args.Me)
 
@@ -94,7 +97,7 @@ func (vs *ViewServer) tick() {
   }
 
   // If the primary has elapsed, try and replace it
-  if pExists && time.Since(primaryTime) > PingInterval * DeadPings {
+  if pExists && sim.Since(vs.clock, primaryTime) > PingInterval * DeadPings {
 
     /*log.Printf(`[View Service] Detected Primary Dead(%d):
                                Primary: (%s)
@@ -104,7 +107,7 @@ func (vs *ViewServer) tick() {
     newView := View{ Viewnum: view.Viewnum + 1,
                      Primary: view.Backup }
 
-    newView.Backup = findBackup(vs.times, &view)
+    newView.Backup = findBackup(vs.clock, vs.times, &view)
 
     vs.currentView = newView.Viewnum
     vs.views[vs.currentView] = newView
@@ -113,13 +116,13 @@ func (vs *ViewServer) tick() {
                                Primary: (%s)
                                Backup: (%s)`, newView.Viewnum, newView.Primary,
                                               newView.Backup)*/
-  } else if bExists && time.Since(backupTime) > PingInterval * DeadPings {
+  } else if bExists && sim.Since(vs.clock, backupTime) > PingInterval * DeadPings {
 
     // Only replace the secondary.
     newView := View{ Viewnum: view.Viewnum + 1,
                      Primary: view.Primary }
 
-    newView.Backup = findBackup(vs.times, &view)
+    newView.Backup = findBackup(vs.clock, vs.times, &view)
 
     vs.currentView = newView.Viewnum
     vs.views[vs.currentView] = newView
@@ -138,7 +141,16 @@ func (vs *ViewServer) Kill() {
 }
 
 func StartServer(me string) *ViewServer {
+  return StartServerOn(nil, me)
+}
+
+//
+// like StartServer(), but listens with tr.
+//
+func StartServerOn(tr transport.Transport, me string) *ViewServer {
   vs := new(ViewServer)
+  vs.tr = tr
+  vs.clock = sim.ClockOf(tr)
   vs.me = me
   // Your vs.* initializations here.
   vs.times = make(map[string]time.Time)
@@ -149,11 +161,10 @@ func StartServer(me string) *ViewServer {
   // tell net/rpc about our RPC server and handlers.
   rpcs := rpc.NewServer()
   rpcs.Register(vs)
+  faults.Register(rpcs, vs.tr)
 
   // prepare to receive connections from clients.
-  // change "unix" to "tcp" to use over a network.
-  os.Remove(vs.me) // only needed for "unix"
-  l, e := net.Listen("unix", vs.me);
+  l, e := transport.ListenRPC(vs.tr, vs.me, rpcs);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -179,12 +190,12 @@ func StartServer(me string) *ViewServer {
   }()
 
   // create a thread to call tick() periodically.
-  go func() {
+  vs.clock.Go(func() {
     for vs.dead == false {
       vs.tick()
-      time.Sleep(PingInterval)
+      vs.clock.Sleep(PingInterval)
     }
-  }()
+  })
 
   return vs
 }
@@ -230,10 +241,10 @@ func UpdateView(view *View, server string, clientnum uint) View {
 
 
 
-func findBackup(times map[string]time.Time, view *View) string {
+func findBackup(clock sim.Clock, times map[string]time.Time, view *View) string {
 
   for key, value := range times {
-    if time.Since(value) < PingInterval * DeadPings &&
+    if sim.Since(clock, value) < PingInterval * DeadPings &&
        key != view.Primary && key != view.Backup {
       return key
     }
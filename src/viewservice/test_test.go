@@ -6,6 +6,7 @@ import "time"
 import "fmt"
 import "os"
 import "strconv"
+import "sim"
 
 func check(t *testing.T, ck *Clerk, p string, b string, n uint) {
   view, _ := ck.Get()
@@ -230,3 +231,46 @@ func Test1(t *testing.T) {
 
   vs.Kill()
 }
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := sim.New(sim.Seed(t))
+  defer s.Stop()
+
+  vshost := "viewserver"
+  vs := StartServerOn(s.Node(vshost), vshost)
+  defer vs.Kill()
+
+  ck1 := MakeClerkOn(s.Node("1"), "1", vshost)
+  ck2 := MakeClerkOn(s.Node("2"), "2", vshost)
+
+  fmt.Printf("Test: Backup takes over, on simulated time ...\n")
+
+  for i := 0; i < DeadPings * 2; i++ {
+    v, _ := ck1.Get()
+    ck1.Ping(v.Viewnum)
+    ck2.Ping(0)
+    s.Sleep(PingInterval)
+  }
+  check(t, ck1, "1", "2", 0)
+  vx, _ := ck1.Get()
+
+  // ck1 falls silent; cut it off for good measure.
+  s.Partition([]string{"1"})
+  for i := 0; i < DeadPings * 2; i++ {
+    v, _ := ck2.Ping(vx.Viewnum)
+    if v.Primary == "2" {
+      break
+    }
+    s.Sleep(PingInterval)
+  }
+  check(t, ck2, "2", "", vx.Viewnum + 1)
+
+  // the viewservice's notion of time is virtual too.
+  if d := s.Now().Sub(sim.Epoch); d < PingInterval * DeadPings {
+    t.Fatalf("only %v of virtual time passed", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}